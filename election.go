@@ -0,0 +1,342 @@
+package gofactory
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/xyzj/toolbox/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// electionTTL is the lease of a leader, it is renewed every third of the ttl
+	electionTTL = time.Second * 10
+	// electionMargin is kept before the lease expires for the clock drift between the hosts
+	electionMargin = time.Second
+)
+
+// elector acquires and keeps the lease of an election
+type elector interface {
+	// acquire returns the fencing token of the new term, or 0 when another instance is the leader
+	acquire(ctx context.Context) (int64, error)
+	// renew extends the lease of the term, false means the lease is lost
+	renew(ctx context.Context, token int64) (bool, error)
+	// release gives up the lease of the term
+	release(ctx context.Context, token int64) error
+}
+
+// Leadership is the campaign of this instance in an election, see Service.Campaign.
+type Leadership struct {
+	elector   elector
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error // 释放租约的错误
+	name      string
+	token     atomic.Int64 // 当前任期的fencing token,非leader时为0
+	deadline  atomic.Int64 // 租约的安全截止时间,纳秒
+	onElected []func(token int64)
+	onRevoked []func()
+	mu        sync.Mutex
+}
+
+// Name returns the name of the election
+func (e *Leadership) Name() string {
+	return e.name
+}
+
+// IsLeader reports whether this instance is the leader now
+func (e *Leadership) IsLeader() bool {
+	return e.Token() > 0
+}
+
+// Token returns the fencing token of the current term, or 0 when this instance is not the leader.
+// The tokens increase with every new term, pass it to the storage written by the leader,
+// so that the writes of an old leader which lost its lease can be rejected.
+func (e *Leadership) Token() int64 {
+	// 租约即将过期时不再视为leader,即使续约循环尚未运行
+	if time.Now().UnixNano() >= e.deadline.Load() {
+		return 0
+	}
+	return e.token.Load()
+}
+
+// OnElected registers f which is called when this instance becomes the leader, with the fencing token of the term.
+// f is called right away when this instance is the leader already. f should return quickly, run the jobs in a goroutine.
+func (e *Leadership) OnElected(f func(token int64)) {
+	if f == nil {
+		return
+	}
+	e.mu.Lock()
+	e.onElected = append(e.onElected, f)
+	t := e.token.Load()
+	e.mu.Unlock()
+	if t > 0 {
+		f(t)
+	}
+}
+
+// OnRevoked registers f which is called when this instance is not the leader any more,
+// because the lease is lost or resigned, the jobs of the leader should be stopped.
+func (e *Leadership) OnRevoked(f func()) {
+	if f == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onRevoked = append(e.onRevoked, f)
+}
+
+// Resign stops the campaign, the lease is released when this instance is the leader,
+// so that another instance is elected right away.
+func (e *Leadership) Resign() error {
+	e.cancel()
+	<-e.done
+	return e.err
+}
+
+// Done returns a channel which is closed when the campaign is stopped
+func (e *Leadership) Done() <-chan struct{} {
+	return e.done
+}
+
+// elected stores the token and calls the callbacks out of the lock,
+// so that a callback may call OnElected or OnRevoked.
+// A callback registered meanwhile is called either here or by OnElected, never both.
+func (e *Leadership) elected(token int64, l logger.Logger) {
+	e.mu.Lock()
+	e.token.Store(token)
+	ff := slices.Clone(e.onElected)
+	e.mu.Unlock()
+	for _, f := range ff {
+		e.callback(func() { f(token) }, l)
+	}
+}
+
+func (e *Leadership) revoked(l logger.Logger) {
+	e.mu.Lock()
+	if e.token.Swap(0) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	ff := slices.Clone(e.onRevoked)
+	e.mu.Unlock()
+	for _, f := range ff {
+		e.callback(f, l)
+	}
+}
+
+// callback calls f and logs its panic, so that a callback can not stop the campaign
+func (e *Leadership) callback(f func(), l logger.Logger) {
+	defer func() {
+		if err := recover(); err != nil {
+			l.Error(fmt.Sprintf("[election] %s callback panic: %+v", e.name, err))
+		}
+	}()
+	f()
+}
+
+// campaign tries to acquire the lease until ctx is done, and renews it while this instance is the leader.
+// The lease is measured from before the acquire or renew call, when a renewal fails and the lease would expire
+// before the next one, this instance steps down, so that it is never the leader with an expired lease.
+func (e *Leadership) campaign(ctx context.Context, l logger.Logger) {
+	defer close(e.done)
+	t1 := time.NewTicker(electionTTL / 3)
+	defer t1.Stop()
+	for {
+		e.step(ctx, l)
+		select {
+		case <-ctx.Done():
+			if token := e.token.Load(); token > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				if err := e.elector.release(ctx, token); err != nil {
+					e.err = errors.New("[election] " + e.name + " release error:" + err.Error())
+					l.Error(e.err.Error())
+				}
+				cancel()
+				e.revoked(l)
+				l.Info("[election] " + e.name + " resigned")
+			}
+			return
+		case <-t1.C:
+		}
+	}
+}
+
+// step acquires the lease when this instance is not the leader, otherwise renews it
+func (e *Leadership) step(ctx context.Context, l logger.Logger) {
+	start := time.Now()
+	if token := e.token.Load(); token == 0 {
+		t, err := e.elector.acquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			l.Error("[election] " + e.name + " acquire error:" + err.Error())
+		}
+		if t > 0 {
+			e.deadline.Store(start.Add(electionTTL - electionMargin).UnixNano())
+			l.Info("[election] " + e.name + " elected, token:" + strconv.FormatInt(t, 10))
+			e.elected(t, l)
+		}
+	} else {
+		rctx, cancel := context.WithDeadline(ctx, time.Unix(0, e.deadline.Load()))
+		ok, err := e.elector.renew(rctx, token)
+		cancel()
+		switch {
+		case err == nil && ok:
+			e.deadline.Store(start.Add(electionTTL - electionMargin).UnixNano())
+		case err == nil && !ok:
+			l.Warning("[election] " + e.name + " lease lost")
+			e.revoked(l)
+		case time.Now().Add(electionTTL/3).UnixNano() >= e.deadline.Load():
+			// 下次续约前租约将过期
+			l.Error("[election] " + e.name + " renew error, step down:" + err.Error())
+			e.revoked(l)
+		default:
+			l.Error("[election] " + e.name + " renew error:" + err.Error())
+		}
+	}
+}
+
+func startCampaign(ctx context.Context, name string, el elector, l logger.Logger) *Leadership {
+	ctx, cancel := context.WithCancel(ctx)
+	e := &Leadership{
+		elector: el,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		name:    name,
+	}
+	go e.campaign(ctx, l)
+	return e
+}
+
+var (
+	// 成功时返回新的fencing token
+	redisAcquireScript = redis.NewScript(`if not redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then return 0 end
+local t = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. t, 'PX', ARGV[2])
+return t`)
+	redisRenewScript = redis.NewScript(`if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+return 0`)
+	redisReleaseScript = redis.NewScript(`if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0`)
+)
+
+// redisElector keeps the lease in `<root>/election/{name}`, whose value is `<instance id>:<token>`,
+// and the last token in `<root>/election/{name}.token`, both keys are in the same cluster slot.
+type redisElector struct {
+	cli   *cliRedis
+	key   string
+	token string
+	id    string
+}
+
+func newRedisElector(cli *cliRedis, root, name, id string) *redisElector {
+	key := appendRootPath(root, "election/{"+name+"}", "/")
+	return &redisElector{
+		cli:   cli,
+		key:   key,
+		token: key + ".token",
+		id:    id,
+	}
+}
+
+func (r *redisElector) ready() error {
+	if !r.cli.loaded.Load() {
+		return errors.New("redis client not ready")
+	}
+	return nil
+}
+
+func (r *redisElector) acquire(ctx context.Context) (int64, error) {
+	// 等待客户端连接
+	if r.ready() != nil {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.cli.timeoutWrite())
+	defer cancel()
+	t, err := redisAcquireScript.Run(ctx, r.cli.client(), []string{r.key, r.token}, r.id, electionTTL.Milliseconds()).Int64()
+	return t, r.cli.checkRedisDialErr(err)
+}
+
+func (r *redisElector) renew(ctx context.Context, token int64) (bool, error) {
+	if err := r.ready(); err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.cli.timeoutWrite())
+	defer cancel()
+	n, err := redisRenewScript.Run(ctx, r.cli.client(), []string{r.key}, r.id+":"+strconv.FormatInt(token, 10), electionTTL.Milliseconds()).Int64()
+	return n == 1, r.cli.checkRedisDialErr(err)
+}
+
+func (r *redisElector) release(ctx context.Context, token int64) error {
+	if err := r.ready(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.cli.timeoutWrite())
+	defer cancel()
+	return r.cli.checkRedisDialErr(redisReleaseScript.Run(ctx, r.cli.client(), []string{r.key}, r.id+":"+strconv.FormatInt(token, 10)).Err())
+}
+
+// boltElector holds the lock of a bolt file while it is the leader,
+// the lock is released by the system when the process exits, the last token is saved in the file.
+type boltElector struct {
+	db   *bolt.DB
+	path string
+	name []byte
+}
+
+func (b *boltElector) acquire(ctx context.Context) (int64, error) {
+	db, err := bolt.Open(b.path, 0o644, &bolt.Options{Timeout: time.Millisecond * 100})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.New("open bolt file error:" + err.Error())
+	}
+	var t uint64
+	err = db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte("election"))
+		if err != nil {
+			return err
+		}
+		if v := bk.Get(b.name); len(v) == 8 {
+			t = binary.BigEndian.Uint64(v)
+		}
+		t++
+		return bk.Put(b.name, binary.BigEndian.AppendUint64(nil, t))
+	})
+	if err != nil {
+		db.Close()
+		return 0, err
+	}
+	b.db = db
+	return int64(t), nil
+}
+
+func (b *boltElector) renew(ctx context.Context, token int64) (bool, error) {
+	return b.db != nil, nil
+}
+
+func (b *boltElector) release(ctx context.Context, token int64) error {
+	if b.db == nil {
+		return nil
+	}
+	err := b.db.Close()
+	b.db = nil
+	return err
+}
+
+// electionName checks the name of an election
+func electionName(name string) error {
+	if name == "" || strings.ContainsAny(name, "{}") {
+		return errors.New("[election] name error:" + name)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xyzj/toolbox/logger"
+)
+
+// testElector returns the configured results
+type testElector struct {
+	token    int64
+	ok       bool
+	err      error
+	released int
+}
+
+func (x *testElector) acquire(ctx context.Context) (int64, error) {
+	return x.token, x.err
+}
+
+func (x *testElector) renew(ctx context.Context, token int64) (bool, error) {
+	return x.ok, x.err
+}
+
+func (x *testElector) release(ctx context.Context, token int64) error {
+	x.released++
+	return nil
+}
+
+func TestLeadershipStep(t *testing.T) {
+	errRenew := errors.New("timeout")
+	tests := []struct {
+		name     string
+		token    int64         // 当前任期
+		deadline time.Duration // 当前租约剩余时间
+		elector  testElector
+		leader   bool
+		elected  int
+		revoked  int
+	}{
+		{"acquire", 0, 0, testElector{token: 5}, true, 1, 0},
+		{"acquire by other", 0, 0, testElector{}, false, 0, 0},
+		{"acquire error", 0, 0, testElector{err: errRenew}, false, 0, 0},
+		{"renew", 5, electionTTL / 3, testElector{ok: true}, true, 0, 0},
+		{"renew lost", 5, electionTTL - electionMargin, testElector{}, false, 0, 1},
+		{"renew error", 5, electionTTL - electionMargin, testElector{err: errRenew}, true, 0, 0},
+		{"renew error step down", 5, electionTTL/3 - time.Millisecond*100, testElector{err: errRenew}, false, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Leadership{elector: &tt.elector, name: "test"}
+			elected, revoked := 0, 0
+			e.OnElected(func(token int64) { elected++ })
+			e.OnRevoked(func() { revoked++ })
+			e.token.Store(tt.token)
+			e.deadline.Store(time.Now().Add(tt.deadline).UnixNano())
+			e.step(context.Background(), logger.NewNilLogger())
+			if e.IsLeader() != tt.leader || elected != tt.elected || revoked != tt.revoked {
+				t.Fatalf("leader %v, elected %d, revoked %d", e.IsLeader(), elected, revoked)
+			}
+			// 续约成功时租约从续约前开始计算
+			if tt.elector.ok && time.Until(time.Unix(0, e.deadline.Load())) <= electionTTL/3 {
+				t.Fatal("deadline is not extended")
+			}
+		})
+	}
+}
+
+func TestLeadershipToken(t *testing.T) {
+	e := &Leadership{elector: &testElector{}, name: "test"}
+	e.token.Store(3)
+	e.deadline.Store(time.Now().Add(time.Second).UnixNano())
+	if e.Token() != 3 {
+		t.Fatalf("token %d", e.Token())
+	}
+	// 租约过期后即使续约循环尚未运行也不再是leader
+	e.deadline.Store(time.Now().Add(-time.Millisecond).UnixNano())
+	if e.Token() != 0 || e.IsLeader() {
+		t.Fatalf("token %d after the deadline", e.Token())
+	}
+}
+
+func TestLeadershipCallbackPanic(t *testing.T) {
+	el := &testElector{token: 5, ok: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Leadership{elector: el, cancel: cancel, done: make(chan struct{}), name: "test"}
+	e.OnElected(func(token int64) { panic("elected") })
+	e.OnRevoked(func() { panic("revoked") })
+	go e.campaign(ctx, logger.NewNilLogger())
+	for i := 0; !e.IsLeader(); i++ {
+		if i > 50 {
+			t.Fatal("not elected")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	// 回调的panic不会结束竞选,辞职时仍释放租约
+	select {
+	case <-e.Done():
+		t.Fatal("campaign is stopped by the callback")
+	default:
+	}
+	if err := e.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if e.IsLeader() || el.released != 1 {
+		t.Fatalf("leader %v, released %d", e.IsLeader(), el.released)
+	}
+}
+
+func TestLeadershipCallback(t *testing.T) {
+	e := &Leadership{elector: &testElector{}, name: "test"}
+	e.deadline.Store(time.Now().Add(time.Second).UnixNano())
+	n := 0
+	// 回调中注册的回调在释放锁后调用
+	e.OnElected(func(token int64) {
+		e.OnElected(func(token int64) { n++ })
+		e.OnRevoked(func() { n++ })
+	})
+	e.elected(1, logger.NewNilLogger())
+	e.revoked(logger.NewNilLogger())
+	if n != 2 {
+		t.Fatalf("called %d", n)
+	}
+}
+
+func TestBoltElector(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "election.db")
+	a := &boltElector{path: name, name: []byte("test")}
+	b := &boltElector{path: name, name: []byte("test")}
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		f    func() (int64, error)
+		want int64
+	}{
+		{"a acquire", func() (int64, error) { return a.acquire(ctx) }, 1},
+		{"b excluded", func() (int64, error) { return b.acquire(ctx) }, 0},
+		{"a release", func() (int64, error) { return 0, a.release(ctx, 1) }, 0},
+		{"b acquire", func() (int64, error) { return b.acquire(ctx) }, 2},
+		{"a excluded", func() (int64, error) { return a.acquire(ctx) }, 0},
+	}
+	for _, tt := range tests {
+		x, err := tt.f()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if x != tt.want {
+			t.Fatalf("%s: token %d, want %d", tt.name, x, tt.want)
+		}
+	}
+	if ok, _ := a.renew(ctx, 1); ok {
+		t.Fatal("a renewed without the lock")
+	}
+	if ok, _ := b.renew(ctx, 2); !ok {
+		t.Fatal("b lost the lock")
+	}
+	b.release(ctx, 2)
+}
+
+func TestCampaignLocal(t *testing.T) {
+	s, err := New(WithLogger(logger.NewNilLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "election.db")
+	a, err := s.CampaignLocal(context.Background(), "test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Resign()
+	deadline := time.Now().Add(time.Second * 3)
+	for !a.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !a.IsLeader() {
+		t.Fatal("a is not elected")
+	}
+	b, err := s.CampaignLocal(context.Background(), "test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	if b.IsLeader() {
+		t.Fatal("both are the leader")
+	}
+	if err := b.Resign(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PickFilter narrows the instances considered by PickService.
+// A required filter drops the instances which do not match,
+// a preferred filter keeps only the matched instances when there is any, otherwise it keeps all.
+type PickFilter struct {
+	match  func(info *svrinfo, self *svrinfo) bool
+	prefer bool
+}
+
+// FilterTag keeps the instances which have the tag
+func FilterTag(tag string) PickFilter {
+	return PickFilter{match: func(info, _ *svrinfo) bool {
+		return slices.Contains(info.Tags, tag)
+	}}
+}
+
+// FilterZone keeps the instances in the zone
+func FilterZone(zone string) PickFilter {
+	return PickFilter{match: func(info, _ *svrinfo) bool {
+		return info.Zone == zone
+	}}
+}
+
+// FilterMetadata keeps the instances whose metadata key equals value
+func FilterMetadata(key, value string) PickFilter {
+	return PickFilter{match: func(info, _ *svrinfo) bool {
+		v, ok := info.Metadata[key]
+		return ok && v == value
+	}}
+}
+
+// FilterVersion keeps the instances whose version meets the constraint,
+// such as ">=1.4", "<2", "!=1.4.1" or "1.4.2", which means "=1.4.2".
+// The versions are compared by the numeric parts, the instances without a version never match.
+func FilterVersion(constraint string) (PickFilter, error) {
+	op, ver := "=", strings.TrimSpace(constraint)
+	for _, v := range []string{">=", "<=", "!=", "==", ">", "<", "="} {
+		if strings.HasPrefix(ver, v) {
+			op, ver = v, strings.TrimSpace(ver[len(v):])
+			break
+		}
+	}
+	want, ok := parseVersion(ver)
+	if !ok {
+		return PickFilter{}, errors.New("[discover] version error:" + constraint)
+	}
+	return PickFilter{match: func(info, _ *svrinfo) bool {
+		v, ok := parseVersion(info.Version)
+		if !ok {
+			return false
+		}
+		c := slices.Compare(v, want)
+		switch op {
+		case ">=":
+			return c >= 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		case "<":
+			return c < 0
+		case "!=":
+			return c != 0
+		}
+		return c == 0
+	}}, nil
+}
+
+// PreferZone picks the instances in the zone first, other instances are picked only when none is in the zone
+func PreferZone(zone string) PickFilter {
+	f := FilterZone(zone)
+	f.prefer = true
+	return f
+}
+
+// PreferSameZone picks the instances in the zone of this instance first, see OptDiscoverZone
+func PreferSameZone() PickFilter {
+	return PickFilter{prefer: true, match: func(info, self *svrinfo) bool {
+		return info.Zone == self.Zone
+	}}
+}
+
+// ParsePickFilter parses a filter expression, which is one of:
+//
+//	tag=canary
+//	zone=sh1
+//	meta.<key>=<value>
+//	version>=1.4, also with >, <=, <, =, !=
+//	prefer_zone=sh1
+//	same_zone
+func ParsePickFilter(expr string) (PickFilter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "same_zone" {
+		return PreferSameZone(), nil
+	}
+	if v, ok := strings.CutPrefix(expr, "version"); ok {
+		return FilterVersion(v)
+	}
+	k, v, ok := strings.Cut(expr, "=")
+	if !ok {
+		return PickFilter{}, errors.New("[discover] filter error:" + expr)
+	}
+	k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+	switch k {
+	case "tag":
+		return FilterTag(v), nil
+	case "zone":
+		return FilterZone(v), nil
+	case "prefer_zone":
+		return PreferZone(v), nil
+	}
+	if mk, ok := strings.CutPrefix(k, "meta."); ok && mk != "" {
+		return FilterMetadata(mk, v), nil
+	}
+	return PickFilter{}, errors.New("[discover] filter error:" + expr)
+}
+
+// parseVersion returns the numeric parts of a version like v1.4.2-rc1
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+ "); i >= 0 {
+		s = s[:i]
+	}
+	if s == "" {
+		return nil, false
+	}
+	ss := strings.Split(s, ".")
+	x := make([]int, 0, 3)
+	for _, v := range ss {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, false
+		}
+		x = append(x, n)
+	}
+	// 1.4 与 1.4.0 相同
+	for len(x) < 3 {
+		x = append(x, 0)
+	}
+	return x, true
+}
+
+// filterInstances applies the filters in order
+func filterInstances(ss []instance, self *svrinfo, filters []PickFilter) []instance {
+	for _, f := range filters {
+		if f.match == nil {
+			continue
+		}
+		x := make([]instance, 0, len(ss))
+		for _, v := range ss {
+			if f.match(&v.info, self) {
+				x = append(x, v)
+			}
+		}
+		if f.prefer && len(x) == 0 {
+			continue
+		}
+		ss = x
+	}
+	return ss
+}
+
+type pickFiltersKey struct{}
+
+// ContextWithPickFilters returns a copy of ctx which carries the filters used by CallService
+func ContextWithPickFilters(ctx context.Context, filters ...PickFilter) context.Context {
+	return context.WithValue(ctx, pickFiltersKey{}, filters)
+}
+
+func pickFiltersFromContext(ctx context.Context) []PickFilter {
+	ff, _ := ctx.Value(pickFiltersKey{}).([]PickFilter)
+	return ff
+}
@@ -0,0 +1,77 @@
+package gofactory
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePickFilter(t *testing.T) {
+	ss := []instance{
+		{addr: "a", info: svrinfo{Tags: []string{"canary"}, Zone: "sh1", Version: "1.4.2", Metadata: map[string]string{"env": "prod"}}},
+		{addr: "b", info: svrinfo{Zone: "sh2", Version: "v1.3.0-rc1"}},
+		{addr: "c", info: svrinfo{Zone: "sh2", Version: "2.0", Metadata: map[string]string{"env": "test"}}},
+		{addr: "d"},
+	}
+	self := &svrinfo{Zone: "sh2"}
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"tag=canary", []string{"a"}},
+		{" zone = sh2 ", []string{"b", "c"}},
+		{"meta.env=prod", []string{"a"}},
+		{"meta.env=", nil},
+		{"version>=1.4", []string{"a", "c"}},
+		{"version>1.4.2", []string{"c"}},
+		{"version<=1.4.2", []string{"a", "b"}},
+		{"version<2", []string{"a", "b"}},
+		{"version=1.4.2", []string{"a"}},
+		{"version==2.0.0", []string{"c"}},
+		{"version!=1.3", []string{"a", "c"}},
+		{"prefer_zone=sh1", []string{"a"}},
+		{"prefer_zone=sh9", []string{"a", "b", "c", "d"}},
+		{"same_zone", []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := ParsePickFilter(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			x := make([]string, 0)
+			for _, v := range filterInstances(ss, self, []PickFilter{f}) {
+				x = append(x, v.addr)
+			}
+			if !slices.Equal(x, tt.want) {
+				t.Fatalf("got %v, want %v", x, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePickFilterError(t *testing.T) {
+	for _, expr := range []string{"", "canary", "host=a", "meta.=x", "version>=x", "version>=", "version~1.4", "same_zone=sh1"} {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := ParsePickFilter(expr); err == nil {
+				t.Fatalf("%q is parsed", expr)
+			}
+		})
+	}
+}
+
+func TestFilterInstancesOrder(t *testing.T) {
+	ss := []instance{
+		{addr: "a", info: svrinfo{Zone: "sh1", Tags: []string{"canary"}}},
+		{addr: "b", info: svrinfo{Zone: "sh2", Tags: []string{"canary"}}},
+		{addr: "c", info: svrinfo{Zone: "sh1"}},
+	}
+	// 优先条件在必需条件之后生效，没有匹配时保留全部
+	x := filterInstances(ss, &svrinfo{}, []PickFilter{FilterTag("canary"), PreferZone("sh2")})
+	if len(x) != 1 || x[0].addr != "b" {
+		t.Fatalf("got %v", x)
+	}
+	x = filterInstances(ss, &svrinfo{}, []PickFilter{FilterZone("sh2"), PreferZone("sh1")})
+	if len(x) != 1 || x[0].addr != "b" {
+		t.Fatalf("got %v", x)
+	}
+}
@@ -0,0 +1,209 @@
+package gofactory
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultBuckets are the latency buckets in seconds, same as the prometheus client defaults
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+type metricSeries struct {
+	lvs    []string
+	value  float64  // counter or gauge value
+	counts []uint64 // histogram bucket counts, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// metricFamily is a metric with a fixed set of label names.
+type metricFamily struct {
+	collect func(emit func(v float64, lvs ...string)) // 采集时读取数值，设置后忽略series
+	series  map[string]*metricSeries
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+}
+
+func (f *metricFamily) get(lvs []string) *metricSeries {
+	k := strings.Join(lvs, "\xff")
+	x, ok := f.series[k]
+	if !ok {
+		x = &metricSeries{lvs: slices.Clone(lvs)}
+		if f.kind == kindHistogram {
+			x.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[k] = x
+	}
+	return x
+}
+
+// add adds v to the counter or gauge
+func (f *metricFamily) add(v float64, lvs ...string) {
+	f.mu.Lock()
+	f.get(lvs).value += v
+	f.mu.Unlock()
+}
+
+// set sets the gauge to v
+func (f *metricFamily) set(v float64, lvs ...string) {
+	f.mu.Lock()
+	f.get(lvs).value = v
+	f.mu.Unlock()
+}
+
+// observe records v into the histogram
+func (f *metricFamily) observe(v float64, lvs ...string) {
+	f.mu.Lock()
+	x := f.get(lvs)
+	for i, b := range f.buckets {
+		if v <= b {
+			x.counts[i]++
+			break
+		}
+	}
+	x.sum += v
+	x.count++
+	f.mu.Unlock()
+}
+
+func (f *metricFamily) write(w *bufio.Writer) {
+	ss := make([]*metricSeries, 0)
+	if f.collect != nil {
+		f.collect(func(v float64, lvs ...string) {
+			ss = append(ss, &metricSeries{lvs: lvs, value: v})
+		})
+	} else {
+		f.mu.Lock()
+		for _, v := range f.series {
+			x := *v
+			x.counts = slices.Clone(v.counts)
+			ss = append(ss, &x)
+		}
+		f.mu.Unlock()
+	}
+	if len(ss) == 0 {
+		return
+	}
+	slices.SortFunc(ss, func(a, b *metricSeries) int {
+		return slices.Compare(a.lvs, b.lvs)
+	})
+	w.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + string(f.kind) + "\n")
+	for _, x := range ss {
+		if f.kind != kindHistogram {
+			w.WriteString(f.name + f.labelString(x.lvs, "", "") + " " + formatFloat(x.value) + "\n")
+			continue
+		}
+		var n uint64
+		for i, b := range f.buckets {
+			n += x.counts[i]
+			w.WriteString(f.name + "_bucket" + f.labelString(x.lvs, "le", formatFloat(b)) + " " + strconv.FormatUint(n, 10) + "\n")
+		}
+		w.WriteString(f.name + "_bucket" + f.labelString(x.lvs, "le", "+Inf") + " " + strconv.FormatUint(x.count, 10) + "\n")
+		w.WriteString(f.name + "_sum" + f.labelString(x.lvs, "", "") + " " + formatFloat(x.sum) + "\n")
+		w.WriteString(f.name + "_count" + f.labelString(x.lvs, "", "") + " " + strconv.FormatUint(x.count, 10) + "\n")
+	}
+}
+
+func (f *metricFamily) labelString(lvs []string, extraName, extraValue string) string {
+	ss := make([]string, 0, len(f.labels)+1)
+	for i, l := range f.labels {
+		v := ""
+		if i < len(lvs) {
+			v = lvs[i]
+		}
+		ss = append(ss, l+`="`+escapeLabel(v)+`"`)
+	}
+	if extraName != "" {
+		ss = append(ss, extraName+`="`+extraValue+`"`)
+	}
+	if len(ss) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(ss, ",") + "}"
+}
+
+// metricRegistry holds metric families and writes them in the prometheus text format.
+type metricRegistry struct {
+	families []*metricFamily
+	mu       sync.Mutex
+}
+
+func (r *metricRegistry) register(f *metricFamily) *metricFamily {
+	f.series = make(map[string]*metricSeries)
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+func (r *metricRegistry) counter(name, help string, labels ...string) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: kindCounter, labels: labels})
+}
+
+func (r *metricRegistry) gauge(name, help string, labels ...string) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: kindGauge, labels: labels})
+}
+
+func (r *metricRegistry) histogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: kindHistogram, labels: labels, buckets: buckets})
+}
+
+// collector registers a counter or gauge whose values are read by collect on every scrape
+func (r *metricRegistry) collector(kind metricKind, name, help string, collect func(emit func(v float64, lvs ...string)), labels ...string) *metricFamily {
+	return r.register(&metricFamily{name: name, help: help, kind: kind, labels: labels, collect: collect})
+}
+
+// writeTo writes all metrics in the prometheus text exposition format
+func (r *metricRegistry) writeTo(w io.Writer) error {
+	r.mu.Lock()
+	ff := slices.Clone(r.families)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, f := range ff {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
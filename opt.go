@@ -5,7 +5,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/xyzj/toolbox/db"
 	"github.com/xyzj/toolbox/logger"
 )
 
@@ -17,6 +17,22 @@ const (
 	Release
 )
 
+// Component identifies a built-in server or client of the service.
+type Component string
+
+const (
+	ComponentTCP        Component = "tcp"
+	ComponentMQTTBroker Component = "mqtt-broker"
+	ComponentWeb        Component = "web"
+	ComponentDiscover   Component = "discover"
+	ComponentRedis      Component = "redis"
+	ComponentMQTT       Component = "mqtt"
+	ComponentRMQ        Component = "rmq"
+	ComponentDB         Component = "db"
+	ComponentBolt       Component = "bolt"
+	ComponentMetrics    Component = "metrics"
+)
+
 type emptySvr struct {
 	enable bool
 }
@@ -35,12 +51,52 @@ type Opt struct {
 	clidb    cliDB
 	boltname string
 	// base config
-	logg logger.Logger
-	mode RunMode
+	metricsBind     string
+	traceExporter   SpanExporter
+	traceOTLP       *otlpConfig
+	traceRatio      float64
+	file            *fileConfig
+	fileErr         error
+	filePath        string
+	logg            logger.Logger
+	logLevel        logger.LogLevel
+	reloadInterval  time.Duration
+	reload          bool
+	optional        map[Component]bool
+	shutdownTimeout time.Duration
+	mode            RunMode
+	strict          bool
+	strictSet       bool
 }
 
 type Opts func(opt *Opt)
 
+// liveOpt is the options which Reload may change while the service runs,
+// the readers load the snapshot and Reload stores a new one.
+type liveOpt struct {
+	optional        map[Component]bool
+	shutdownTimeout time.Duration
+	webRead         time.Duration // web请求的读超时
+	webWrite        time.Duration // web请求的写超时
+	strategy        PickStrategy
+	logLevel        logger.LogLevel
+	mode            RunMode
+	strict          bool
+}
+
+func newLiveOpt(o *Opt) *liveOpt {
+	return &liveOpt{
+		optional:        o.optional,
+		shutdownTimeout: o.shutdownTimeout,
+		webRead:         o.webServer.readTimeout,
+		webWrite:        o.webServer.writeTimeout,
+		strategy:        o.discover.strategy,
+		logLevel:        o.logLevel,
+		mode:            o.mode,
+		strict:          o.strict,
+	}
+}
+
 func checkTCPAddr(s string) (*net.TCPAddr, bool) {
 	if s == "" {
 		return nil, false
@@ -52,11 +108,42 @@ func checkTCPAddr(s string) (*net.TCPAddr, bool) {
 	}
 }
 
+// probeTCPAddr binds s and releases it right away,
+// it's used for the servers which bind the address by themselves and do not report the error.
+func probeTCPAddr(s string) error {
+	ln, err := net.Listen("tcp", s)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
 func SetMode(m RunMode) Opts {
 	return func(o *Opt) {
 		o.mode = m
-		if m == Release {
-			gin.SetMode(gin.ReleaseMode)
+	}
+}
+
+// WithStrict sets whether a failed component stops the service.
+//
+// In strict mode New returns the joined errors of all failed components,
+// and Run returns as soon as an enabled listener fails to bind.
+// Strict mode is enabled by default in Release mode.
+func WithStrict(b bool) Opts {
+	return func(o *Opt) {
+		o.strict = b
+		o.strictSet = true
+	}
+}
+
+// WithOptional marks components whose failure is only logged, even in strict mode.
+func WithOptional(c ...Component) Opts {
+	return func(o *Opt) {
+		if o.optional == nil {
+			o.optional = make(map[Component]bool)
+		}
+		for _, v := range c {
+			o.optional[v] = true
 		}
 	}
 }
@@ -67,11 +154,60 @@ func WithLogger(l logger.Logger) Opts {
 	}
 }
 
+// WithLogLevel sets the log level, by default the level is debug in Debug mode and unchanged otherwise.
+func WithLogLevel(l logger.LogLevel) Opts {
+	return func(o *Opt) {
+		o.logLevel = l
+	}
+}
+
+// WithConfigReload enables reloading the config on SIGHUP.
+//
+// When the service is loaded from a config file and interval > 0,
+// the file is also checked every interval and reloaded when it is modified.
+func WithConfigReload(interval time.Duration) Opts {
+	return func(o *Opt) {
+		o.reload = true
+		if interval > 0 {
+			o.reloadInterval = max(interval, time.Second)
+		}
+	}
+}
+
+// WithShutdownTimeout sets how long Run waits for the service to stop after its context is done.
+func WithShutdownTimeout(t time.Duration) Opts {
+	return func(o *Opt) {
+		o.shutdownTimeout = max(t, time.Second)
+	}
+}
+
+// WithMetrics sets the address of a separate http server for /metrics, which is used only when the web server is not enabled.
+// With the web server enabled, /metrics is always served by it.
+//
+// The mqtt broker metrics need the inline client, see OptMqttInsideClient.
+func WithMetrics(bind string) Opts {
+	return func(o *Opt) {
+		o.metricsBind = bind
+	}
+}
+
+// WithTracing enables tracing, the finished spans are sent to exp in batches.
+//
+// ratio is the sampling ratio of new traces in [0,1],
+// a trace continued from a traceparent follows the sampled flag of the caller.
+func WithTracing(exp SpanExporter, ratio float64) Opts {
+	return func(o *Opt) {
+		o.traceExporter = exp
+		o.traceOTLP = nil
+		o.traceRatio = min(max(ratio, 0), 1)
+	}
+}
+
 func WithTCPServer(opts ...tcpOpts) Opts {
 	return func(o *Opt) {
 		o.tcpServer = defaultTCPServer
 		o.tcpServer.enable = true
-		for _, v := range opts {
+		for _, v := range append(o.file.tcpOpts(), opts...) {
 			v(&o.tcpServer)
 		}
 	}
@@ -81,7 +217,7 @@ func WithMQTTBroker(opts ...mqttBrokerOpts) Opts {
 	return func(o *Opt) {
 		o.mqttBroker = defaultMqttBroker
 		o.mqttBroker.enable = true
-		for _, v := range opts {
+		for _, v := range append(o.file.brokerOpts(), opts...) {
 			v(&o.mqttBroker)
 		}
 	}
@@ -91,7 +227,7 @@ func WithWebServer(opts ...webOpts) Opts {
 	return func(o *Opt) {
 		o.webServer = defaultWebServer
 		o.webServer.enable = true
-		for _, v := range opts {
+		for _, v := range append(o.file.webOpts(), opts...) {
 			v(&o.webServer)
 		}
 	}
@@ -117,7 +253,7 @@ func WithRedisClient(opts ...redisOpts) Opts {
 			writeTimeout: time.Second * 10,
 		}
 		o.cliredis.enable = true
-		for _, v := range opts {
+		for _, v := range append(o.file.redisOpts(), opts...) {
 			v(&o.cliredis)
 		}
 	}
@@ -129,10 +265,10 @@ func WithDiscover(opts ...discoverOpts) Opts {
 			svrInfo:         &svrinfo{},
 			infoTimeout:     time.Second * 9,
 			publishInterval: time.Second * 4,
-			udpPort:         9000,
+			udp:             udpConfig{port: 9000, ttl: 1},
 		}
 		o.discover.enable = true
-		for _, v := range opts {
+		for _, v := range append(o.file.discoverOpts(), opts...) {
 			v(&o.discover)
 		}
 	}
@@ -150,7 +286,7 @@ func WithMqttClient(opts ...mqttOpts) Opts {
 			failureCacheMax:    100,
 			failureCacheExpire: time.Minute * 5,
 		}
-		for _, v := range opts {
+		for _, v := range append(o.file.mqttOpts(), opts...) {
 			v(&o.climqtt)
 		}
 	}
@@ -167,7 +303,7 @@ func WithRmqProducer(opts ...rmqOpts) Opts {
 			enableP:  true,
 			enable:   true,
 		}
-		for _, v := range opts {
+		for _, v := range append(o.file.rmqOpts(), opts...) {
 			v(&o.clirmq)
 		}
 	}
@@ -182,12 +318,13 @@ func WithRMQConsumer(opts ...rmqOpts) Opts {
 			vhost:           "/",
 			exchange:        "",
 			queueName:       time.Now().Format("Jan-01-02_15-04-05"),
+			queueAuto:       true,
 			queueDurable:    false,
 			queueAutoDelete: true,
 			enableC:         true,
 			enable:          true,
 		}
-		for _, v := range opts {
+		for _, v := range append(o.file.rmqOpts(), opts...) {
 			v(&o.clirmq)
 		}
 	}
@@ -202,13 +339,14 @@ func WithBoltDB(name string) Opts {
 func WithDBClient(opts ...dbOpts) Opts {
 	return func(o *Opt) {
 		o.clidb = cliDB{
+			driver:   db.DriveMySQL,
 			addr:     "127.0.0.1:3306",
 			user:     "root",
 			pwd:      "root",
 			database: []string{"test"},
 			enable:   true,
 		}
-		for _, v := range opts {
+		for _, v := range append(o.file.dbOpts(), opts...) {
 			v(&o.clidb)
 		}
 	}
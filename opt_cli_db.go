@@ -1,6 +1,8 @@
 package gofactory
 
 import (
+	"time"
+
 	"github.com/xyzj/toolbox/db"
 	"github.com/xyzj/toolbox/logger"
 )
@@ -12,6 +14,7 @@ type cliDB struct {
 	user     string
 	pwd      string
 	database []string
+	timeout  time.Duration // 单次调用的超时
 	enable   bool
 }
 
@@ -19,12 +22,17 @@ func (opt *cliDB) build(l logger.Logger) error {
 	if !opt.enable {
 		return nil
 	}
+	if opt.timeout <= 0 {
+		opt.timeout = time.Second * 300
+	}
 	var err error
 	opt.cli, err = db.New(&db.Opt{
 		Server:     opt.addr,
 		User:       opt.user,
 		Passwd:     opt.pwd,
+		DBNames:    opt.database,
 		DriverType: opt.driver,
+		Timeout:    opt.timeout,
 		Logger:     l,
 	})
 	return err
@@ -1,17 +1,23 @@
 package gofactory
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
 	"net"
 	"os"
+	"slices"
 	"strconv"
-	"syscall"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/sjson"
 	"github.com/xyzj/toolbox/cache"
-	"github.com/xyzj/toolbox/crypto"
 	"github.com/xyzj/toolbox/json"
 	"github.com/xyzj/toolbox/logger"
 	"github.com/xyzj/toolbox/loopfunc"
@@ -22,6 +28,8 @@ type discoverType byte
 const (
 	byUDP discoverType = iota
 	byRedis
+	byBackend
+	byBolt
 )
 
 type ProtocolType byte
@@ -35,12 +43,69 @@ const (
 	ProtocolMQTTWS
 )
 
+func (p ProtocolType) String() string {
+	switch p {
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolHTTP:
+		return "http"
+	case ProtocolHTTPS:
+		return "https"
+	case ProtocolMQTT:
+		return "mqtt"
+	case ProtocolMQTTTLS:
+		return "mqtttls"
+	case ProtocolMQTTWS:
+		return "mqttws"
+	}
+	return "unknown"
+}
+
+// scheme returns the scheme of the registered address of the protocol
+func (p ProtocolType) scheme() string {
+	switch p {
+	case ProtocolHTTP:
+		return "http://"
+	case ProtocolHTTPS:
+		return "https://"
+	case ProtocolMQTT:
+		return "tcp://"
+	case ProtocolMQTTTLS:
+		return "tls://"
+	case ProtocolMQTTWS:
+		return "ws://"
+	}
+	return ""
+}
+
+// ServiceStatus is the status of a service instance in discover
+type ServiceStatus string
+
+const (
+	// StatusStarting the instance is registered but not all components are started
+	StatusStarting ServiceStatus = "starting"
+	// StatusServing the instance is ready for requests
+	StatusServing ServiceStatus = "serving"
+	// StatusDraining the instance finishes the running requests and takes no new ones
+	StatusDraining ServiceStatus = "draining"
+	// StatusLeaving the instance is deregistered, it is only sent in the final announcement
+	StatusLeaving ServiceStatus = "leaving"
+)
+
 type svrinfo struct {
 	RegisterAddress map[ProtocolType]string `json:"register_address,omitempty"` // 注册地址
 	SvrName         string                  `json:"svr_name,omitempty"`         // 注册服务名称
 	SvrAlias        string                  `json:"svr_alias,omitempty"`        // 注册别名
 	SvrSource       string                  `json:"svr_source,omitempty"`       // 服务本地原始地址
 	RootPath        string                  `json:"root_path,omitempty"`        // 业务标识
+	Weight          int                     `json:"weight,omitempty"`           // 负载权重,0按1处理
+	Status          ServiceStatus           `json:"status,omitempty"`           // 实例状态,为空时视为serving
+	Metadata        map[string]string       `json:"metadata,omitempty"`         // 自定义信息
+	Tags            []string                `json:"tags,omitempty"`             // 标签,如 canary
+	Version         string                  `json:"version,omitempty"`          // 版本号,如 1.4.2
+	Zone            string                  `json:"zone,omitempty"`             // 所在区域或机房
+	InstanceID      string                  `json:"instance_id,omitempty"`      // 实例标识,未设置时启动时生成
+	StartTime       int64                   `json:"start_time,omitempty"`       // 启动时间戳
 	UpdateTime      string                  `json:"update_time,omitempty"`      // 更新时间,可读
 	UpdateStamp     int64                   `json:"update_stamp,omitempty"`     // 更新时间戳
 }
@@ -51,206 +116,528 @@ func (s *svrinfo) Json() string {
 	return json.String(b)
 }
 
-type svrinfoUDP struct {
-	Info string `json:"info"`
-	Key  string `json:"key"`
-	Sign string `json:"sign"`
-}
-
-func (s *svrinfoUDP) json() []byte {
-	b, _ := json.Marshal(s)
-	return b
-}
-
 type discover struct {
 	rediscli        cliRedis
 	svrInfo         *svrinfo
 	infos           *cache.AnyCache[svrinfo]
-	cryp            *crypto.SM2
+	backend         DiscoveryBackend
 	infoTimeout     time.Duration // 服务消息超时
 	publishInterval time.Duration // 服务消息更新间隔
 	info            string
-	udpPort         int // udp端口
+	key             string       // 本实例的注册键
+	published       atomic.Int64 // 最后一次发布时间
+	started         atomic.Bool  // build完成，可以查询实例
+	intervalCh      chan time.Duration
+	publishCh       chan struct{} // 立即发布
+	queried         sync.Map      // 服务名称最后一次查询的时间
+	logg            logger.Logger
+	udp             udpConfig               // udp广播设置
+	keys            *discoverKeys           // udp签名密钥,为空时使用内置密钥
+	advertiseIP     string                  // 注册地址使用的ip,为空时自动获取
+	boltFile        string                  // 使用bolt文件注册时的数据文件
+	address         map[ProtocolType]string // 配置的注册地址
+	nameAuto        bool                    // 名称为启动时生成
 	discoverType    discoverType
+	strategy        PickStrategy // 默认选择策略
+	picker          picker
+	snapshot        map[string]svrinfo // 最后一次通知时的实例
+	watchers        []*serviceWatcher
+	watchMu         sync.Mutex
+	infoMu          sync.Mutex
+	infosMu         sync.RWMutex // 缓存原地更新已有的实例,更新与遍历互斥
 	enable          bool
 }
 
-func (opt *discover) packInfo(encode bool) string {
+func (opt *discover) packInfo() string {
+	opt.infoMu.Lock()
+	defer opt.infoMu.Unlock()
 	opt.info, _ = sjson.Set(opt.info, "update_stamp", time.Now().Unix())
 	opt.info, _ = sjson.Set(opt.info, "update_time", time.Now().Format("2006-01-02 15:04:05"))
-	if !encode {
-		return opt.info
-	}
-	bb, err := opt.cryp.Encode([]byte(opt.info))
-	if err != nil {
+	return opt.info
+}
+
+// prefix returns the prefix of the instance keys under the root path
+func (opt *discover) prefix() string {
+	return opt.svrInfo.RootPath + "/discover"
+}
+
+// setStatus changes the status in the published info
+func (opt *discover) setStatus(st ServiceStatus) {
+	opt.infoMu.Lock()
+	defer opt.infoMu.Unlock()
+	opt.svrInfo.Status = st
+	opt.info, _ = sjson.Set(opt.info, "status", st)
+}
+
+func (opt *discover) status() ServiceStatus {
+	opt.infoMu.Lock()
+	defer opt.infoMu.Unlock()
+	return opt.svrInfo.Status
+}
+
+// setAddress changes the registered addresses
+func (opt *discover) setAddress(addrs map[ProtocolType]string) {
+	opt.infoMu.Lock()
+	defer opt.infoMu.Unlock()
+	opt.svrInfo.RegisterAddress = addrs
+	opt.info = opt.svrInfo.Json()
+}
+
+// advertise returns the host:port of bind to register,
+// the host is the advertise ip, or the host of bind, or the detected local ip.
+func (opt *discover) advertise(bind string) string {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil || port == "" || port == "0" {
 		return ""
 	}
-	bbb, err := opt.cryp.Sign([]byte(bb.Base64String()))
-	if err != nil {
-		return ""
+	switch {
+	case opt.advertiseIP != "":
+		host = opt.advertiseIP
+	case host == "" || net.ParseIP(host).IsUnspecified():
+		host = localIP()
 	}
-	a := svrinfoUDP{
-		Key:  fmt.Sprintf("%s/discover/%s/%s", opt.svrInfo.RootPath, opt.svrInfo.SvrName, time.Now().Format("Jan-01-02 15:04:05.000000")),
-		Info: bb.Base64String(),
-		Sign: bbb.Base64String(),
+	return net.JoinHostPort(host, port)
+}
+
+// fillHost adds the advertise host to an address without host, such as http://:6880 or http://6880
+func (opt *discover) fillHost(addr string) string {
+	scheme, hp := "", addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme, hp = addr[:i+3], addr[i+3:]
 	}
-	return json.String(a.json())
+	if _, err := strconv.Atoi(hp); err == nil {
+		hp = ":" + hp
+	}
+	if host, _, err := net.SplitHostPort(hp); err != nil || host != "" {
+		return addr
+	}
+	return scheme + opt.advertise(hp)
 }
 
-func (opt *discover) unpackInfo(s string, encode bool) (*svrinfo, error) {
-	var err error
-	if encode {
-		aa := svrinfoUDP{}
-		err = json.UnmarshalFromString(s, &aa)
+// localIP returns the first ipv4 address of the up and non loopback interfaces
+func localIP() string {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for _, v := range ifs {
+		if v.Flags&net.FlagUp == 0 || v.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := v.Addrs()
 		if err != nil {
-			return nil, err
+			continue
 		}
-		ok, _ := opt.cryp.VerifySignFromBase64(aa.Sign, json.Bytes(aa.Info))
-		if !ok {
-			return nil, errors.New("verify sign failed")
+		for _, a := range addrs {
+			if ip, ok := a.(*net.IPNet); ok && ip.IP.To4() != nil && ip.IP.IsGlobalUnicast() {
+				return ip.IP.String()
+			}
 		}
-		s, err = opt.cryp.DecodeBase64(aa.Info)
-		if err != nil {
-			return nil, err
+	}
+	return "127.0.0.1"
+}
+
+// sameInfo reports whether x registers the same info as this instance, the runtime fields are ignored
+func (opt *discover) sameInfo(x *svrinfo) bool {
+	if x == nil || opt.svrInfo == nil {
+		return x == opt.svrInfo
+	}
+	opt.infoMu.Lock()
+	a := *opt.svrInfo
+	opt.infoMu.Unlock()
+	b := *x
+	if !maps.Equal(opt.address, x.RegisterAddress) {
+		return false
+	}
+	b.RegisterAddress = a.RegisterAddress
+	b.Status, b.StartTime = a.Status, a.StartTime
+	if b.InstanceID == "" {
+		b.InstanceID = a.InstanceID
+	}
+	return infoEqual(a, b)
+}
+
+// serve publishes the serving status right away
+func (opt *discover) serve() {
+	opt.setStatus(StatusServing)
+	if opt.publishCh != nil {
+		notifyCh(opt.publishCh)
+	}
+}
+
+// lookup returns the instances as instances does. When none is found, the peers are queried right away,
+// by an udp query whose replies are waited for a moment, or by reading the backend again.
+// A name is queried at most once a second.
+func (opt *discover) lookup(name string, protocols ...ProtocolType) []instance {
+	ss := opt.instances(name, protocols...)
+	if len(ss) > 0 || opt.backend == nil {
+		return ss
+	}
+	now := time.Now().UnixMilli()
+	if v, ok := opt.queried.Load(name); ok && now-v.(int64) < queryInterval.Milliseconds() {
+		return ss
+	}
+	opt.queried.Store(name, now)
+	ctx, cancel := context.WithTimeout(context.Background(), queryWait)
+	defer cancel()
+	q, ok := opt.backend.(backendQuerier)
+	if !ok {
+		if err := opt.read(ctx, opt.logg); err != nil {
+			opt.logg.Error("[discover] read instances error:" + err.Error())
+		}
+		return opt.instances(name, protocols...)
+	}
+	if err := q.query(ctx, opt.prefix(), name); err != nil {
+		opt.logg.Error("[discover] query error:" + err.Error())
+		return ss
+	}
+	t := time.NewTicker(time.Millisecond * 50)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ss
+		case <-t.C:
+			if ss = opt.instances(name, protocols...); len(ss) > 0 {
+				return ss
+			}
 		}
 	}
-	a := svrinfo{}
-	err = json.Unmarshal(json.Bytes(s), &a)
+}
+
+// publish sends the info of this instance once, nothing is sent before discover is started
+// or after the leaving announcement
+func (opt *discover) publish(ctx context.Context) error {
+	if !opt.started.Load() || opt.backend == nil || opt.status() == StatusLeaving {
+		return nil
+	}
+	if err := opt.backend.Register(ctx, opt.prefix(), opt.key, opt.packInfo(), opt.infoTimeout); err != nil {
+		return err
+	}
+	opt.published.Store(time.Now().Unix())
+	return nil
+}
+
+// read loads the live instances from the backend into the cache,
+// the instances which are not listed any more are removed from the cache.
+func (opt *discover) read(ctx context.Context, l logger.Logger) error {
+	ss, err := opt.backend.List(ctx, opt.prefix())
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &a, nil
+	found := make(map[string]svrinfo, len(ss))
+	for k, v := range ss {
+		x := svrinfo{}
+		if err := json.UnmarshalFromString(v, &x); err != nil {
+			l.Error("[discover] unpack info of " + k + " error:" + err.Error())
+			continue
+		}
+		if x.Status == StatusLeaving {
+			continue
+		}
+		found[k] = x
+	}
+	opt.infosMu.Lock()
+	defer opt.infosMu.Unlock()
+	// 已注销或过期的实例
+	gone := make([]string, 0)
+	opt.infos.ForEach(func(key string, value svrinfo) bool {
+		if _, ok := found[key]; !ok {
+			gone = append(gone, key)
+		}
+		return true
+	})
+	for _, k := range gone {
+		opt.infos.Delete(k)
+	}
+	for k, v := range found {
+		opt.infos.Store(k, v)
+	}
+	return nil
 }
 
-func (opt *discover) build(l logger.Logger) error {
-	opt.infos = cache.NewAnyCache[svrinfo](opt.infoTimeout)
-	opt.cryp = crypto.NewSM2()
-	opt.cryp.SetPrivateKey(getSM2())
-	key := fmt.Sprintf("%s/discover/%s/%s", opt.svrInfo.RootPath, opt.svrInfo.SvrName, time.Now().Format("Jan-01-02 15:04:05.000000"))
-	switch opt.discoverType {
-	case byRedis:
-		go loopfunc.LoopFunc(func(params ...any) {
-			err := opt.rediscli.build(l)
-			if err != nil {
-				return
+// instances returns the live instances of name, ordered by address.
+// The address of the first registered protocol of protocols is used for each instance.
+func (opt *discover) instances(name string, protocols ...ProtocolType) []instance {
+	found := make(map[string]instance)
+	opt.infosMu.RLock()
+	opt.infos.ForEach(func(key string, value svrinfo) bool {
+		if value.SvrName != name {
+			return true
+		}
+		for _, p := range protocols {
+			addr, ok := value.RegisterAddress[p]
+			if !ok || addr == "" {
+				continue
 			}
-			t1 := time.NewTicker(opt.publishInterval)
-			fWrite := func() {
-				if err := opt.rediscli.write(key, opt.packInfo(false), opt.infoTimeout); err != nil {
-					l.Error("[discover] write info error:" + err.Error())
-				}
+			if value.Status != "" && value.Status != StatusServing {
+				break
 			}
-			fRead := func() {
-				val, err := opt.rediscli.keys(fmt.Sprintf("%s/discover/*", opt.svrInfo.RootPath))
-				if err != nil {
-					l.Error("[discover] read keys error:" + err.Error())
-					return
-				}
-				for _, k := range val {
-					v, err := opt.rediscli.read(k)
-					if err != nil {
-						l.Error("[discover] read info error:" + err.Error())
-						continue
-					}
-					x, err := opt.unpackInfo(v, false)
-					if err != nil {
-						l.Error("[discover] unpack info error:" + err.Error())
-						continue
-					}
-					if time.Since(time.Unix(x.UpdateStamp, 0)) > opt.infoTimeout {
-						continue
-					}
-					opt.infos.Store(k, *x)
+			// 同一地址重启后可能有新旧两条记录,保留最新的
+			if x, ok := found[addr]; !ok || x.stamp < value.UpdateStamp {
+				found[addr] = instance{
+					info:     value,
+					addr:     addr,
+					rootPath: value.RootPath,
+					protocol: p,
+					weight:   max(value.Weight, 1),
+					stamp:    value.UpdateStamp,
 				}
 			}
-			for range t1.C {
-				fWrite()
-				fRead()
-			}
-		}, "discover", l.DefaultWriter())
+			break
+		}
+		return true
+	})
+	opt.infosMu.RUnlock()
+	ss := make([]instance, 0, len(found))
+	for _, v := range found {
+		ss = append(ss, v)
+	}
+	slices.SortFunc(ss, func(a, b instance) int {
+		return strings.Compare(a.addr, b.addr)
+	})
+	return ss
+}
+
+func (opt *discover) build(ctx context.Context, l logger.Logger) error {
+	opt.infos = cache.NewAnyCache[svrinfo](opt.infoTimeout)
+	opt.intervalCh = make(chan time.Duration, 1)
+	opt.publishCh = make(chan struct{}, 1)
+	opt.logg = l
+	switch opt.discoverType {
+	case byRedis:
+		opt.backend = newRedisBackend(&opt.rediscli)
 	case byUDP:
-		go loopfunc.LoopFunc(func(params ...any) {
-			p, err := net.ResolveUDPAddr("udp", "255.255.255.255:"+strconv.Itoa(opt.udpPort))
-			if err != nil {
-				l.Error("[discover] resolve udp addr error:" + err.Error())
+		b, err := newUDPBackend(opt.udp, opt.infoTimeout, opt.keys)
+		if err != nil {
+			return errors.New("[discover] " + err.Error())
+		}
+		opt.backend = b
+	case byBolt:
+		opt.backend = NewKVBackend(NewBoltStore(opt.boltFile))
+	case byBackend:
+		if opt.backend == nil {
+			return errors.New("[discover] backend is not set")
+		}
+	default:
+		return errors.New("[discover] type error")
+	}
+	opt.key = fmt.Sprintf("%s/discover/%s/%s", opt.svrInfo.RootPath, opt.svrInfo.SvrName, time.Now().Format("Jan-01-02 15:04:05.000000"))
+	opt.infoMu.Lock()
+	if opt.svrInfo.InstanceID == "" {
+		opt.svrInfo.InstanceID = newInstanceID()
+	}
+	opt.svrInfo.StartTime = time.Now().Unix()
+	opt.info, _ = sjson.Set(opt.info, "instance_id", opt.svrInfo.InstanceID)
+	opt.info, _ = sjson.Set(opt.info, "start_time", opt.svrInfo.StartTime)
+	opt.infoMu.Unlock()
+	opt.setStatus(StatusStarting)
+	opt.watchLoop(ctx, l)
+	go loopfunc.LoopFunc(func(params ...any) {
+		if b, ok := opt.backend.(backendStarter); ok {
+			if err := b.start(ctx, l); err != nil {
+				l.Error("[discover] start error:" + err.Error())
 				return
 			}
-			fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
-			if err != nil {
-				l.Error("[discover] create udp socket error:" + err.Error())
-				return
+		}
+		t1 := time.NewTicker(opt.publishInterval)
+		defer t1.Stop()
+		fWrite := func() {
+			if err := opt.publish(ctx); err != nil {
+				l.Error("[discover] publish info error:" + err.Error())
 			}
-			defer syscall.Close(fd)
-			syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1) // 允许多个程序绑定同一端口
-			syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1) // 允许广播
-
-			addr := syscall.SockaddrInet4{Port: opt.udpPort}
-			// copy(addr.Addr[:], net.IPv4zero)
-			if err := syscall.Bind(fd, &addr); err != nil {
-				l.Error("[discover] bind udp port error:" + err.Error())
-				return
+		}
+		fRead := func() {
+			if err := opt.read(ctx, l); err != nil {
+				l.Error("[discover] read instances error:" + err.Error())
 			}
-			u, err := net.FilePacketConn(os.NewFile(uintptr(fd), ""))
-			if err != nil {
-				l.Error("[discover] create udp conn error:" + err.Error())
-				return
+		}
+		changed := opt.backend.Watch(ctx, opt.prefix())
+		// 启动时立即发布并查询所有实例,不必等待一个发布间隔
+		fWrite()
+		if q, ok := opt.backend.(backendQuerier); ok {
+			if err := q.query(ctx, opt.prefix(), ""); err != nil {
+				l.Error("[discover] query error:" + err.Error())
 			}
-			l.System("[discover] start udp server on port:" + strconv.Itoa(opt.udpPort))
-			go func() {
-				t1 := time.NewTicker(opt.publishInterval)
-				var err error
-				for range t1.C {
-					_, err = u.WriteTo(json.Bytes(opt.packInfo(true)), p)
-					if err != nil {
-						l.Error("[discover] publish info error:" + err.Error())
-					}
-					l.Debug("[discover] publish info")
-				}
-			}()
-			b := make([]byte, 4096)
-			a := &svrinfo{}
-			aa := svrinfoUDP{}
-			var n int
-			var ra net.Addr
-			for {
-				n, ra, err = u.ReadFrom(b)
-				if err != nil || n == 0 {
-					continue
-				}
-				a, err = opt.unpackInfo(string(b[:n]), true)
-				if err != nil {
-					l.Error("[discover] unpack error from " + ra.String() + ":" + err.Error())
-					continue
-				}
-				if time.Since(time.Unix(a.UpdateStamp, 0)) > opt.infoTimeout {
-					continue
-				}
-				opt.infos.Store(aa.Key, *a)
-				l.Debug("[discover] unpack info from " + ra.String() + ":" + a.Json())
+		}
+		fRead()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case d := <-opt.intervalCh:
+				t1.Reset(d)
+			case <-t1.C:
+				fWrite()
+				fRead()
+			case <-opt.publishCh:
+				fWrite()
+			case <-changed:
+				fRead()
 			}
-		}, "discover", l.DefaultWriter())
+		}
+	}, "discover", l.DefaultWriter())
+	opt.started.Store(true)
+	return nil
+}
+
+// ready returns an error when discover is not enabled, or not started by Service.Run yet
+func (opt *discover) ready() error {
+	if !opt.enable {
+		return errors.New("[discover] not enabled")
+	}
+	if !opt.started.Load() {
+		return errors.New("[discover] not started")
+	}
+	return nil
+}
+
+// setPublishInterval changes the publish interval of the running discover loop,
+// the interval must be shorter than the info timeout.
+func (opt *discover) setPublishInterval(interval time.Duration) error {
+	interval = min(max(interval, time.Second), time.Second*30)
+	if interval >= opt.infoTimeout {
+		return errors.New("[discover] publish interval should be shorter than info timeout")
+	}
+	opt.publishInterval = interval
+	if opt.intervalCh == nil {
+		return nil
+	}
+	select {
+	case <-opt.intervalCh:
 	default:
-		return errors.New("[discover] type error")
 	}
+	opt.intervalCh <- interval
 	return nil
 }
 
+// drain publishes the draining status right away, so that the peers stop picking this instance.
+func (opt *discover) drain() error {
+	if !opt.started.Load() || opt.backend == nil {
+		return nil
+	}
+	if st := opt.status(); st == StatusDraining || st == StatusLeaving {
+		return nil
+	}
+	opt.setStatus(StatusDraining)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := opt.publish(ctx); err != nil {
+		return errors.New("[discover] publish draining error:" + err.Error())
+	}
+	return nil
+}
+
+// close sends the final leaving announcement, such as a redis DEL or an udp goodbye,
+// and closes the backend.
+func (opt *discover) close() error {
+	opt.setStatus(StatusLeaving)
+	if opt.backend == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	var err error
+	if opt.published.Load() > 0 {
+		if err = opt.backend.Deregister(ctx, opt.prefix(), opt.key, opt.packInfo()); err != nil {
+			err = errors.New("[discover] deregister error:" + err.Error())
+		}
+	}
+	if c, ok := opt.backend.(io.Closer); ok {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
+
+// newInstanceID returns a random id of an instance
+func newInstanceID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
 type discoverOpts func(o *discover)
 
+// OptDiscoverInfo sets the registered info of this instance.
+// The addresses of the enabled servers are registered automatically, address overrides them,
+// such as a public address behind a proxy, see also OptDiscoverAdvertiseIP.
 func OptDiscoverInfo(name, alias, source, rootpath string, address map[ProtocolType]string) discoverOpts {
 	return func(o *discover) {
-		if name == "" {
-			name = time.Now().Format("x_150405.000")
-		}
+		o.nameAuto = name == ""
 		o.svrInfo.SvrName = name
+		if o.nameAuto {
+			o.svrInfo.SvrName = time.Now().Format("x_150405.000")
+		}
 		o.svrInfo.SvrAlias = alias
 		o.svrInfo.SvrSource = source
 		o.svrInfo.RootPath = rootpath
 		o.svrInfo.RegisterAddress = address
+		o.address = maps.Clone(address)
+		o.info = o.svrInfo.Json()
+	}
+}
+
+// OptDiscoverAdvertiseIP sets the ip of the addresses registered for the enabled servers,
+// by default the host of the bind address is used, or the first ipv4 address of the host when binding all interfaces.
+func OptDiscoverAdvertiseIP(ip string) discoverOpts {
+	return func(o *discover) {
+		o.advertiseIP = ip
+	}
+}
+
+// OptDiscoverWeight sets the weight of this instance used by PickWeighted, the default is 1.
+func OptDiscoverWeight(weight int) discoverOpts {
+	return func(o *discover) {
+		o.svrInfo.Weight = max(weight, 0)
+		o.info = o.svrInfo.Json()
+	}
+}
+
+// OptDiscoverVersion sets the version of this instance, such as 1.4.2, used by FilterVersion.
+func OptDiscoverVersion(version string) discoverOpts {
+	return func(o *discover) {
+		o.svrInfo.Version = version
+		o.info = o.svrInfo.Json()
+	}
+}
+
+// OptDiscoverZone sets the zone or datacenter of this instance, used by FilterZone and PreferSameZone.
+func OptDiscoverZone(zone string) discoverOpts {
+	return func(o *discover) {
+		o.svrInfo.Zone = zone
+		o.info = o.svrInfo.Json()
+	}
+}
+
+// OptDiscoverTags sets the tags of this instance, such as canary, used by FilterTag.
+func OptDiscoverTags(tags ...string) discoverOpts {
+	return func(o *discover) {
+		o.svrInfo.Tags = tags
 		o.info = o.svrInfo.Json()
 	}
 }
 
+// OptDiscoverMetadata sets the custom key values of this instance, used by FilterMetadata.
+func OptDiscoverMetadata(md map[string]string) discoverOpts {
+	return func(o *discover) {
+		o.svrInfo.Metadata = md
+		o.info = o.svrInfo.Json()
+	}
+}
+
+// OptDiscoverInstanceID sets the id of this instance, a random id is used by default.
+func OptDiscoverInstanceID(id string) discoverOpts {
+	return func(o *discover) {
+		o.svrInfo.InstanceID = id
+		o.info = o.svrInfo.Json()
+	}
+}
+
+// OptDiscoverPickStrategy sets the strategy used by PickService, the default is PickRoundRobin.
+func OptDiscoverPickStrategy(strategy PickStrategy) discoverOpts {
+	return func(o *discover) {
+		o.strategy = strategy
+	}
+}
+
 func OptDiscoverByRedis(opts ...redisOpts) discoverOpts {
 	return func(o *discover) {
 		o.discoverType = byRedis
@@ -271,19 +658,84 @@ func OptDiscoverByRedis(opts ...redisOpts) discoverOpts {
 func OptDiscoverByUDP(port int) discoverOpts {
 	return func(o *discover) {
 		o.discoverType = byUDP
-		o.udpPort = min(max(port, 1024), 65535)
+		o.udp.port = min(max(port, 1024), 65535)
+	}
+}
+
+// OptDiscoverMulticast sends the udp discover packets to the ipv4 or ipv6 multicast group instead of broadcasting,
+// such as 239.255.10.1 or ff05::10, the group is reachable across vlans when the routers forward it.
+func OptDiscoverMulticast(group string) discoverOpts {
+	return func(o *discover) {
+		o.udp.group = group
+	}
+}
+
+// OptDiscoverInterface sets the network interface of the udp discover on a multi-homed host, such as eth1,
+// the multicast group is joined on it, or the packets are broadcast to its subnet.
+func OptDiscoverInterface(name string) discoverOpts {
+	return func(o *discover) {
+		o.udp.iface = name
+	}
+}
+
+// OptDiscoverTTL sets the ttl or hop limit of the multicast packets, the default is 1, which stays in the local network.
+func OptDiscoverTTL(ttl int) discoverOpts {
+	return func(o *discover) {
+		o.udp.ttl = min(max(ttl, 1), 255)
+	}
+}
+
+// OptDiscoverSeeds sends the udp discover packets to the peers as well, such as 10.1.0.5:9000,
+// for the peers which are not reachable by broadcast or multicast. The port of the udp discover is used
+// when a peer has no port. The seeds should list each other, since the packets are only sent to the known addresses.
+func OptDiscoverSeeds(peers ...string) discoverOpts {
+	return func(o *discover) {
+		o.udp.seeds = peers
+	}
+}
+
+// OptDiscoverKeys sets the sm2 keypair of the deployment used by the udp discover, instead of the builtin key,
+// see GenerateDiscoverKeys. The packets are signed by privPEM, and only the packets signed by privPEM
+// or by one of trustedPubs are accepted, the keys are in pem or in base64 der.
+//
+// With the keys the info is signed but not encrypted, the instances with the builtin key can not read it.
+func OptDiscoverKeys(privPEM string, trustedPubs ...string) discoverOpts {
+	return func(o *discover) {
+		o.keys = &discoverKeys{priv: privPEM, trusted: trustedPubs}
+	}
+}
+
+// OptDiscoverKeysFromFile sets the keys of OptDiscoverKeys from the pem files
+func OptDiscoverKeysFromFile(privFile string, trustedFiles ...string) discoverOpts {
+	return func(o *discover) {
+		o.keys = &discoverKeys{}
+		b, err := os.ReadFile(privFile)
+		if err != nil {
+			o.keys.err = errors.New("read key file error:" + err.Error())
+			return
+		}
+		o.keys.priv = string(b)
+		for _, v := range trustedFiles {
+			b, err := os.ReadFile(v)
+			if err != nil {
+				o.keys.err = errors.New("read key file error:" + err.Error())
+				return
+			}
+			o.keys.trusted = append(o.keys.trusted, string(b))
+		}
 	}
 }
 
 // OptDiscoverInfoTimeout sets the timeout of service info.
 //
-// The timeout should between 1 minute and 3 seconds.
+// The timeout should between 1 minute and 3 seconds,
+// and the publish interval should between 30 seconds and 1 second.
 func OptDiscoverInfoTimeout(timeo, interval time.Duration) discoverOpts {
 	return func(o *discover) {
-		o.publishInterval = min(max(interval, time.Second*30), time.Second)
+		o.publishInterval = min(max(interval, time.Second), time.Second*30)
 		if int64(timeo.Seconds()) <= int64(o.publishInterval.Seconds()) {
 			timeo = o.publishInterval + time.Second
 		}
-		o.infoTimeout = min(max(timeo, time.Minute), time.Second*3)
+		o.infoTimeout = min(max(timeo, time.Second*3), time.Minute)
 	}
 }
@@ -0,0 +1,89 @@
+package gofactory
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/xyzj/toolbox/logger"
+)
+
+// DiscoveryBackend stores the infos of the service instances, the info is the json of an instance.
+// The keys of the instances under a root path start with prefix, which is "<root path>/discover",
+// such as "/wlst-micro/discover/demo/Oct-10-17 10:20:30.000000".
+//
+// The builtin backends are the udp broadcast and redis, see OptDiscoverByUDP and OptDiscoverByRedis,
+// other backends are set by OptDiscoverBackend, such as NewStaticBackend and NewKVBackend.
+// A backend which implements io.Closer is closed when the service stops.
+type DiscoveryBackend interface {
+	// Register writes the info of this instance, which expires after ttl if it is not registered again.
+	// It is called every publish interval and when the status of this instance is changed.
+	Register(ctx context.Context, prefix, key, info string, ttl time.Duration) error
+	// Deregister removes this instance when the service stops, the info has the leaving status.
+	Deregister(ctx context.Context, prefix, key, info string) error
+	// List returns the infos of the live instances under prefix by key.
+	List(ctx context.Context, prefix string) (map[string]string, error)
+	// Watch returns a channel which receives a value when the instances may be changed, until ctx is done.
+	// The instances are listed every publish interval as well, a backend which can not watch returns nil.
+	Watch(ctx context.Context, prefix string) <-chan struct{}
+}
+
+// backendStarter is implemented by the builtin backends, which start their client before use
+type backendStarter interface {
+	start(ctx context.Context, l logger.Logger) error
+}
+
+// backendQuerier is implemented by the backends which ask the peers to announce themselves,
+// the peers of name reply right away, or all peers when name is empty.
+type backendQuerier interface {
+	query(ctx context.Context, prefix, name string) error
+}
+
+const (
+	queryInterval = time.Second            // 同一服务的最小查询间隔
+	queryWait     = time.Millisecond * 300 // 等待查询回复的时间
+)
+
+// OptDiscoverBackend registers and finds the instances with backend.
+func OptDiscoverBackend(backend DiscoveryBackend) discoverOpts {
+	return func(o *discover) {
+		o.discoverType = byBackend
+		o.backend = backend
+	}
+}
+
+// notifyCh sends a value to ch without blocking
+func notifyCh(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// sameBackend reports whether a and b are the same backend, the builtin backends are compared by their config,
+// such as the ones made again from the config file on reload.
+func sameBackend(a, b DiscoveryBackend) bool {
+	switch x := a.(type) {
+	case *staticBackend:
+		y, ok := b.(*staticBackend)
+		return ok && x.file == y.file && slices.Equal(x.records, y.records)
+	case *kvBackend:
+		y, ok := b.(*kvBackend)
+		if !ok {
+			return false
+		}
+		if xs, ok := x.store.(*boltStore); ok {
+			ys, ok := y.store.(*boltStore)
+			return ok && xs.path == ys.path
+		}
+		return sameValue(x.store, y.store)
+	}
+	return sameValue(a, b)
+}
+
+// sameValue reports whether a and b are the same instance, the values which can not be compared are not the same
+func sameValue(a, b any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	return va.IsValid() && vb.IsValid() && va.Type() == vb.Type() && va.Comparable() && va.Equal(vb)
+}
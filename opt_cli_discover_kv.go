@@ -0,0 +1,163 @@
+package gofactory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/xyzj/toolbox/json"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVStore is a key value store used by NewKVBackend, such as an adapter of an etcd client, or NewBoltStore.
+type KVStore interface {
+	// Put writes the value of key
+	Put(ctx context.Context, key, value string) error
+	// Delete removes key, a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Scan returns the values whose key starts with prefix by key
+	Scan(ctx context.Context, prefix string) (map[string]string, error)
+}
+
+// kvRecord is the value of an instance in the store
+type kvRecord struct {
+	Info   string `json:"info"`
+	Expire int64  `json:"expire"` // 过期时间, 毫秒
+}
+
+// kvBackend keeps the instances in a KVStore, the key of an instance is its discover key
+type kvBackend struct {
+	store KVStore
+}
+
+// NewKVBackend returns a backend which keeps the instances in store,
+// the expire time is saved with the info, and the expired instances are removed when listed.
+func NewKVBackend(store KVStore) DiscoveryBackend {
+	return &kvBackend{store: store}
+}
+
+// Register writes the info with its expire time
+func (b *kvBackend) Register(ctx context.Context, prefix, key, info string, ttl time.Duration) error {
+	v, _ := json.MarshalToString(&kvRecord{Info: info, Expire: time.Now().Add(ttl).UnixMilli()})
+	return b.store.Put(ctx, key, v)
+}
+
+// Deregister removes the instance
+func (b *kvBackend) Deregister(ctx context.Context, prefix, key, info string) error {
+	return b.store.Delete(ctx, key)
+}
+
+// List returns the live instances, the expired instances are removed
+func (b *kvBackend) List(ctx context.Context, prefix string) (map[string]string, error) {
+	vals, err := b.store.Scan(ctx, prefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	ss := make(map[string]string, len(vals))
+	for k, v := range vals {
+		x := kvRecord{}
+		if err := json.UnmarshalFromString(v, &x); err != nil || x.Expire <= now {
+			b.store.Delete(ctx, k)
+			continue
+		}
+		ss[k] = x.Info
+	}
+	return ss, nil
+}
+
+// Watch returns nil, the instances are listed every publish interval
+func (b *kvBackend) Watch(ctx context.Context, prefix string) <-chan struct{} {
+	return nil
+}
+
+// boltStore keeps the values in a bucket of a bolt file, the file is opened for every call,
+// so that the services on the same host can share it.
+type boltStore struct {
+	path   string
+	bucket []byte
+}
+
+// NewBoltStore returns a KVStore saved in the bolt file at path, for the services on a single host,
+// use it with NewKVBackend. The file is locked while a call is running, the other processes wait up to 3 seconds.
+func NewBoltStore(path string) KVStore {
+	return &boltStore{
+		path:   path,
+		bucket: []byte("discover"),
+	}
+}
+
+func (b *boltStore) open(readonly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(b.path, 0o644, &bolt.Options{Timeout: time.Second * 3, ReadOnly: readonly})
+	if err != nil {
+		return nil, errors.New("open bolt file error:" + err.Error())
+	}
+	return db, nil
+}
+
+func (b *boltStore) update(ctx context.Context, f func(bk *bolt.Bucket) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db, err := b.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(b.bucket)
+		if err != nil {
+			return err
+		}
+		return f(bk)
+	})
+}
+
+// Put writes the value of key
+func (b *boltStore) Put(ctx context.Context, key, value string) error {
+	return b.update(ctx, func(bk *bolt.Bucket) error {
+		return bk.Put([]byte(key), []byte(value))
+	})
+}
+
+// Delete removes key
+func (b *boltStore) Delete(ctx context.Context, key string) error {
+	return b.update(ctx, func(bk *bolt.Bucket) error {
+		return bk.Delete([]byte(key))
+	})
+}
+
+// Scan returns the values whose key starts with prefix
+func (b *boltStore) Scan(ctx context.Context, prefix string) (map[string]string, error) {
+	ss := make(map[string]string)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// 尚未有实例写入
+	if _, err := os.Stat(b.path); os.IsNotExist(err) {
+		return ss, nil
+	}
+	db, err := b.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		if bk == nil {
+			return nil
+		}
+		c := bk.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			ss[string(k)] = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
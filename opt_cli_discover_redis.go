@@ -0,0 +1,178 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/xyzj/toolbox/json"
+	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/loopfunc"
+)
+
+// redisBackend keeps the instances of a root path in redis:
+//
+//	<root>/discover.registry  hash, field is the instance key and value is the info
+//	<root>/discover.expire    sorted set, member is the instance key and score is the expire time in milliseconds
+//	<root>/discover.events    pub/sub channel, the instance key is published when its status changes
+//
+// The names do not match the `<root>/discover/*` pattern, so they are not read by the older versions,
+// which find the instances by KEYS, and the plain key of the instance is still written for them.
+type redisBackend struct {
+	cli       *cliRedis
+	l         logger.Logger
+	ch        chan struct{} // 收到实例变化通知时立即读取
+	announced ServiceStatus // 最后一次广播的状态
+	mu        sync.Mutex
+}
+
+func newRedisBackend(cli *cliRedis) *redisBackend {
+	return &redisBackend{
+		cli: cli,
+		ch:  make(chan struct{}, 1),
+	}
+}
+
+func (b *redisBackend) start(ctx context.Context, l logger.Logger) error {
+	b.l = l
+	return b.cli.build(ctx, l)
+}
+
+func registryKeys(prefix string) (registry, expire, events string) {
+	return prefix + ".registry", prefix + ".expire", prefix + ".events"
+}
+
+// Register writes the info into the registry,
+// and publishes the key when the status is changed since the last register.
+func (b *redisBackend) Register(ctx context.Context, prefix, key, info string, ttl time.Duration) error {
+	if !b.cli.loaded.Load() {
+		return errors.New("redis client not ready")
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.cli.timeoutWrite())
+	defer cancel()
+	registry, expire, events := registryKeys(prefix)
+	a := svrinfo{}
+	json.UnmarshalFromString(info, &a)
+	b.mu.Lock()
+	changed := a.Status != b.announced
+	b.mu.Unlock()
+	pipe := b.cli.client().TxPipeline()
+	pipe.HSet(ctx, registry, key, info)
+	pipe.ZAdd(ctx, expire, redis.Z{Score: float64(time.Now().Add(ttl).UnixMilli()), Member: key})
+	pipe.Set(ctx, key, info, ttl)
+	if changed {
+		pipe.Publish(ctx, events, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return b.cli.checkRedisDialErr(err)
+	}
+	b.mu.Lock()
+	b.announced = a.Status
+	b.mu.Unlock()
+	return nil
+}
+
+// Deregister removes the instance from the registry and publishes the key
+func (b *redisBackend) Deregister(ctx context.Context, prefix, key, info string) error {
+	if !b.cli.loaded.Load() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.cli.timeoutWrite())
+	defer cancel()
+	registry, expire, events := registryKeys(prefix)
+	pipe := b.cli.client().TxPipeline()
+	pipe.HDel(ctx, registry, key)
+	pipe.ZRem(ctx, expire, key)
+	pipe.Del(ctx, key)
+	pipe.Publish(ctx, events, key)
+	_, err := pipe.Exec(ctx)
+	return b.cli.checkRedisDialErr(err)
+}
+
+// List returns the live instances in the registry, the expired instances are removed from the registry.
+func (b *redisBackend) List(ctx context.Context, prefix string) (map[string]string, error) {
+	if !b.cli.loaded.Load() {
+		return nil, errors.New("redis client not ready")
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.cli.timeoutRead())
+	defer cancel()
+	registry, expire, _ := registryKeys(prefix)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	pipe := b.cli.client().Pipeline()
+	dead := pipe.ZRangeByScore(ctx, expire, &redis.ZRangeBy{Min: "-inf", Max: now})
+	live := pipe.ZRangeByScore(ctx, expire, &redis.ZRangeBy{Min: "(" + now, Max: "+inf"})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, b.cli.checkRedisDialErr(err)
+	}
+	keys := live.Val()
+	pipe = b.cli.client().Pipeline()
+	var vals *redis.SliceCmd
+	if len(keys) > 0 {
+		vals = pipe.HMGet(ctx, registry, keys...)
+	}
+	if ks := dead.Val(); len(ks) > 0 {
+		members := make([]any, 0, len(ks))
+		for _, k := range ks {
+			members = append(members, k)
+		}
+		pipe.HDel(ctx, registry, ks...)
+		pipe.ZRem(ctx, expire, members...)
+	}
+	if pipe.Len() > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, b.cli.checkRedisDialErr(err)
+		}
+	}
+	ss := make(map[string]string)
+	if vals != nil {
+		for i, v := range vals.Val() {
+			if s, ok := v.(string); ok {
+				ss[keys[i]] = s
+			}
+		}
+	}
+	return ss, nil
+}
+
+// Watch subscribes the events channel, and resubscribes when the subscription is closed
+func (b *redisBackend) Watch(ctx context.Context, prefix string) <-chan struct{} {
+	go loopfunc.LoopFunc(func(params ...any) {
+		_, _, events := registryKeys(prefix)
+		for ctx.Err() == nil {
+			if !b.cli.loaded.Load() {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			ps := b.cli.client().Subscribe(ctx, events)
+			ch := ps.Channel()
+		RECV:
+			for {
+				select {
+				case <-ctx.Done():
+					ps.Close()
+					return
+				case _, ok := <-ch:
+					if !ok {
+						break RECV
+					}
+					notifyCh(b.ch)
+				}
+			}
+			ps.Close()
+			b.l.Warning("[discover] registry subscription closed, resubscribe")
+		}
+	}, "discover subscribe", b.l.DefaultWriter())
+	return b.ch
+}
+
+// Close stops the redis client
+func (b *redisBackend) Close() error {
+	return b.cli.close()
+}
@@ -0,0 +1,141 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SRVRecord is a dns srv record of the instances of a service, used by NewStaticBackend
+type SRVRecord struct {
+	Name     string       // 服务名称
+	Record   string       // srv记录, 如 _demo._tcp.example.com
+	Protocol ProtocolType // 实例地址的协议
+}
+
+// staticInstance is an instance in the file of NewStaticBackend
+type staticInstance struct {
+	Name     string            `yaml:"name" json:"name"`         // 服务名称
+	Alias    string            `yaml:"alias" json:"alias"`       // 服务别名
+	Address  map[string]string `yaml:"address" json:"address"`   // 注册地址，key为 tcp, http, https, mqtt, mqtttls, mqttws
+	Weight   int               `yaml:"weight" json:"weight"`     // 负载权重
+	Version  string            `yaml:"version" json:"version"`   // 版本号
+	Zone     string            `yaml:"zone" json:"zone"`         // 所在区域
+	Tags     []string          `yaml:"tags" json:"tags"`         // 标签
+	Metadata map[string]string `yaml:"metadata" json:"metadata"` // 自定义信息
+}
+
+// staticBackend lists the instances from a file and dns srv records, nothing is registered
+type staticBackend struct {
+	file    string
+	records []SRVRecord
+}
+
+// NewStaticBackend returns a backend which lists the instances from file and the dns srv records,
+// for the hosts which have no redis or broadcast network. The instances are read again every publish interval,
+// this instance is not registered, so it should be listed in the file of its peers.
+//
+// The file is a yaml or json list of the instances, such as:
+//
+//	# instances.yaml
+//	- name: demo
+//	  address:
+//	    http: http://10.0.0.2:6880
+//	  weight: 2
+//	  zone: sh1
+//
+// The targets of the srv records with the lowest priority are listed, the srv weight is the instance weight.
+func NewStaticBackend(file string, records ...SRVRecord) DiscoveryBackend {
+	return &staticBackend{
+		file:    file,
+		records: records,
+	}
+}
+
+// Register does nothing, the instances are static
+func (b *staticBackend) Register(ctx context.Context, prefix, key, info string, ttl time.Duration) error {
+	return nil
+}
+
+// Deregister does nothing, the instances are static
+func (b *staticBackend) Deregister(ctx context.Context, prefix, key, info string) error {
+	return nil
+}
+
+// List reads the file and looks up the srv records
+func (b *staticBackend) List(ctx context.Context, prefix string) (map[string]string, error) {
+	ss := make(map[string]string)
+	root := strings.TrimSuffix(prefix, "/discover")
+	if b.file != "" {
+		bb, err := os.ReadFile(b.file)
+		if err != nil {
+			return nil, errors.New("read file error:" + err.Error())
+		}
+		xx := make([]staticInstance, 0)
+		if err := yaml.Unmarshal(bb, &xx); err != nil {
+			return nil, errors.New("parse file error:" + err.Error())
+		}
+		for i, v := range xx {
+			if v.Name == "" {
+				continue
+			}
+			a := &svrinfo{
+				SvrName:         v.Name,
+				SvrAlias:        v.Alias,
+				RootPath:        root,
+				Weight:          v.Weight,
+				Status:          StatusServing,
+				Version:         v.Version,
+				Zone:            v.Zone,
+				Tags:            v.Tags,
+				Metadata:        v.Metadata,
+				RegisterAddress: make(map[ProtocolType]string),
+			}
+			for k, addr := range v.Address {
+				if p, ok := protocolNames[strings.ToLower(k)]; ok {
+					a.RegisterAddress[p] = addr
+				}
+			}
+			ss[prefix+"/"+v.Name+"/static-"+strconv.Itoa(i)] = a.Json()
+		}
+	}
+	var r net.Resolver
+	for _, v := range b.records {
+		_, srvs, err := r.LookupSRV(ctx, "", "", v.Record)
+		if err != nil {
+			return nil, errors.New("lookup srv " + v.Record + " error:" + err.Error())
+		}
+		if len(srvs) == 0 {
+			continue
+		}
+		// 只使用优先级最高(数值最小)的记录
+		pri := slices.MinFunc(srvs, func(a, b *net.SRV) int { return int(a.Priority) - int(b.Priority) }).Priority
+		for _, x := range srvs {
+			if x.Priority != pri {
+				continue
+			}
+			hp := net.JoinHostPort(strings.TrimSuffix(x.Target, "."), strconv.Itoa(int(x.Port)))
+			a := &svrinfo{
+				SvrName:         v.Name,
+				RootPath:        root,
+				Weight:          max(int(x.Weight), 1),
+				Status:          StatusServing,
+				RegisterAddress: map[ProtocolType]string{v.Protocol: v.Protocol.scheme() + hp},
+			}
+			ss[prefix+"/"+v.Name+"/srv-"+hp] = a.Json()
+		}
+	}
+	return ss, nil
+}
+
+// Watch returns nil, the instances are read every publish interval
+func (b *staticBackend) Watch(ctx context.Context, prefix string) <-chan struct{} {
+	return nil
+}
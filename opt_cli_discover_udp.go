@@ -0,0 +1,533 @@
+package gofactory
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/xyzj/toolbox/cache"
+	"github.com/xyzj/toolbox/crypto"
+	"github.com/xyzj/toolbox/json"
+	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/loopfunc"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type svrinfoUDP struct {
+	Info  string `json:"info"`
+	Key   string `json:"key"`
+	Sign  string `json:"sign"`
+	Stamp int64  `json:"stamp,omitempty"` // 发送时间,纳秒,同一发送者严格递增
+}
+
+var errUDPReplayed = errors.New("update time replayed")
+
+func (s *svrinfoUDP) json() []byte {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// discoverKeys is the keypair of a deployment and the public keys of the trusted peers
+type discoverKeys struct {
+	priv    string
+	trusted []string
+	err     error
+}
+
+// udpConfig is the network of the udp discover
+type udpConfig struct {
+	seeds []string // 单播节点
+	group string   // 组播地址,为空时广播
+	iface string   // 网卡名称
+	port  int      // udp端口
+	ttl   int      // 组播ttl
+}
+
+// udpQuery asks the instances of Name to reply their infos, or all instances when Name is empty
+type udpQuery struct {
+	Type        string `json:"type"` // 固定为 query
+	Name        string `json:"name"`
+	RootPath    string `json:"root_path"`
+	UpdateStamp int64  `json:"update_stamp"`
+}
+
+// udpSelf is the last registered info of this instance
+type udpSelf struct {
+	key      string
+	info     string
+	name     string
+	rootPath string
+}
+
+// udpBackend broadcasts the signed infos to the udp port, and keeps the infos received from the peers
+type udpBackend struct {
+	conn    net.PacketConn // udp广播连接
+	qconn   net.PacketConn // 发送查询并接收回复的连接
+	addr    net.Addr       // udp广播或组播地址
+	cfg     udpConfig
+	cryp    *crypto.SM2
+	trusted []*crypto.SM2 // 信任的公钥,为空时使用内置密钥
+	infos   *cache.AnyCache[string]
+	stamps  *cache.AnyCache[int64] // 实例最后的发送时间戳,用于拒绝重放
+	stamp   atomic.Int64           // 本实例最后的发送时间戳
+	ch      chan struct{}          // 收到实例变化时通知
+	self    udpSelf                // 本实例最后发布的信息,用于回复查询
+	timeout time.Duration
+	mu      sync.Mutex
+}
+
+func newUDPBackend(cfg udpConfig, timeout time.Duration, keys *discoverKeys) (*udpBackend, error) {
+	b := &udpBackend{
+		cryp:    crypto.NewSM2(),
+		infos:   cache.NewAnyCache[string](timeout),
+		stamps:  cache.NewAnyCache[int64](timeout * 2),
+		ch:      make(chan struct{}, 1),
+		cfg:     cfg,
+		timeout: timeout,
+	}
+	if keys == nil {
+		b.cryp.SetPrivateKey(getSM2())
+		return b, nil
+	}
+	if keys.err != nil {
+		return nil, keys.err
+	}
+	if err := b.cryp.SetPrivateKey(keyBase64(keys.priv)); err != nil {
+		return nil, errors.New("private key error:" + err.Error())
+	}
+	b.trusted = []*crypto.SM2{b.cryp}
+	for _, v := range keys.trusted {
+		c := crypto.NewSM2()
+		if err := c.SetPublicKey(keyBase64(v)); err != nil {
+			return nil, errors.New("trusted key error:" + err.Error())
+		}
+		b.trusted = append(b.trusted, c)
+	}
+	return b, nil
+}
+
+// keyBase64 returns the base64 der of a pem key, a key which is not pem is returned as it is
+func keyBase64(s string) string {
+	if p, _ := pem.Decode([]byte(s)); p != nil {
+		return base64.StdEncoding.EncodeToString(p.Bytes)
+	}
+	return strings.TrimSpace(s)
+}
+
+// checkStamp rejects the packet whose send time is out of the info timeout,
+// or is not newer than the last packet of the same instance, stamp is in nanoseconds.
+func (b *udpBackend) checkStamp(key string, stamp int64) error {
+	if d := time.Since(time.Unix(0, stamp)); d > b.timeout || d < -b.timeout {
+		return errors.New("update time out of window")
+	}
+	// 两个连接同时接收,检查与保存需要互斥
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if last, ok := b.stamps.Load(key); ok && stamp <= last {
+		return errUDPReplayed
+	}
+	b.stamps.Store(key, stamp)
+	return nil
+}
+
+// nextStamp returns the send time of a packet, which is greater than the last one
+func (b *udpBackend) nextStamp() int64 {
+	for {
+		last, now := b.stamp.Load(), time.Now().UnixNano()
+		if now <= last {
+			now = last + 1
+		}
+		if b.stamp.CompareAndSwap(last, now) {
+			return now
+		}
+	}
+}
+
+// start binds the udp port and receives the infos until ctx is done,
+// the queries are sent from another socket on a random port, so that the replies reach this instance
+// when several instances on the same host share the udp port.
+func (b *udpBackend) start(ctx context.Context, l logger.Logger) error {
+	var ifi *net.Interface
+	if b.cfg.iface != "" {
+		x, err := net.InterfaceByName(b.cfg.iface)
+		if err != nil {
+			return errors.New("interface error:" + err.Error())
+		}
+		ifi = x
+	}
+	network := "udp4"
+	var group net.IP
+	if b.cfg.group != "" {
+		group = net.ParseIP(b.cfg.group)
+		if group == nil || !group.IsMulticast() {
+			return errors.New("multicast group error:" + b.cfg.group)
+		}
+		if group.To4() == nil {
+			network = "udp6"
+		}
+	}
+	u, err := b.listen(ctx, network, b.cfg.port, ifi, group)
+	if err != nil {
+		return err
+	}
+	qc, err := b.listen(ctx, network, 0, ifi, group)
+	if err != nil {
+		u.Close()
+		return err
+	}
+	var p net.Addr = &net.UDPAddr{IP: group, Port: b.cfg.port}
+	if group == nil {
+		p = &net.UDPAddr{IP: broadcastIP(ifi), Port: b.cfg.port}
+	}
+	b.mu.Lock()
+	b.conn, b.qconn, b.addr = u, qc, p
+	b.mu.Unlock()
+	l.System("[discover] start udp server on port:" + strconv.Itoa(b.cfg.port) + ", send to " + p.String())
+	// the conns are closed by Close after the goodbye is sent
+	go loopfunc.LoopFunc(func(params ...any) {
+		b.receive(ctx, l, u)
+	}, "discover udp", l.DefaultWriter())
+	go loopfunc.LoopFunc(func(params ...any) {
+		b.receive(ctx, l, qc)
+	}, "discover udp query", l.DefaultWriter())
+	return nil
+}
+
+// listen binds the port, the multicast group is joined when the port is not 0
+func (b *udpBackend) listen(ctx context.Context, network string, port int, ifi *net.Interface, group net.IP) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setSockopt(fd, network)
+			})
+			return errors.Join(err, serr)
+		},
+	}
+	u, err := lc.ListenPacket(ctx, network, ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, errors.New("listen udp port error:" + err.Error())
+	}
+	if group == nil {
+		return u, nil
+	}
+	if network == "udp4" {
+		pc := ipv4.NewPacketConn(u)
+		err = errors.Join(pc.SetMulticastTTL(b.cfg.ttl), pc.SetMulticastLoopback(true))
+		if port > 0 {
+			err = errors.Join(err, pc.JoinGroup(ifi, &net.UDPAddr{IP: group}))
+		}
+		if ifi != nil {
+			err = errors.Join(err, pc.SetMulticastInterface(ifi))
+		}
+	} else {
+		pc := ipv6.NewPacketConn(u)
+		err = errors.Join(pc.SetMulticastHopLimit(b.cfg.ttl), pc.SetMulticastLoopback(true))
+		if port > 0 {
+			err = errors.Join(err, pc.JoinGroup(ifi, &net.UDPAddr{IP: group}))
+		}
+		if ifi != nil {
+			err = errors.Join(err, pc.SetMulticastInterface(ifi))
+		}
+	}
+	if err != nil {
+		u.Close()
+		return nil, errors.New("join multicast group error:" + err.Error())
+	}
+	return u, nil
+}
+
+// receive reads the infos and queries from u until ctx is done or u is closed
+func (b *udpBackend) receive(ctx context.Context, l logger.Logger, u net.PacketConn) {
+	buf := make([]byte, 4096)
+	for {
+		n, ra, err := u.ReadFrom(buf)
+		if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 {
+			continue
+		}
+		key, info, stamp, err := b.unpack(string(buf[:n]))
+		if err != nil {
+			l.Error("[discover] unpack error from " + ra.String() + ":" + err.Error())
+			continue
+		}
+		a := svrinfo{}
+		if err := json.UnmarshalFromString(info, &a); err != nil {
+			l.Error("[discover] unpack error from " + ra.String() + ":" + err.Error())
+			continue
+		}
+		if q := (udpQuery{}); json.UnmarshalFromString(info, &q) == nil && q.Type == "query" {
+			if err := b.checkStamp(key, packetStamp(stamp, q.UpdateStamp)); err != nil {
+				b.logDrop(l, "query", ra, err)
+				continue
+			}
+			if err := b.reply(u, ra, key, q); err != nil {
+				l.Error("[discover] reply query to " + ra.String() + " error:" + err.Error())
+			}
+			continue
+		}
+		if err := b.checkStamp(key, packetStamp(stamp, a.UpdateStamp)); err != nil {
+			b.logDrop(l, "packet", ra, err)
+			continue
+		}
+		if a.Status == StatusLeaving {
+			b.infos.Delete(key)
+			notifyCh(b.ch)
+			l.Debug("[discover] goodbye from " + ra.String() + ":" + a.SvrName)
+			continue
+		}
+		// the cache updates an existing entry out of its lock, so the update and List are serialized
+		b.mu.Lock()
+		old, ok := b.infos.Load(key)
+		b.infos.Store(key, info)
+		b.mu.Unlock()
+		// 新实例或状态变化时立即通知
+		if x := (svrinfo{}); !ok || json.UnmarshalFromString(old, &x) != nil || x.Status != a.Status {
+			notifyCh(b.ch)
+		}
+		l.Debug("[discover] unpack info from " + ra.String() + ":" + info)
+	}
+}
+
+// packetStamp returns the send time of a packet,
+// the packets of the older versions have no send time and use the update time in seconds.
+func packetStamp(stamp, updateStamp int64) int64 {
+	if stamp > 0 {
+		return stamp
+	}
+	return updateStamp * int64(time.Second)
+}
+
+// logDrop logs a dropped packet, a replayed one is usually the same packet received by both broadcast and unicast
+func (b *udpBackend) logDrop(l logger.Logger, kind string, ra net.Addr, err error) {
+	if errors.Is(err, errUDPReplayed) {
+		l.Debug("[discover] drop " + kind + " from " + ra.String() + ":" + err.Error())
+		return
+	}
+	l.Error("[discover] drop " + kind + " from " + ra.String() + ":" + err.Error())
+}
+
+// pack signs the info of key.
+// With the builtin key the info is encrypted and signed as the older versions,
+// with the keys of OptDiscoverKeys the info is signed together with the key and the send time.
+func (b *udpBackend) pack(key, info string) (string, error) {
+	a := svrinfoUDP{Key: key, Stamp: b.nextStamp()}
+	if b.trusted == nil {
+		bb, err := b.cryp.Encode([]byte(info))
+		if err != nil {
+			return "", err
+		}
+		a.Info = bb.Base64String()
+	} else {
+		a.Info = base64.StdEncoding.EncodeToString([]byte(info))
+	}
+	bbb, err := b.cryp.Sign(b.signData(a))
+	if err != nil {
+		return "", err
+	}
+	a.Sign = bbb.Base64String()
+	return json.String(a.json()), nil
+}
+
+func (b *udpBackend) signData(a svrinfoUDP) []byte {
+	if b.trusted == nil {
+		return []byte(a.Info)
+	}
+	return []byte(a.Key + "\n" + strconv.FormatInt(a.Stamp, 10) + "\n" + a.Info)
+}
+
+// unpack verifies the message and returns the key, info and send time
+func (b *udpBackend) unpack(s string) (string, string, int64, error) {
+	aa := svrinfoUDP{}
+	if err := json.UnmarshalFromString(s, &aa); err != nil {
+		return "", "", 0, err
+	}
+	if b.trusted == nil {
+		ok, _ := b.cryp.VerifySignFromBase64(aa.Sign, b.signData(aa))
+		if !ok {
+			return "", "", 0, errors.New("verify sign failed")
+		}
+		info, err := b.cryp.DecodeBase64(aa.Info)
+		if err != nil {
+			return "", "", 0, err
+		}
+		return aa.Key, info, aa.Stamp, nil
+	}
+	trusted := false
+	for _, c := range b.trusted {
+		if ok, _ := c.VerifySignFromBase64(aa.Sign, b.signData(aa)); ok {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return "", "", 0, errors.New("signed by an untrusted key")
+	}
+	info, err := base64.StdEncoding.DecodeString(aa.Info)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return aa.Key, string(info), aa.Stamp, nil
+}
+
+func (b *udpBackend) send(key, info string) error {
+	b.mu.Lock()
+	u := b.conn
+	b.mu.Unlock()
+	return b.sendFrom(u, key, info)
+}
+
+// sendFrom sends the info to the broadcast or multicast address and the seeds from u
+func (b *udpBackend) sendFrom(u net.PacketConn, key, info string) error {
+	b.mu.Lock()
+	p := b.addr
+	b.mu.Unlock()
+	if u == nil {
+		return errors.New("udp conn not ready")
+	}
+	s, err := b.pack(key, info)
+	if err != nil {
+		return err
+	}
+	bb := json.Bytes(s)
+	_, err = u.WriteTo(bb, p)
+	for _, v := range b.cfg.seeds {
+		if _, _, e := net.SplitHostPort(v); e != nil {
+			v = net.JoinHostPort(v, strconv.Itoa(b.cfg.port))
+		}
+		a, e := net.ResolveUDPAddr("udp", v)
+		if e == nil {
+			_, e = u.WriteTo(bb, a)
+		}
+		if e != nil {
+			err = errors.Join(err, errors.New("send to seed "+v+" error:"+e.Error()))
+		}
+	}
+	return err
+}
+
+// broadcastIP returns the broadcast address of the first ipv4 subnet of ifi, or 255.255.255.255
+func broadcastIP(ifi *net.Interface) net.IP {
+	if ifi == nil {
+		return net.IPv4bcast
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return net.IPv4bcast
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.To4() == nil || len(ipn.Mask) != net.IPv4len {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, v := range ipn.IP.To4() {
+			ip[i] = v | ^ipn.Mask[i]
+		}
+		return ip
+	}
+	return net.IPv4bcast
+}
+
+// Register broadcasts the info
+func (b *udpBackend) Register(ctx context.Context, prefix, key, info string, ttl time.Duration) error {
+	a := svrinfo{}
+	json.UnmarshalFromString(info, &a)
+	b.mu.Lock()
+	b.self = udpSelf{key: key, info: info, name: a.SvrName, rootPath: a.RootPath}
+	b.mu.Unlock()
+	return b.send(key, info)
+}
+
+// query broadcasts a query for name, the peers reply to this instance by unicast
+func (b *udpBackend) query(ctx context.Context, prefix, name string) error {
+	b.mu.Lock()
+	key, qc := b.self.key, b.qconn
+	b.mu.Unlock()
+	if key == "" {
+		key = prefix + "/query"
+	}
+	q, _ := json.MarshalToString(&udpQuery{
+		Type:        "query",
+		Name:        name,
+		RootPath:    strings.TrimSuffix(prefix, "/discover"),
+		UpdateStamp: time.Now().Unix(),
+	})
+	return b.sendFrom(qc, key, q)
+}
+
+// reply sends the info of this instance to the peer which queried it
+func (b *udpBackend) reply(u net.PacketConn, ra net.Addr, key string, q udpQuery) error {
+	b.mu.Lock()
+	self := b.self
+	b.mu.Unlock()
+	if self.info == "" || key == self.key || q.RootPath != self.rootPath || (q.Name != "" && q.Name != self.name) {
+		return nil
+	}
+	s, err := b.pack(self.key, self.info)
+	if err != nil {
+		return err
+	}
+	_, err = u.WriteTo(json.Bytes(s), ra)
+	return err
+}
+
+// Deregister broadcasts the goodbye
+func (b *udpBackend) Deregister(ctx context.Context, prefix, key, info string) error {
+	if err := b.send(key, info); err != nil {
+		return errors.New("send goodbye error:" + err.Error())
+	}
+	return nil
+}
+
+// List returns the received infos under prefix
+func (b *udpBackend) List(ctx context.Context, prefix string) (map[string]string, error) {
+	ss := make(map[string]string)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.infos.ForEach(func(key string, value string) bool {
+		if strings.HasPrefix(key, prefix+"/") {
+			ss[key] = value
+		}
+		return true
+	})
+	return ss, nil
+}
+
+// Watch notifies when an instance is found, changes its status or leaves
+func (b *udpBackend) Watch(ctx context.Context, prefix string) <-chan struct{} {
+	return b.ch
+}
+
+// Close closes the udp conns
+func (b *udpBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := errors.Join(b.conn.Close(), b.qconn.Close())
+	b.conn, b.qconn = nil, nil
+	return err
+}
+
+// GenerateDiscoverKeys returns a new sm2 keypair in pem for OptDiscoverKeys
+func GenerateDiscoverKeys() (string, string, error) {
+	pub, priv, err := crypto.NewSM2().GenerateKey()
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})), nil
+}
@@ -0,0 +1,241 @@
+package gofactory
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xyzj/toolbox/logger"
+)
+
+const testDiscoverPrefix = "/test-root/discover"
+
+// freeUDPPort returns a udp port which is not used now
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	u, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	return u.LocalAddr().(*net.UDPAddr).Port
+}
+
+func startUDPBackend(t *testing.T, ctx context.Context, cfg udpConfig, keys *discoverKeys) *udpBackend {
+	t.Helper()
+	b, err := newUDPBackend(cfg, time.Second*10, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.start(ctx, logger.NewNilLogger()); err != nil {
+		t.Skip("udp not available:", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func testInfo(name, key string, st ServiceStatus) string {
+	a := &svrinfo{SvrName: name, RootPath: "/test-root", Status: st, InstanceID: key}
+	return a.Json()
+}
+
+// waitInfo waits until b lists key, or lists it no more when gone is true
+func waitInfo(t *testing.T, b *udpBackend, key string, gone bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		ss, err := b.List(context.Background(), testDiscoverPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := ss[key]; ok != gone {
+			return
+		}
+		select {
+		case <-b.ch:
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+	if gone {
+		t.Fatalf("%s is still listed", key)
+	}
+	t.Fatalf("%s is not received", key)
+}
+
+func TestUDPBackendUnicast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pa, pb := freeUDPPort(t), freeUDPPort(t)
+	// 广播可能不可用，通过单播节点互相发送
+	a := startUDPBackend(t, ctx, udpConfig{port: pa, seeds: []string{"127.0.0.1:" + strconv.Itoa(pb)}}, nil)
+	b := startUDPBackend(t, ctx, udpConfig{port: pb, seeds: []string{"127.0.0.1:" + strconv.Itoa(pa)}}, nil)
+
+	keyA := testDiscoverPrefix + "/svc-a/1"
+	a.Register(ctx, testDiscoverPrefix, keyA, testInfo("svc-a", keyA, StatusServing), time.Second*10)
+	waitInfo(t, b, keyA, false)
+
+	// b回复查询，信息经单播到达a的查询连接
+	keyB := testDiscoverPrefix + "/svc-b/1"
+	b.mu.Lock()
+	b.self = udpSelf{key: keyB, info: testInfo("svc-b", keyB, StatusServing), name: "svc-b", rootPath: "/test-root"}
+	b.mu.Unlock()
+	a.query(ctx, testDiscoverPrefix, "svc-b")
+	waitInfo(t, a, keyB, false)
+
+	// 离开后立即移除
+	a.Deregister(ctx, testDiscoverPrefix, keyA, testInfo("svc-a", keyA, StatusLeaving))
+	waitInfo(t, b, keyA, true)
+}
+
+func TestUDPBackendUntrusted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	privA, pubA, err := GenerateDiscoverKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privB, _, err := GenerateDiscoverKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa, pb, pc := freeUDPPort(t), freeUDPPort(t), freeUDPPort(t)
+	// b信任a，c不信任a
+	a := startUDPBackend(t, ctx, udpConfig{port: pa, seeds: []string{"127.0.0.1:" + strconv.Itoa(pb), "127.0.0.1:" + strconv.Itoa(pc)}}, &discoverKeys{priv: privA})
+	b := startUDPBackend(t, ctx, udpConfig{port: pb}, &discoverKeys{priv: privB, trusted: []string{pubA}})
+	c := startUDPBackend(t, ctx, udpConfig{port: pc}, &discoverKeys{priv: privB})
+
+	keyA := testDiscoverPrefix + "/svc-a/1"
+	a.Register(ctx, testDiscoverPrefix, keyA, testInfo("svc-a", keyA, StatusServing), time.Second*10)
+	waitInfo(t, b, keyA, false)
+	ss, _ := c.List(ctx, testDiscoverPrefix)
+	if _, ok := ss[keyA]; ok {
+		t.Fatal("the info signed by an untrusted key is accepted")
+	}
+}
+
+func TestUDPBackendMulticast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ifi := multicastInterface()
+	if ifi == "" {
+		t.Skip("no multicast interface")
+	}
+	port := freeUDPPort(t)
+	cfg := udpConfig{port: port, group: "239.255.73.81", iface: ifi, ttl: 1}
+	// 两个实例共用端口，都加入组播
+	a := startUDPBackend(t, ctx, cfg, nil)
+	b := startUDPBackend(t, ctx, cfg, nil)
+
+	keyA := testDiscoverPrefix + "/svc-a/1"
+	if err := a.Register(ctx, testDiscoverPrefix, keyA, testInfo("svc-a", keyA, StatusServing), time.Second*10); err != nil {
+		t.Skip("multicast send error:", err)
+	}
+	waitInfo(t, b, keyA, false)
+}
+
+// multicastInterface returns the name of an up interface which supports multicast
+func multicastInterface() string {
+	ii, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, v := range ii {
+		if v.Flags&net.FlagUp != 0 && v.Flags&net.FlagMulticast != 0 {
+			return v.Name
+		}
+	}
+	return ""
+}
+
+func TestUDPBackendStamp(t *testing.T) {
+	b, err := newUDPBackend(udpConfig{}, time.Second*10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UnixNano()
+	tests := []struct {
+		name  string
+		key   string
+		stamp int64
+		ok    bool
+	}{
+		{"first", "a", now, true},
+		{"newer", "a", now + 1, true},
+		{"same", "a", now + 1, false},
+		{"older", "a", now, false},
+		{"other sender", "b", now, true},
+		{"too old", "c", now - int64(time.Second*11), false},
+		{"too new", "c", now + int64(time.Second*11), false},
+		{"older version", "d", packetStamp(0, time.Now().Unix()), true},
+	}
+	for _, tt := range tests {
+		if err := b.checkStamp(tt.key, tt.stamp); (err == nil) != tt.ok {
+			t.Fatalf("%s: error %v", tt.name, err)
+		}
+	}
+	// 同一纳秒内发送的消息也严格递增
+	last := b.nextStamp()
+	for range 1000 {
+		x := b.nextStamp()
+		if x <= last {
+			t.Fatalf("stamp %d after %d", x, last)
+		}
+		last = x
+	}
+}
+
+func TestUDPBackendReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, keys := range []bool{false, true} {
+		t.Run("keys "+strconv.FormatBool(keys), func(t *testing.T) {
+			var ka, kb *discoverKeys
+			if keys {
+				priv, pub, err := GenerateDiscoverKeys()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ka, kb = &discoverKeys{priv: priv}, &discoverKeys{priv: priv, trusted: []string{pub}}
+			}
+			a, err := newUDPBackend(udpConfig{}, time.Second*10, ka)
+			if err != nil {
+				t.Fatal(err)
+			}
+			port := freeUDPPort(t)
+			b := startUDPBackend(t, ctx, udpConfig{port: port}, kb)
+			conn, err := net.Dial("udp4", "127.0.0.1:"+strconv.Itoa(port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			key := testDiscoverPrefix + "/svc-a/1"
+			// 注册与离开在同一秒内发送
+			hello, _ := a.pack(key, testInfo("svc-a", key, StatusServing))
+			bye, _ := a.pack(key, testInfo("svc-a", key, StatusLeaving))
+			conn.Write([]byte(hello))
+			waitInfo(t, b, key, false)
+			conn.Write([]byte(bye))
+			waitInfo(t, b, key, true)
+			// 重放的注册被拒绝
+			conn.Write([]byte(hello))
+			time.Sleep(time.Millisecond * 200)
+			if ss, _ := b.List(ctx, testDiscoverPrefix); ss[key] != "" {
+				t.Fatal("the replayed packet is accepted")
+			}
+			hello, _ = a.pack(key, testInfo("svc-a", key, StatusServing))
+			conn.Write([]byte(hello))
+			waitInfo(t, b, key, false)
+			// 同一秒内的旧状态被拒绝
+			draining := testInfo("svc-a", key, StatusDraining)
+			p, _ := a.pack(key, draining)
+			conn.Write([]byte(p))
+			conn.Write([]byte(hello))
+			time.Sleep(time.Millisecond * 200)
+			if ss, _ := b.List(ctx, testDiscoverPrefix); ss[key] != draining {
+				t.Fatalf("info %s", ss[key])
+			}
+		})
+	}
+}
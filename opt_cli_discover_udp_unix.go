@@ -0,0 +1,16 @@
+//go:build !windows
+
+package gofactory
+
+import "syscall"
+
+// setSockopt allows the programs on the same host to bind the udp port, and to broadcast
+func setSockopt(fd uintptr, network string) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	if network == "udp6" {
+		return nil
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+}
@@ -1,7 +1,11 @@
 package gofactory
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"maps"
+	"sync/atomic"
 	"time"
 
 	"github.com/xyzj/toolbox/logger"
@@ -9,7 +13,8 @@ import (
 )
 
 type cliMqtt struct {
-	cli                    *mq.MqttClientV5
+	cli                    atomic.Pointer[mq.MqttClientV5] // 订阅变化时替换
+	logg                   logger.Logger
 	tlsc                   *tls.Config                     // tls配置，默认为 InsecureSkipVerify: true
 	subscribe              map[string]byte                 // 订阅消息，map[topic]qos
 	sendTimeo              time.Duration                   // 发送超时
@@ -26,28 +31,82 @@ type cliMqtt struct {
 }
 
 func (opt *cliMqtt) build(l logger.Logger) error {
-	var err error
-	opt.cli, err = mq.NewMQTTClientV5(&mq.MqttOpt{
-		Logg:                   l,
+	opt.logg = l
+	opt.subscribe = maps.Clone(opt.subscribe)
+	cli, err := opt.newClient(opt.subscribe)
+	opt.cli.Store(cli)
+	return err
+}
+
+// newClient creates a client subscribing sub, the client reads a copy of sub on every reconnect
+func (opt *cliMqtt) newClient(sub map[string]byte) (*mq.MqttClientV5, error) {
+	return mq.NewMQTTClientV5(&mq.MqttOpt{
+		Logg:                   opt.logg,
 		Username:               opt.user,
 		Passwd:                 opt.pwd,
 		ClientID:               opt.clientID,
 		Addr:                   opt.addr,
 		TLSConf:                opt.tlsc,
 		SendTimeo:              opt.sendTimeo,
-		Subscribe:              opt.subscribe,
+		Subscribe:              maps.Clone(sub),
 		EnableFailureCache:     opt.enableFailureCache,
 		FailureCacheMax:        opt.failureCacheMax,
 		FailureCacheExpire:     opt.failureCacheExpire,
 		FailureCacheExpireFunc: opt.failureCacheExpireFunc,
 		LogHeader:              "[mqtt]",
 	}, opt.recvFunc)
-	if err != nil {
-		return err
+}
+
+func (opt *cliMqtt) client() *mq.MqttClientV5 {
+	return opt.cli.Load()
+}
+
+// resubscribe replaces the client with a new one subscribing sub,
+// the subscriptions of a client can not be changed after it's created,
+// since it subscribes them again on every reconnect.
+// The old client is closed first, or the two clients with the same client id would take over each other.
+func (opt *cliMqtt) resubscribe(sub map[string]byte) error {
+	old := opt.cli.Load()
+	if old == nil {
+		return errors.New("[mqtt] resubscribe error: client closed")
+	}
+	var err error
+	if e := closeMqttClient(old); e != nil {
+		err = errors.New("[mqtt] close error:" + e.Error())
+	}
+	opt.subscribe = maps.Clone(sub)
+	cli, e := opt.newClient(opt.subscribe)
+	if e != nil {
+		err = errors.Join(err, errors.New("[mqtt] resubscribe error:"+e.Error()))
+	}
+	if !opt.cli.CompareAndSwap(old, cli) {
+		// closed meanwhile
+		closeMqttClient(cli)
+	}
+	return err
+}
+
+// close closes the client, the client is not replaced after closed
+func (opt *cliMqtt) close() error {
+	if cli := opt.cli.Swap(nil); cli != nil {
+		return closeMqttClient(cli)
 	}
 	return nil
 }
 
+// closeMqttClient disconnects cli before closing it. Close drops the failure cache of cli
+// while the reconnect callback may be resending from it, the disconnect waits until the callback returns.
+// cli is closed even when the disconnect fails, so that its cache and goroutines are released.
+func closeMqttClient(cli *mq.MqttClientV5) error {
+	var err error
+	if cm := cli.Client(); cm != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		err = cm.Disconnect(ctx)
+	}
+	return errors.Join(err, cli.Close())
+}
+
 type mqttOpts func(o *cliMqtt)
 
 func OptMqttHost(s string, t *tls.Config) mqttOpts {
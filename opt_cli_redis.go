@@ -3,57 +3,208 @@ package gofactory
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/xyzj/toolbox"
+	"github.com/xyzj/toolbox/crypto"
 	"github.com/xyzj/toolbox/json"
 	"github.com/xyzj/toolbox/logger"
 	"github.com/xyzj/toolbox/loopfunc"
 )
 
 type cliRedis struct {
-	cli          *redis.Client
+	cli          atomic.Pointer[redis.UniversalClient] // 重连时替换
+	hook         redis.Hook
 	user         string
 	pwd          string
 	addr         string
+	master       string   // 哨兵模式的主节点名称
+	addrs        []string // 哨兵或集群节点地址
+	cluster      bool     // 集群模式
+	tlsc         *tls.Config
+	tlsFiles     [3]string // tls证书，私钥，根证书文件
+	tlsErr       error     // 载入tls证书的错误
+	tlsInsecure  bool      // 不验证服务端证书
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	timeouts     atomic.Pointer[redisTimeouts] // 重载后的超时
+	keyEvents    bool                          // 订阅过期通知时开启服务端的键事件通知
 	database     int
-	cliver       int
+	cliver       atomic.Int32
 	loaded       atomic.Bool
 	enable       bool
 }
 
-func (opt *cliRedis) build(l logger.Logger) error {
-	p, ok := checkTCPAddr(opt.addr)
-	if !ok {
-		return errors.New("[redis] addr error")
+// redisTimeouts is the timeouts of the calls, which are replaced by Reload
+type redisTimeouts struct {
+	read  time.Duration
+	write time.Duration
+}
+
+// setTimeouts changes the timeouts of the calls while the client is used
+func (opt *cliRedis) setTimeouts(read, write time.Duration) {
+	opt.timeouts.Store(&redisTimeouts{read: read, write: write})
+}
+
+// timeoutRead returns the timeout of the reads
+func (opt *cliRedis) timeoutRead() time.Duration {
+	if t := opt.timeouts.Load(); t != nil {
+		return t.read
+	}
+	return opt.readTimeout
+}
+
+// timeoutWrite returns the timeout of the writes and the other commands
+func (opt *cliRedis) timeoutWrite() time.Duration {
+	if t := opt.timeouts.Load(); t != nil {
+		return t.write
+	}
+	return opt.writeTimeout
+}
+
+// endpoint returns the address of the server, or the nodes of sentinel and cluster
+func (opt *cliRedis) endpoint() string {
+	switch {
+	case opt.master != "":
+		return opt.master + "@" + strings.Join(opt.addrs, ",")
+	case opt.cluster:
+		return "cluster@" + strings.Join(opt.addrs, ",")
+	}
+	return opt.addr
+}
+
+// newClient returns a client of a single server, a sentinel master or a cluster
+func (opt *cliRedis) newClient() redis.UniversalClient {
+	tlsc := opt.tlsConfig()
+	switch {
+	case opt.master != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:            opt.master,
+			SentinelAddrs:         opt.addrs,
+			Username:              opt.user,
+			Password:              opt.pwd,
+			DB:                    opt.database,
+			PoolFIFO:              true,
+			MinIdleConns:          3,
+			ConnMaxIdleTime:       time.Minute,
+			ReadTimeout:           opt.readTimeout,
+			WriteTimeout:          opt.writeTimeout,
+			DialTimeout:           time.Second * 5,
+			ContextTimeoutEnabled: true, // 使用调用方ctx的超时与取消
+			TLSConfig:             tlsc,
+		})
+	case opt.cluster:
+		// 集群不支持选择数据库
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:                 opt.addrs,
+			Username:              opt.user,
+			Password:              opt.pwd,
+			PoolFIFO:              true,
+			MinIdleConns:          3,
+			ConnMaxIdleTime:       time.Minute,
+			ReadTimeout:           opt.readTimeout,
+			WriteTimeout:          opt.writeTimeout,
+			DialTimeout:           time.Second * 5,
+			ContextTimeoutEnabled: true, // 使用调用方ctx的超时与取消
+			TLSConfig:             tlsc,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:                  opt.addr,
+		Username:              opt.user,
+		Password:              opt.pwd,
+		DB:                    opt.database,
+		PoolFIFO:              true,
+		MinIdleConns:          3,
+		ConnMaxIdleTime:       time.Minute,
+		ReadTimeout:           opt.readTimeout,
+		WriteTimeout:          opt.writeTimeout,
+		DialTimeout:           time.Second * 5,
+		ContextTimeoutEnabled: true, // 使用调用方ctx的超时与取消
+		TLSConfig:             tlsc,
+	})
+}
+
+// sameConn reports whether x connects to the same servers in the same way
+func (opt *cliRedis) sameConn(x *cliRedis) bool {
+	return opt.addr == x.addr &&
+		opt.master == x.master &&
+		opt.cluster == x.cluster &&
+		slices.Equal(opt.addrs, x.addrs) &&
+		opt.user == x.user &&
+		opt.pwd == x.pwd &&
+		opt.database == x.database &&
+		opt.sameTLS(x) &&
+		opt.tlsInsecure == x.tlsInsecure
+}
+
+// sameTLS reports whether x uses the same tls config,
+// the configs loaded from files are new in every load, so they are compared by the files.
+func (opt *cliRedis) sameTLS(x *cliRedis) bool {
+	if opt.tlsFiles != x.tlsFiles {
+		return false
+	}
+	if opt.tlsFiles != ([3]string{}) {
+		return true
+	}
+	return reflect.DeepEqual(opt.tlsc, x.tlsc)
+}
+
+// tlsConfig returns the tls config of the client, the server name is not set,
+// so that the sentinel and cluster nodes are verified by their own hosts.
+func (opt *cliRedis) tlsConfig() *tls.Config {
+	if opt.tlsc == nil {
+		return nil
+	}
+	t := opt.tlsc.Clone()
+	if opt.tlsInsecure {
+		t.InsecureSkipVerify = true
+	}
+	return t
+}
+
+func (opt *cliRedis) build(ctx context.Context, l logger.Logger) error {
+	if opt.tlsErr != nil {
+		return errors.New("[redis] tls error:" + opt.tlsErr.Error())
+	}
+	// ServerName is left empty, so that the tls dial verifies the host of every dialed address,
+	// the addresses are kept as they are set for the same reason.
+	if len(opt.addrs) > 0 {
+		for _, a := range opt.addrs {
+			if _, ok := checkTCPAddr(a); !ok {
+				return errors.New("[redis] node addr error:" + a)
+			}
+		}
+	} else {
+		if opt.master != "" || opt.cluster {
+			return errors.New("[redis] no node addr")
+		}
+		if _, ok := checkTCPAddr(opt.addr); !ok {
+			return errors.New("[redis] addr error")
+		}
 	}
-	opt.addr = p.String()
 	opt.loaded = atomic.Bool{}
 	fConn := func() {
-		opt.cli = redis.NewClient(&redis.Options{
-			Addr:            opt.addr,
-			Password:        opt.pwd,
-			DB:              opt.database,
-			PoolFIFO:        true,
-			MinIdleConns:    3,
-			ConnMaxIdleTime: time.Minute,
-			ReadTimeout:     opt.readTimeout,
-			WriteTimeout:    opt.writeTimeout,
-			DialTimeout:     time.Second * 5,
-		})
-		if opt.cli == nil {
-			return
+		cli := opt.newClient()
+		if opt.hook != nil {
+			cli.AddHook(opt.hook)
+		}
+		// the calls which got the old client fail with redis.ErrClosed
+		if old := opt.cli.Swap(&cli); old != nil {
+			(*old).Close()
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 		defer cancel()
-		a, err := opt.cli.Info(ctx, "Server").Result()
+		a, err := cli.Info(ctx, "Server").Result()
 		if err != nil {
 			l.Error("[redis] get version error:" + err.Error())
 			return
@@ -62,58 +213,107 @@ func (opt *cliRedis) build(l logger.Logger) error {
 		for !sr.Scan() {
 			s := json.String(sr.Bytes())
 			if strings.HasPrefix(sr.Text(), "redis_version:") {
-				opt.cliver = toolbox.String2Int(strings.Split(strings.Split(s, ":")[1], ".")[0], 10)
+				opt.cliver.Store(int32(toolbox.String2Int(strings.Split(strings.Split(s, ":")[1], ".")[0], 10)))
 				break
 			}
 		}
 		opt.loaded.Store(true)
-		l.System(fmt.Sprintf("[redis] client to [%s] is ready, use db %d", opt.addr, opt.database))
+		l.System(fmt.Sprintf("[redis] client to [%s] is ready, use db %d", opt.endpoint(), opt.database))
 	}
 	fConn()
 	go loopfunc.LoopFunc(func(params ...interface{}) {
 		t1 := time.NewTicker(time.Second * 10)
-		for range t1.C {
-			if !opt.loaded.Load() {
-				fConn()
+		defer t1.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t1.C:
+				if !opt.loaded.Load() {
+					fConn()
+				}
 			}
 		}
 	}, "redis check", l.DefaultWriter(), nil)
 	return nil
 }
 
-func (opt *cliRedis) read(key string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), opt.readTimeout)
+// close stops using the client and releases its connection pool.
+func (opt *cliRedis) close() error {
+	opt.loaded.Store(false)
+	cli := opt.cli.Load()
+	if cli == nil {
+		return nil
+	}
+	return (*cli).Close()
+}
+
+// client returns the client which is used now
+func (opt *cliRedis) client() redis.UniversalClient {
+	if cli := opt.cli.Load(); cli != nil {
+		return *cli
+	}
+	return nil
+}
+
+func (opt *cliRedis) read(ctx context.Context, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opt.timeoutRead())
 	defer cancel()
-	val := opt.cli.Get(ctx, key)
+	val := opt.client().Get(ctx, key)
 	if val.Err() != nil {
 		return "", val.Err()
 	}
 	return val.Val(), nil
 }
 
-func (opt *cliRedis) keys(key string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), opt.writeTimeout)
+func (opt *cliRedis) keys(ctx context.Context, key string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opt.timeoutWrite())
 	defer cancel()
-	val := opt.cli.Keys(ctx, key)
+	// 集群的key分布在各个主节点上
+	if c, ok := opt.client().(*redis.ClusterClient); ok {
+		ss := make([]string, 0)
+		mu := sync.Mutex{}
+		err := c.ForEachMaster(ctx, func(ctx context.Context, cli *redis.Client) error {
+			val, err := cli.Keys(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			ss = append(ss, val...)
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			return []string{}, err
+		}
+		return ss, nil
+	}
+	val := opt.client().Keys(ctx, key)
 	if val.Err() != nil {
 		return []string{}, val.Err()
 	}
 	return val.Val(), nil
 }
 
-func (opt *cliRedis) write(key string, value any, expire time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), opt.writeTimeout)
+func (opt *cliRedis) del(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, opt.timeoutWrite())
+	defer cancel()
+	return opt.checkRedisDialErr(opt.client().Del(ctx, key).Err())
+}
+
+func (opt *cliRedis) write(ctx context.Context, key string, value any, expire time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, opt.timeoutWrite())
 	defer cancel()
-	return opt.checkRedisDialErr(opt.cli.Set(ctx, key, value, expire).Err())
+	return opt.checkRedisDialErr(opt.client().Set(ctx, key, value, expire).Err())
 }
 
 // checkRedisDialErr checks if the error is a network error and sets loaded to false if so,
 // so that the next call to Redis will try to reconnect.
 func (opt *cliRedis) checkRedisDialErr(err error) error {
 	if err != nil {
-		if strings.Contains(err.Error(), "dail tcp") {
+		if strings.Contains(err.Error(), "dial tcp") {
 			opt.loaded.Store(false)
-			opt.cliver = 0
+			opt.cliver.Store(0)
 		}
 	}
 	return err
@@ -127,6 +327,26 @@ func OptRedisAddr(s string) redisOpts {
 	}
 }
 
+// OptRedisSentinel connects to the master named master, which is found by the sentinels at addrs,
+// the client follows the new master after a failover. OptRedisAddr is ignored.
+func OptRedisSentinel(master string, addrs ...string) redisOpts {
+	return func(o *cliRedis) {
+		o.master = master
+		o.cluster = false
+		o.addrs = slices.Clone(addrs)
+	}
+}
+
+// OptRedisCluster connects to the redis cluster by the seed nodes at addrs, the other nodes are found from them.
+// OptRedisAddr and OptRedisDatabase are ignored, the cluster has only database 0.
+func OptRedisCluster(addrs ...string) redisOpts {
+	return func(o *cliRedis) {
+		o.master = ""
+		o.cluster = true
+		o.addrs = slices.Clone(addrs)
+	}
+}
+
 func OptRedisAuth(user, pwd string) redisOpts {
 	return func(o *cliRedis) {
 		o.user = user
@@ -134,9 +354,59 @@ func OptRedisAuth(user, pwd string) redisOpts {
 	}
 }
 
+// OptRedisTLS connects to redis over tls with t, the server name is the host of the addr when it is not set in t.
+// The sentinels and the cluster nodes use t as well.
+func OptRedisTLS(t *tls.Config) redisOpts {
+	return func(o *cliRedis) {
+		o.tlsc = t
+		o.tlsFiles = [3]string{}
+		o.tlsErr = nil
+	}
+}
+
+// OptRedisTLSFromFile connects to redis over tls with the client certificate in cert and key, loaded by crypto.TLSConfigFromFile.
+// The server certificate is verified by the system roots and the root certificate in ca.
+// When ca is empty the server certificate is not verified, as crypto.TLSConfigFromFile sets InsecureSkipVerify.
+func OptRedisTLSFromFile(cert, key, ca string) redisOpts {
+	return func(o *cliRedis) {
+		o.tlsc, o.tlsErr = redisTLSConfig(cert, key, ca)
+		o.tlsFiles = [3]string{cert, key, ca}
+	}
+}
+
+// OptRedisTLSInsecure does not verify the server certificate when b is true, it is only for tests.
+func OptRedisTLSInsecure(b bool) redisOpts {
+	return func(o *cliRedis) {
+		o.tlsInsecure = b
+	}
+}
+
+func redisTLSConfig(cert, key, ca string) (*tls.Config, error) {
+	t, err := crypto.TLSConfigFromFile(cert, key, ca)
+	if err != nil || ca == "" {
+		return t, err
+	}
+	// crypto.TLSConfigFromFile adds ca to the roots of the client certificates, a client verifies the server by them
+	if t.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, errors.New("no certificate in " + ca)
+	}
+	t.InsecureSkipVerify = false
+	t.RootCAs, t.ClientCAs = t.ClientCAs, nil
+	t.ClientAuth = tls.NoClientCert
+	return t, nil
+}
+
+// OptRedisKeyEvents turns on the keyevent notifications on the server by CONFIG SET for RedisOnExpired,
+// which changes the config of the server for all its clients.
+func OptRedisKeyEvents(b bool) redisOpts {
+	return func(o *cliRedis) {
+		o.keyEvents = b
+	}
+}
+
 func OptRedisDatabase(i int) redisOpts {
 	return func(o *cliRedis) {
-		o.database = max(i, 255)
+		o.database = min(max(i, 0), 255)
 	}
 }
 
@@ -0,0 +1,169 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/loopfunc"
+)
+
+// redisSub is a subscription of patterns, which is subscribed again when the client is reconnected
+type redisSub struct {
+	patterns []string
+	perNode  bool                                             // 集群时订阅每个主节点，用于键空间通知
+	setup    func(ctx context.Context, c redis.Cmdable) error // 订阅前在每个节点上执行
+	handler  func(channel, payload string)
+}
+
+// subscribe receives the messages of sub until ctx is done, the handler is called one message at a time.
+// When the client is replaced by the reconnect loop, or the connection is lost, the patterns are subscribed again.
+func (opt *cliRedis) subscribe(ctx context.Context, sub *redisSub, l logger.Logger) {
+	name := strings.Join(sub.patterns, ",")
+	ch := make(chan *redis.Message, 100)
+	go loopfunc.LoopFunc(func(params ...any) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-ch:
+				sub.handler(m.Channel, m.Payload)
+			}
+		}
+	}, "redis sub "+name, l.DefaultWriter())
+	go loopfunc.LoopFunc(func(params ...any) {
+		for {
+			if opt.loaded.Load() {
+				if err := opt.receive(ctx, sub, ch); err != nil && ctx.Err() == nil {
+					l.Error("[redis] subscribe " + name + " error:" + err.Error())
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}, "redis sub "+name, l.DefaultWriter())
+}
+
+// nodes returns the client, or the clients of the masters when the client is a cluster and perNode is true
+func (opt *cliRedis) nodes(ctx context.Context, perNode bool) ([]redis.UniversalClient, error) {
+	cli := opt.client()
+	c, ok := cli.(*redis.ClusterClient)
+	if !ok || !perNode {
+		return []redis.UniversalClient{cli}, nil
+	}
+	clis := make([]redis.UniversalClient, 0)
+	mu := sync.Mutex{}
+	err := c.ForEachMaster(ctx, func(ctx context.Context, cli *redis.Client) error {
+		mu.Lock()
+		clis = append(clis, cli)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, opt.checkRedisDialErr(err)
+	}
+	return clis, nil
+}
+
+// receive subscribes the patterns and forwards the messages to ch,
+// it returns when ctx is done or any of the subscriptions is closed.
+func (opt *cliRedis) receive(ctx context.Context, sub *redisSub, ch chan<- *redis.Message) error {
+	clis, err := opt.nodes(ctx, sub.perNode)
+	if err != nil {
+		return err
+	}
+	channels, patterns := splitPatterns(sub.patterns)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	for _, cli := range clis {
+		if sub.setup != nil {
+			if err := sub.setup(ctx, cli); err != nil {
+				return err
+			}
+		}
+		ps := cli.Subscribe(ctx, channels...)
+		if len(patterns) > 0 {
+			if err := ps.PSubscribe(ctx, patterns...); err != nil {
+				ps.Close()
+				return opt.checkRedisDialErr(err)
+			}
+		}
+		// 确认订阅成功
+		if _, err := ps.Receive(ctx); err != nil {
+			ps.Close()
+			return opt.checkRedisDialErr(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			defer ps.Close()
+			msgs := ps.Channel()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m, ok := <-msgs:
+					// 客户端已关闭
+					if !ok {
+						return
+					}
+					select {
+					case ch <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// splitPatterns returns the channel names, which are subscribed by SUBSCRIBE,
+// and the patterns with * ? or [], which are subscribed by PSUBSCRIBE.
+func splitPatterns(ss []string) (channels, patterns []string) {
+	for _, v := range ss {
+		if strings.ContainsAny(v, "*?[") {
+			patterns = append(patterns, v)
+		} else {
+			channels = append(channels, v)
+		}
+	}
+	return channels, patterns
+}
+
+// keyEvents checks that the keyevent notifications of flags are on, such as "x" for expired,
+// the missing ones are turned on by CONFIG SET when set is true, or an error is returned.
+func keyEvents(ctx context.Context, c redis.Cmdable, flags string, set bool) error {
+	v, err := c.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	cur := v["notify-keyspace-events"]
+	add := ""
+	if !strings.Contains(cur, "E") {
+		add += "E"
+	}
+	for _, f := range flags {
+		if !strings.ContainsRune(cur, f) && !strings.Contains(cur, "A") {
+			add += string(f)
+		}
+	}
+	if add == "" {
+		return nil
+	}
+	if !set {
+		return errors.New("keyevent notifications are off, notify-keyspace-events is `" + cur + "`, add `" + add + "` on the server or use OptRedisKeyEvents")
+	}
+	return c.ConfigSet(ctx, "notify-keyspace-events", cur+add).Err()
+}
@@ -0,0 +1,167 @@
+package gofactory
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert, c := testCert(t, "redis.example.com")
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}),
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}),
+		"bad.pem":  []byte("no certificate"),
+	}
+	for k, v := range files {
+		if err := os.WriteFile(filepath.Join(dir, k), v, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fOpt := func(ca string) *cliRedis {
+		o := &cliRedis{addr: "redis.example.com:6380"}
+		OptRedisTLSFromFile(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), ca)(o)
+		return o
+	}
+	// 根证书用于验证服务端
+	o := fOpt(filepath.Join(dir, "cert.pem"))
+	if o.tlsErr != nil {
+		t.Fatal(o.tlsErr)
+	}
+	x := o.tlsConfig()
+	if x.InsecureSkipVerify || x.RootCAs == nil || x.ClientCAs != nil || x.ServerName != "" || len(x.Certificates) != 1 {
+		t.Fatalf("config with ca: insecure %v, roots %v, client roots %v, server name %q", x.InsecureSkipVerify, x.RootCAs, x.ClientCAs, x.ServerName)
+	}
+	o.tlsInsecure = true
+	if x = o.tlsConfig(); !x.InsecureSkipVerify || o.tlsc.InsecureSkipVerify {
+		t.Fatal("insecure config is verified, or the config of the option is changed")
+	}
+	// 不设置根证书时不验证服务端
+	if o = fOpt(""); o.tlsErr != nil || !o.tlsConfig().InsecureSkipVerify {
+		t.Fatalf("config without ca: %v", o.tlsErr)
+	}
+	if o = fOpt(filepath.Join(dir, "bad.pem")); o.tlsErr == nil {
+		t.Fatal("ca without certificate is loaded")
+	}
+}
+
+func TestRedisSameTLS(t *testing.T) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, v := range []struct {
+		name string
+		a, b redisOpts
+		same bool
+	}{
+		{name: "same config", a: OptRedisTLS(tc), b: OptRedisTLS(tc), same: true},
+		{name: "equal configs", a: OptRedisTLS(&tls.Config{}), b: OptRedisTLS(&tls.Config{}), same: true},
+		{name: "different configs", a: OptRedisTLS(tc), b: OptRedisTLS(&tls.Config{}), same: false},
+		{name: "tls and plain", a: OptRedisTLS(tc), b: OptRedisTLS(nil), same: false},
+		{name: "same files", a: OptRedisTLSFromFile("a.pem", "a.key", ""), b: OptRedisTLSFromFile("a.pem", "a.key", ""), same: true},
+		{name: "different files", a: OptRedisTLSFromFile("a.pem", "a.key", ""), b: OptRedisTLSFromFile("b.pem", "b.key", ""), same: false},
+	} {
+		a, b := &cliRedis{}, &cliRedis{}
+		v.a(a)
+		v.b(b)
+		if a.sameConn(b) != v.same {
+			t.Fatalf("%s: same %v", v.name, !v.same)
+		}
+	}
+}
+
+// testCert returns a self signed certificate of the host, which is a dns name or an ip
+func testCert(t *testing.T, host string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tpl.IPAddresses = []net.IP{ip}
+	} else {
+		tpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, c
+}
+
+func TestRedisTLSNodes(t *testing.T) {
+	roots := x509.NewCertPool()
+	addrs := make([]string, 0, 2)
+	// 每个节点的证书只包含自己的地址
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		cert, c := testCert(t, host)
+		roots.AddCert(c)
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	o := cliRedis{addrs: addrs, cluster: true, tlsc: &tls.Config{RootCAs: roots}}
+	dial := redis.NewDialer(&redis.Options{TLSConfig: o.tlsConfig(), DialTimeout: time.Second * 3})
+	for _, a := range addrs {
+		conn, err := dial(context.Background(), "tcp", a)
+		if err != nil {
+			t.Fatalf("dial %s: %v", a, err)
+		}
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			t.Fatalf("handshake %s: %v", a, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestSplitPatterns(t *testing.T) {
+	channels, patterns := splitPatterns([]string{"__keyevent@0__:expired", "news.*", "user.?", "a[bc]", "plain"})
+	if strings.Join(channels, ",") != "__keyevent@0__:expired,plain" || strings.Join(patterns, ",") != "news.*,user.?,a[bc]" {
+		t.Fatalf("channels %v, patterns %v", channels, patterns)
+	}
+}
@@ -1,22 +1,35 @@
 package gofactory
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/loopfunc"
 	"github.com/xyzj/toolbox/mq"
 )
 
 type cliRmq struct {
-	clip            *mq.RMQProducer
+	clip            *rmqProducer
+	clic            *rmqConsumer
 	tlsc            *tls.Config
 	recvFunc        func(topic string, body []byte)
+	recvCtxFunc     func(ctx context.Context, topic string, body []byte)
 	addr            string
 	user            string
 	pwd             string
 	vhost           string
 	exchange        string
 	queueName       string
+	queueAuto       bool // 队列名称为启动时生成
 	queueDurable    bool // 队列是否持久化
 	queueAutoDelete bool // 队列在不用时是否删除
 	enableP         bool
@@ -24,40 +37,309 @@ type cliRmq struct {
 	enable          bool
 }
 
-func (opt *cliRmq) build(l logger.Logger) error {
+// build starts the clients, recv is called with every message received by the consumer
+func (opt *cliRmq) build(l logger.Logger, recv func(d *amqp.Delivery)) error {
 	if opt.enableP {
-		opt.clip = mq.NewRMQProducer(&mq.RabbitMQOpt{
-			Addr:         opt.addr,
-			Username:     opt.user,
-			Passwd:       opt.pwd,
-			VHost:        opt.vhost,
-			ExchangeName: opt.exchange,
-			TLSConf:      opt.tlsc,
-			LogHeader:    "[rmq-p]",
-		}, l)
+		opt.clip = newRMQProducer(opt, l)
 	}
 	if opt.enableC {
-		mq.NewRMQConsumer(&mq.RabbitMQOpt{
-			Addr:            opt.addr,
-			Username:        opt.user,
-			Passwd:          opt.pwd,
-			VHost:           opt.vhost,
-			ExchangeName:    opt.exchange,
-			QueueName:       opt.queueName,
-			QueueDurable:    opt.queueDurable,
-			QueueAutoDelete: opt.queueAutoDelete,
-			TLSConf:         opt.tlsc,
-			LogHeader:       "[rmq-c]",
-		}, l, opt.recvFunc)
+		opt.clic = newRMQConsumer(opt, l, recv)
 	}
 	return nil
 }
 
+// the queue arguments of mq.NewRMQConsumer, so that a queue declared by either client is declared again with the same arguments
+const (
+	rmqQueueMaxLen     = 77777
+	rmqQueueMessageTTL = 600000 // 毫秒
+)
+
+type rmqMessage struct {
+	headers amqp.Table
+	body    []byte
+	topic   string
+	expire  time.Duration
+}
+
+// rmqConn keeps the connection of a rmq client, and reconnects every 10 seconds until it is closed
+type rmqConn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  atomic.Bool
+}
+
+// start connects in background and serves the channel until the connection is lost or c is closed,
+// it waits at most 2 seconds for the first connection.
+func (c *rmqConn) start(opt *cliRmq, l logger.Logger, name string, serve func(conn *amqp.Connection, channel *amqp.Channel, closed chan *amqp.Error) error) {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	ctxReady, cancel := context.WithTimeout(c.ctx, time.Second*2)
+	defer cancel()
+	go loopfunc.LoopFunc(func(params ...any) {
+		for {
+			conn, channel, err := opt.connect()
+			if err != nil {
+				l.Error(name + " connect error:" + err.Error())
+			} else {
+				l.System(name + " success connect to " + opt.addr + "; exchange: `" + opt.exchange + "`")
+				c.ready.Store(true)
+				cancel()
+				err = serve(conn, channel, conn.NotifyClose(make(chan *amqp.Error, 1)))
+				c.ready.Store(false)
+				channel.Close()
+				conn.Close()
+				if err == nil {
+					l.System(name + " closed")
+					return
+				}
+				l.Error(name + " " + err.Error())
+			}
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(time.Second * 10):
+			}
+		}
+	}, name, l.DefaultWriter())
+	<-ctxReady.Done()
+}
+
+// Enable returns whether the client is connected
+func (c *rmqConn) Enable() bool {
+	return c.ready.Load()
+}
+
+// Close stops the client
+func (c *rmqConn) Close() {
+	c.cancel()
+}
+
+// connClosed returns the error of a closed connection
+func connClosed(e *amqp.Error) error {
+	if e == nil {
+		return errors.New("connection closed")
+	}
+	return errors.New("connection closed:" + e.Error())
+}
+
+// rmqProducer publishes messages with headers, which mq.RMQProducer does not support
+type rmqProducer struct {
+	rmqConn
+	sendData chan *rmqMessage
+	exchange string
+}
+
+func newRMQProducer(opt *cliRmq, l logger.Logger) *rmqProducer {
+	p := &rmqProducer{
+		sendData: make(chan *rmqMessage, 1000),
+		exchange: opt.exchange,
+	}
+	p.start(opt, l, "[rmq-p]", func(_ *amqp.Connection, channel *amqp.Channel, closed chan *amqp.Error) error {
+		return p.publish(channel, closed, l)
+	})
+	return p
+}
+
+// publish sends the queued messages until the producer is closed or an error occurs,
+// the message which fails to be sent is queued again.
+// The messages are mandatory, a message which is routed to no queue is returned by the server and logged.
+func (p *rmqProducer) publish(channel *amqp.Channel, closed chan *amqp.Error, l logger.Logger) error {
+	returns := channel.NotifyReturn(make(chan amqp.Return, 100))
+	for {
+		select {
+		case <-p.ctx.Done():
+			return nil
+		case e := <-closed:
+			return connClosed(e)
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			l.Error("[rmq-p] S Err:" + r.RoutingKey + " | returned: " + r.ReplyText)
+		case d := <-p.sendData:
+			ex := strconv.Itoa(int(d.expire.Milliseconds()))
+			if ex == "0" {
+				ex = "600000"
+			}
+			err := channel.PublishWithContext(p.ctx,
+				p.exchange, d.topic, true, false,
+				amqp.Publishing{
+					Headers:      d.headers,
+					ContentType:  "text/plain",
+					DeliveryMode: amqp.Persistent,
+					Expiration:   ex,
+					Timestamp:    time.Now(),
+					Body:         d.body,
+				})
+			if err != nil {
+				select {
+				case p.sendData <- d:
+				default:
+					l.Error("[rmq-p] S Err:" + d.topic + " | the send queue is full, message dropped")
+				}
+				return errors.New("send error:" + err.Error())
+			}
+			l.Debug("[rmq-p] S:" + d.topic + " | " + mq.FormatMQBody(d.body))
+		}
+	}
+}
+
+// Send queues a message
+func (p *rmqProducer) Send(topic string, body []byte, expire time.Duration, headers amqp.Table) error {
+	return p.SendCtx(context.Background(), topic, body, expire, headers)
+}
+
+// SendCtx queues a message, an error is returned when the producer is not connected or closed, or ctx is done
+func (p *rmqProducer) SendCtx(ctx context.Context, topic string, body []byte, expire time.Duration, headers amqp.Table) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !p.ready.Load() {
+		return errors.New("[rmq-p] not connected")
+	}
+	select {
+	case p.sendData <- &rmqMessage{topic: topic, body: body, expire: expire, headers: headers}:
+		return nil
+	case <-p.ctx.Done():
+		return errors.New("[rmq-p] closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rmqConsumer receives the messages of the queue with their headers, unlike mq.NewRMQConsumer it stops when closed
+type rmqConsumer struct {
+	rmqConn
+	recv       func(d *amqp.Delivery)
+	durable    bool // 队列是否持久化,与已有队列不同时以已有队列为准
+	autoDelete bool // 队列在不用时是否删除,同上
+}
+
+func newRMQConsumer(opt *cliRmq, l logger.Logger, recv func(d *amqp.Delivery)) *rmqConsumer {
+	c := &rmqConsumer{
+		recv:       recv,
+		durable:    opt.queueDurable,
+		autoDelete: opt.queueAutoDelete,
+	}
+	c.start(opt, l, "[rmq-c]", func(conn *amqp.Connection, channel *amqp.Channel, closed chan *amqp.Error) error {
+		return c.consume(opt, conn, channel, closed, l)
+	})
+	return c
+}
+
+// declare declares the queue, when the queue exists with another durable or auto delete flag,
+// the flag is switched and the queue is declared again on a new channel, as mq.NewRMQConsumer does.
+func (c *rmqConsumer) declare(opt *cliRmq, conn *amqp.Connection, channel *amqp.Channel, l logger.Logger) (*amqp.Channel, error) {
+	for range 3 {
+		_, err := channel.QueueDeclare(opt.queueName, c.durable, c.autoDelete, false, false,
+			amqp.Table{
+				amqp.QueueMaxLenArg:     rmqQueueMaxLen,
+				amqp.QueueMessageTTLArg: rmqQueueMessageTTL,
+			})
+		if err == nil {
+			return channel, nil
+		}
+		switch {
+		case strings.Contains(err.Error(), "durable"):
+			c.durable = !c.durable
+		case strings.Contains(err.Error(), "auto_delete"):
+			c.autoDelete = !c.autoDelete
+		default:
+			return nil, err
+		}
+		l.Warning("[rmq-c] " + err.Error() + ", declare again")
+		// the failed declare closes the channel
+		if channel, err = conn.Channel(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("queue flags mismatch")
+}
+
+// consume declares the queue and receives its messages until the consumer is closed or an error occurs
+func (c *rmqConsumer) consume(opt *cliRmq, conn *amqp.Connection, channel *amqp.Channel, closed chan *amqp.Error, l logger.Logger) error {
+	channel, err := c.declare(opt, conn, channel, l)
+	if err != nil {
+		return errors.New("declare queue error:" + err.Error())
+	}
+	recv, err := channel.ConsumeWithContext(c.ctx, opt.queueName, "", true, false, false, false, nil)
+	if err != nil {
+		return errors.New("consume error:" + err.Error())
+	}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case e := <-closed:
+			return connClosed(e)
+		case d, ok := <-recv:
+			if !ok {
+				if c.ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("consume closed")
+			}
+			l.Debug("[rmq-c] R:" + d.RoutingKey + " | " + mq.FormatMQBody(d.Body))
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						l.Error(fmt.Sprintf("[rmq-c] R Err:%s | %+v", d.RoutingKey, err))
+					}
+				}()
+				c.recv(&d)
+			}()
+		}
+	}
+}
+
+// connect dials the server and declares the exchange
+func (opt *cliRmq) connect() (*amqp.Connection, *amqp.Channel, error) {
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(opt.user, opt.pwd),
+		Host:   opt.addr,
+		Path:   "/" + strings.TrimPrefix(opt.vhost, "/"),
+	}
+	var conn *amqp.Connection
+	var err error
+	if opt.tlsc != nil {
+		u.Scheme = "amqps"
+		conn, err = amqp.DialTLS(u.String(), opt.tlsc)
+		if err != nil && strings.Contains(err.Error(), "not look like a TLS handshake") {
+			u.Scheme = "amqp"
+			conn, err = amqp.Dial(u.String())
+		}
+	} else {
+		conn, err = amqp.Dial(u.String())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if opt.exchange != "" {
+		if err = channel.ExchangeDeclarePassive(opt.exchange, "topic", false, false, false, false, nil); err != nil {
+			// the exchange does not exist, the passive declare closes the channel
+			if channel, err = conn.Channel(); err == nil {
+				err = channel.ExchangeDeclare(opt.exchange, "topic", false, false, false, false, nil)
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, channel, nil
+}
+
 type rmqOpts func(o *cliRmq)
 
 func OptRmqAuth(addr, host, user, pwd string, t *tls.Config) rmqOpts {
 	return func(o *cliRmq) {
-		if _, ok := checkTCPAddr(host); !ok {
+		if _, ok := checkTCPAddr(addr); !ok {
 			return
 		}
 		if t == nil {
@@ -86,7 +368,17 @@ func OptRmqConsumer(exchange, queueName string, queueDurable, queueAutoDelete bo
 		o.exchange = exchange
 		o.recvFunc = recvFunc
 		o.queueName = queueName
+		o.queueAuto = false
 		o.queueDurable = queueDurable
 		o.queueAutoDelete = queueAutoDelete
 	}
 }
+
+// OptRmqConsumerCtx is OptRmqConsumer with a receive func which takes a context,
+// the context carries the consumer span of the message, which continues the trace of the traceparent header.
+func OptRmqConsumerCtx(exchange, queueName string, queueDurable, queueAutoDelete bool, recvFunc func(ctx context.Context, topic string, body []byte)) rmqOpts {
+	return func(o *cliRmq) {
+		OptRmqConsumer(exchange, queueName, queueDurable, queueAutoDelete, nil)(o)
+		o.recvCtxFunc = recvFunc
+	}
+}
@@ -0,0 +1,786 @@
+package gofactory
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/xyzj/toolbox/db"
+	"github.com/xyzj/toolbox/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables which override the config file values,
+// e.g. GOFACTORY_REDIS_ADDR overrides redis.addr
+const envPrefix = "GOFACTORY"
+
+// fileConfig is the schema of the service config file.
+//
+// Every section is optional, a section in the file enables its component.
+// Durations are written like "5s", "1m30s".
+type fileConfig struct {
+	Mode            string              `yaml:"mode" toml:"mode" env:"MODE"`                                     // dev, debug or release
+	LogLevel        string              `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL"`                      // debug, info, warning or error
+	ShutdownTimeout string              `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"` // 关闭超时
+	Strict          *bool               `yaml:"strict" toml:"strict" env:"STRICT"`                               // 严格模式，不设置时release模式下启用
+	Optional        []string            `yaml:"optional" toml:"optional" env:"OPTIONAL"`                         // 可选组件，如 redis,db
+	Bolt            string              `yaml:"bolt" toml:"bolt" env:"BOLT"`                                     // boltdb文件名
+	Metrics         string              `yaml:"metrics" toml:"metrics" env:"METRICS"`                            // 独立的metrics监听地址，未启用web服务时使用
+	TCP             *fileTCPConfig      `yaml:"tcp" toml:"tcp" env:"TCP"`
+	MqttBroker      *fileBrokerConfig   `yaml:"mqtt_broker" toml:"mqtt_broker" env:"MQTT_BROKER"`
+	Web             *fileWebConfig      `yaml:"web" toml:"web" env:"WEB"`
+	Redis           *fileRedisConfig    `yaml:"redis" toml:"redis" env:"REDIS"`
+	Discover        *fileDiscoverConfig `yaml:"discover" toml:"discover" env:"DISCOVER"`
+	Mqtt            *fileMqttConfig     `yaml:"mqtt" toml:"mqtt" env:"MQTT"`
+	Rmq             *fileRmqConfig      `yaml:"rmq" toml:"rmq" env:"RMQ"`
+	DB              *fileDBConfig       `yaml:"db" toml:"db" env:"DB"`
+	Trace           *fileTraceConfig    `yaml:"trace" toml:"trace" env:"TRACE"`
+}
+
+type fileTCPConfig struct {
+	Bind        string `yaml:"bind" toml:"bind" env:"BIND"`                         // 监听地址，如 :6881
+	ReadTimeout string `yaml:"read_timeout" toml:"read_timeout" env:"READ_TIMEOUT"` // 读超时
+}
+
+type fileBrokerConfig struct {
+	Mqtt             string `yaml:"mqtt" toml:"mqtt" env:"MQTT"`                                           // mqtt监听地址
+	MqttTLS          string `yaml:"mqtt_tls" toml:"mqtt_tls" env:"MQTT_TLS"`                               // mqtt+tls监听地址，需要设置证书
+	MqttWeb          string `yaml:"mqtt_web" toml:"mqtt_web" env:"MQTT_WEB"`                               // 状态页面监听地址
+	MqttWS           string `yaml:"mqtt_ws" toml:"mqtt_ws" env:"MQTT_WS"`                                  // websocket监听地址
+	Cert             string `yaml:"cert" toml:"cert" env:"CERT"`                                           // tls证书文件
+	Key              string `yaml:"key" toml:"key" env:"KEY"`                                              // tls私钥文件
+	CA               string `yaml:"ca" toml:"ca" env:"CA"`                                                 // tls根证书文件
+	AuthFile         string `yaml:"auth_file" toml:"auth_file" env:"AUTH_FILE"`                            // 用户认证文件
+	MaxMsgExpiry     string `yaml:"max_msg_expiry" toml:"max_msg_expiry" env:"MAX_MSG_EXPIRY"`             // 消息最大有效期
+	MaxSessionExpiry string `yaml:"max_session_expiry" toml:"max_session_expiry" env:"MAX_SESSION_EXPIRY"` // 会话最大有效期
+	ClientBufferSize int    `yaml:"client_buffer_size" toml:"client_buffer_size" env:"CLIENT_BUFFER_SIZE"` // 客户端读写缓存大小
+}
+
+type fileWebConfig struct {
+	Bind         string   `yaml:"bind" toml:"bind" env:"BIND"`                            // 监听地址，如 :6880
+	Cert         string   `yaml:"cert" toml:"cert" env:"CERT"`                            // tls证书文件，设置后启用https
+	Key          string   `yaml:"key" toml:"key" env:"KEY"`                               // tls私钥文件
+	Hosts        []string `yaml:"hosts" toml:"hosts" env:"HOSTS"`                         // 允许的域名
+	ReadTimeout  string   `yaml:"read_timeout" toml:"read_timeout" env:"READ_TIMEOUT"`    // 读超时
+	WriteTimeout string   `yaml:"write_timeout" toml:"write_timeout" env:"WRITE_TIMEOUT"` // 写超时
+	IdleTimeout  string   `yaml:"idle_timeout" toml:"idle_timeout" env:"IDLE_TIMEOUT"`    // 空闲超时
+}
+
+type fileRedisConfig struct {
+	Addr         string   `yaml:"addr" toml:"addr" env:"ADDR"`                            // 服务地址，如 127.0.0.1:6379
+	Master       string   `yaml:"master" toml:"master" env:"MASTER"`                      // 哨兵模式的主节点名称
+	Cluster      bool     `yaml:"cluster" toml:"cluster" env:"CLUSTER"`                   // 集群模式
+	Nodes        []string `yaml:"nodes" toml:"nodes" env:"NODES"`                         // 哨兵或集群节点地址
+	User         string   `yaml:"user" toml:"user" env:"USER"`                            // 用户名
+	Password     string   `yaml:"password" toml:"password" env:"PASSWORD"`                // 密码
+	Database     int      `yaml:"database" toml:"database" env:"DATABASE"`                // 数据库序号
+	ReadTimeout  string   `yaml:"read_timeout" toml:"read_timeout" env:"READ_TIMEOUT"`    // 读超时
+	WriteTimeout string   `yaml:"write_timeout" toml:"write_timeout" env:"WRITE_TIMEOUT"` // 写超时
+	TLS          bool     `yaml:"tls" toml:"tls" env:"TLS"`                               // 使用tls连接，以系统根证书验证服务端，设置证书文件时自动启用
+	Cert         string   `yaml:"cert" toml:"cert" env:"CERT"`                            // tls客户端证书文件
+	Key          string   `yaml:"key" toml:"key" env:"KEY"`                               // tls客户端私钥文件
+	CA           string   `yaml:"ca" toml:"ca" env:"CA"`                                  // tls根证书文件，用于验证服务端，需要同时设置证书，设置证书但不设置根证书时不验证服务端
+	Insecure     bool     `yaml:"insecure" toml:"insecure" env:"INSECURE"`                // 不验证服务端证书，仅用于测试
+	KeyEvents    bool     `yaml:"key_events" toml:"key_events" env:"KEY_EVENTS"`          // 订阅过期通知时开启服务端的键事件通知
+}
+
+type fileDiscoverConfig struct {
+	Name            string            `yaml:"name" toml:"name" env:"NAME"`                                     // 注册服务名称
+	Alias           string            `yaml:"alias" toml:"alias" env:"ALIAS"`                                  // 注册别名
+	Source          string            `yaml:"source" toml:"source" env:"SOURCE"`                               // 服务本地原始地址
+	RootPath        string            `yaml:"root_path" toml:"root_path" env:"ROOT_PATH"`                      // 业务标识
+	Address         map[string]string `yaml:"address" toml:"address"`                                          // 注册地址，key为 tcp, http, https, mqtt, mqtttls, mqttws
+	By              string            `yaml:"by" toml:"by" env:"BY"`                                           // udp, redis, static 或 bolt
+	UDPPort         int               `yaml:"udp_port" toml:"udp_port" env:"UDP_PORT"`                         // udp端口
+	Multicast       string            `yaml:"multicast" toml:"multicast" env:"MULTICAST"`                      // by为udp时的组播地址,为空时广播
+	Interface       string            `yaml:"interface" toml:"interface" env:"INTERFACE"`                      // by为udp时使用的网卡
+	TTL             int               `yaml:"ttl" toml:"ttl" env:"TTL"`                                        // by为udp时的组播ttl
+	Seeds           []string          `yaml:"seeds" toml:"seeds" env:"SEEDS"`                                  // by为udp时单播的节点
+	KeyFile         string            `yaml:"key_file" toml:"key_file" env:"KEY_FILE"`                         // by为udp时的sm2私钥文件,为空时使用内置密钥
+	TrustedKeyFiles []string          `yaml:"trusted_key_files" toml:"trusted_key_files"`                      // by为udp时信任的sm2公钥文件
+	Redis           *fileRedisConfig  `yaml:"redis" toml:"redis" env:"REDIS"`                                  // by为redis时使用的redis配置
+	StaticFile      string            `yaml:"static_file" toml:"static_file" env:"STATIC_FILE"`                // by为static时的实例列表文件
+	SRV             []fileSRVConfig   `yaml:"srv" toml:"srv"`                                                  // by为static时查询的dns srv记录
+	BoltFile        string            `yaml:"bolt_file" toml:"bolt_file" env:"BOLT_FILE"`                      // by为bolt时的数据文件
+	InfoTimeout     string            `yaml:"info_timeout" toml:"info_timeout" env:"INFO_TIMEOUT"`             // 服务消息超时
+	PublishInterval string            `yaml:"publish_interval" toml:"publish_interval" env:"PUBLISH_INTERVAL"` // 服务消息更新间隔
+	Weight          int               `yaml:"weight" toml:"weight" env:"WEIGHT"`                               // 负载权重
+	Pick            string            `yaml:"pick" toml:"pick" env:"PICK"`                                     // 选择策略: round_robin, random, least_recent, hash, weighted
+	Version         string            `yaml:"version" toml:"version" env:"VERSION"`                            // 版本号
+	Zone            string            `yaml:"zone" toml:"zone" env:"ZONE"`                                     // 所在区域或机房
+	Tags            []string          `yaml:"tags" toml:"tags" env:"TAGS"`                                     // 标签
+	Metadata        map[string]string `yaml:"metadata" toml:"metadata"`                                        // 自定义信息
+	InstanceID      string            `yaml:"instance_id" toml:"instance_id" env:"INSTANCE_ID"`                // 实例标识
+	AdvertiseIP     string            `yaml:"advertise_ip" toml:"advertise_ip" env:"ADVERTISE_IP"`             // 注册地址使用的ip
+}
+
+type fileSRVConfig struct {
+	Name     string `yaml:"name" toml:"name"`         // 服务名称
+	Record   string `yaml:"record" toml:"record"`     // srv记录, 如 _demo._tcp.example.com
+	Protocol string `yaml:"protocol" toml:"protocol"` // 实例地址的协议, 如 http
+}
+
+type fileMqttConfig struct {
+	Addr        string          `yaml:"addr" toml:"addr" env:"ADDR"`                         // 服务地址，如 tls://127.0.0.1:1881
+	User        string          `yaml:"user" toml:"user" env:"USER"`                         // 用户名
+	Password    string          `yaml:"password" toml:"password" env:"PASSWORD"`             // 密码
+	ClientID    string          `yaml:"client_id" toml:"client_id" env:"CLIENT_ID"`          // 客户端标示
+	SendTimeout string          `yaml:"send_timeout" toml:"send_timeout" env:"SEND_TIMEOUT"` // 发送超时
+	Subscribe   map[string]byte `yaml:"subscribe" toml:"subscribe"`                          // 订阅消息，topic: qos
+}
+
+type fileRmqConfig struct {
+	Addr       string `yaml:"addr" toml:"addr" env:"ADDR"`                      // 服务地址，如 127.0.0.1:5672
+	VHost      string `yaml:"vhost" toml:"vhost" env:"VHOST"`                   // 虚拟主机
+	User       string `yaml:"user" toml:"user" env:"USER"`                      // 用户名
+	Password   string `yaml:"password" toml:"password" env:"PASSWORD"`          // 密码
+	Exchange   string `yaml:"exchange" toml:"exchange" env:"EXCHANGE"`          // 交换机名称
+	Producer   bool   `yaml:"producer" toml:"producer" env:"PRODUCER"`          // 启用生产者
+	Consumer   bool   `yaml:"consumer" toml:"consumer" env:"CONSUMER"`          // 启用消费者
+	Queue      string `yaml:"queue" toml:"queue" env:"QUEUE"`                   // 消费者队列名称
+	Durable    bool   `yaml:"durable" toml:"durable" env:"DURABLE"`             // 队列是否持久化
+	AutoDelete bool   `yaml:"auto_delete" toml:"auto_delete" env:"AUTO_DELETE"` // 队列在不用时是否删除
+}
+
+type fileDBConfig struct {
+	Driver    string   `yaml:"driver" toml:"driver" env:"DRIVER"`          // mysql, sqlserver 或 postgre，默认 mysql
+	Host      string   `yaml:"host" toml:"host" env:"HOST"`                // 服务地址
+	User      string   `yaml:"user" toml:"user" env:"USER"`                // 用户名
+	Password  string   `yaml:"password" toml:"password" env:"PASSWORD"`    // 密码
+	Databases []string `yaml:"databases" toml:"databases" env:"DATABASES"` // 数据库名称
+}
+
+type fileTraceConfig struct {
+	Endpoint string            `yaml:"endpoint" toml:"endpoint" env:"ENDPOINT"` // otlp/http地址，如 http://127.0.0.1:4318
+	Service  string            `yaml:"service" toml:"service" env:"SERVICE"`    // 上报的服务名称
+	Ratio    *float64          `yaml:"ratio" toml:"ratio" env:"RATIO"`          // 采样比例，默认为1
+	Headers  map[string]string `yaml:"headers" toml:"headers"`                  // 上报时附加的http头
+}
+
+var protocolNames = map[string]ProtocolType{
+	"tcp":     ProtocolTCP,
+	"http":    ProtocolHTTP,
+	"https":   ProtocolHTTPS,
+	"mqtt":    ProtocolMQTT,
+	"mqtttls": ProtocolMQTTTLS,
+	"mqttws":  ProtocolMQTTWS,
+}
+
+// FromConfigFile loads the service config from a yaml, toml or json file, the format is decided by the file extension.
+// The file is read again on every reload, see WithConfigReload.
+//
+// Environment variables named like GOFACTORY_<SECTION>_<KEY> override the file values,
+// and explicit options passed to New override both, no matter where FromConfigFile is placed.
+//
+// A minimal yaml example:
+//
+//	mode: release
+//	web:
+//	  bind: ":6880"
+//	redis:
+//	  addr: 127.0.0.1:6379
+//	  password: secret
+//	discover:
+//	  name: demo
+//	  by: redis
+//	  address:
+//	    http: http://10.0.0.1:6880
+func FromConfigFile(path string) Opts {
+	return func(o *Opt) {
+		o.filePath = path
+		b, err := os.ReadFile(path)
+		if err != nil {
+			o.fileErr = errors.New("[config] read file error:" + err.Error())
+			return
+		}
+		FromConfigBytes(b, strings.TrimPrefix(filepath.Ext(path), "."))(o)
+	}
+}
+
+// FromConfigBytes loads the service config from content in the given format: yaml, toml or json.
+func FromConfigBytes(b []byte, format string) Opts {
+	f, err := parseConfig(b, format)
+	return func(o *Opt) {
+		if err != nil {
+			o.fileErr = err
+			return
+		}
+		o.file = f
+	}
+}
+
+func parseConfig(b []byte, format string) (*fileConfig, error) {
+	f := &fileConfig{}
+	var err error
+	switch strings.ToLower(format) {
+	case "yaml", "yml", "json": // json is a subset of yaml
+		if len(bytes.TrimSpace(b)) > 0 {
+			err = yaml.Unmarshal(b, f)
+		}
+	case "toml":
+		err = toml.Unmarshal(b, f)
+	default:
+		return nil, errors.New("[config] unsupported format:" + format)
+	}
+	if err != nil {
+		return nil, errors.New("[config] parse error:" + err.Error())
+	}
+	if err = envOverride(reflect.ValueOf(f).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+	if err = f.check(); err != nil {
+		return nil, errors.New("[config] " + err.Error())
+	}
+	return f, nil
+}
+
+// check returns the error of the first value which can not be used, so that a typo fails the load instead of being ignored
+func (f *fileConfig) check() error {
+	switch strings.ToLower(f.Mode) {
+	case "", "dev", "debug", "release":
+	default:
+		return errors.New("unknown mode:" + f.Mode)
+	}
+	switch strings.ToLower(f.LogLevel) {
+	case "", "debug", "info", "warning", "warn", "error":
+	default:
+		return errors.New("unknown log_level:" + f.LogLevel)
+	}
+	durations := [][2]string{{"shutdown_timeout", f.ShutdownTimeout}}
+	if f.TCP != nil {
+		durations = append(durations, [2]string{"tcp.read_timeout", f.TCP.ReadTimeout})
+	}
+	if c := f.MqttBroker; c != nil {
+		durations = append(durations, [2]string{"mqtt_broker.max_msg_expiry", c.MaxMsgExpiry})
+		durations = append(durations, [2]string{"mqtt_broker.max_session_expiry", c.MaxSessionExpiry})
+	}
+	if c := f.Web; c != nil {
+		durations = append(durations, [2]string{"web.read_timeout", c.ReadTimeout})
+		durations = append(durations, [2]string{"web.write_timeout", c.WriteTimeout})
+		durations = append(durations, [2]string{"web.idle_timeout", c.IdleTimeout})
+	}
+	if c := f.Redis; c != nil {
+		durations = append(durations, [2]string{"redis.read_timeout", c.ReadTimeout})
+		durations = append(durations, [2]string{"redis.write_timeout", c.WriteTimeout})
+	}
+	if c := f.Mqtt; c != nil {
+		durations = append(durations, [2]string{"mqtt.send_timeout", c.SendTimeout})
+	}
+	if c := f.Discover; c != nil {
+		durations = append(durations, [2]string{"discover.info_timeout", c.InfoTimeout})
+		durations = append(durations, [2]string{"discover.publish_interval", c.PublishInterval})
+		if c.Redis != nil {
+			durations = append(durations, [2]string{"discover.redis.read_timeout", c.Redis.ReadTimeout})
+			durations = append(durations, [2]string{"discover.redis.write_timeout", c.Redis.WriteTimeout})
+		}
+		switch strings.ToLower(c.By) {
+		case "", "redis", "udp", "static", "bolt":
+		default:
+			return errors.New("unknown discover.by:" + c.By)
+		}
+		if _, ok := pickStrategyNames[strings.ToLower(c.Pick)]; !ok && c.Pick != "" {
+			return errors.New("unknown discover.pick:" + c.Pick)
+		}
+		for k := range c.Address {
+			if _, ok := protocolNames[strings.ToLower(k)]; !ok {
+				return errors.New("unknown discover.address protocol:" + k)
+			}
+		}
+		for _, v := range c.SRV {
+			if _, ok := protocolNames[strings.ToLower(v.Protocol)]; !ok {
+				return errors.New("unknown discover.srv protocol:" + v.Protocol)
+			}
+		}
+	}
+	if c := f.DB; c != nil {
+		switch db.Drive(strings.ToLower(c.Driver)) {
+		case "", db.DriveMySQL, db.DriveSQLServer, db.DrivePostgre:
+		default:
+			return errors.New("unknown db.driver:" + c.Driver)
+		}
+	}
+	for _, v := range durations {
+		if v[1] == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(v[1]); err != nil {
+			return errors.New(v[0] + " error:" + err.Error())
+		}
+	}
+	return nil
+}
+
+// envOverride sets the struct fields tagged with env from environment variables.
+// A nil section is created when any of its variables is set.
+func envOverride(v reflect.Value, prefix string) error {
+	_, err := envOverrideStruct(v, prefix)
+	return err
+}
+
+// envOverrideStruct returns whether any field of v has been set.
+func envOverrideStruct(v reflect.Value, prefix string) (bool, error) {
+	set := false
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+		name := prefix + "_" + tag
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.Struct {
+			nv := fv
+			if fv.IsNil() {
+				nv = reflect.New(fv.Type().Elem())
+			}
+			ok, err := envOverrideStruct(nv.Elem(), name)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				fv.Set(nv)
+				set = true
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(fv, s); err != nil {
+			return false, errors.New("[config] env " + name + " error:" + err.Error())
+		}
+		set = true
+	}
+	return set, nil
+}
+
+func setEnvValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Pointer: // *bool, *float64
+		x := reflect.New(v.Type().Elem())
+		if err := setEnvValue(x.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(x)
+	case reflect.Slice: // comma separated []string
+		ss := make([]string, 0)
+		for _, x := range strings.Split(s, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				ss = append(ss, x)
+			}
+		}
+		v.Set(reflect.ValueOf(ss))
+	default:
+		return errors.New("unsupported type " + v.Kind().String())
+	}
+	return nil
+}
+
+// parseDuration returns 0 when s is empty, so the default value is kept, s is checked when the file is loaded.
+func parseDuration(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// opts returns the top level options enabling every section in the file,
+// the section values are applied by the matching With* option.
+func (f *fileConfig) opts() []Opts {
+	if f == nil {
+		return nil
+	}
+	opts := make([]Opts, 0)
+	switch strings.ToLower(f.Mode) {
+	case "dev":
+		opts = append(opts, SetMode(Dev))
+	case "debug":
+		opts = append(opts, SetMode(Debug))
+	case "release":
+		opts = append(opts, SetMode(Release))
+	}
+	switch strings.ToLower(f.LogLevel) {
+	case "debug":
+		opts = append(opts, WithLogLevel(logger.LogDebug))
+	case "info":
+		opts = append(opts, WithLogLevel(logger.LogInfo))
+	case "warning", "warn":
+		opts = append(opts, WithLogLevel(logger.LogWarning))
+	case "error":
+		opts = append(opts, WithLogLevel(logger.LogError))
+	}
+	if d := parseDuration(f.ShutdownTimeout); d > 0 {
+		opts = append(opts, WithShutdownTimeout(d))
+	}
+	if f.Strict != nil {
+		opts = append(opts, WithStrict(*f.Strict))
+	}
+	if len(f.Optional) > 0 {
+		c := make([]Component, 0, len(f.Optional))
+		for _, v := range f.Optional {
+			c = append(c, Component(v))
+		}
+		opts = append(opts, WithOptional(c...))
+	}
+	if f.Bolt != "" {
+		opts = append(opts, WithBoltDB(f.Bolt))
+	}
+	if f.Metrics != "" {
+		opts = append(opts, WithMetrics(f.Metrics))
+	}
+	if f.TCP != nil {
+		opts = append(opts, WithTCPServer())
+	}
+	if f.MqttBroker != nil {
+		opts = append(opts, WithMQTTBroker())
+	}
+	if f.Web != nil {
+		opts = append(opts, WithWebServer())
+	}
+	if f.Redis != nil {
+		opts = append(opts, WithRedisClient())
+	}
+	if f.Discover != nil {
+		opts = append(opts, WithDiscover())
+	}
+	if f.Mqtt != nil {
+		opts = append(opts, WithMqttClient())
+	}
+	if f.Rmq != nil {
+		if f.Rmq.Consumer && !f.Rmq.Producer {
+			opts = append(opts, WithRMQConsumer())
+		} else {
+			opts = append(opts, WithRmqProducer())
+		}
+	}
+	if f.DB != nil {
+		opts = append(opts, WithDBClient())
+	}
+	if f.Trace != nil && f.Trace.Endpoint != "" {
+		ratio := 1.0
+		if f.Trace.Ratio != nil {
+			ratio = *f.Trace.Ratio
+		}
+		name := f.Trace.Service
+		if name == "" && f.Discover != nil {
+			name = f.Discover.Name
+		}
+		c := &otlpConfig{endpoint: f.Trace.Endpoint, serviceName: name, headers: f.Trace.Headers}
+		opts = append(opts, func(o *Opt) {
+			WithTracing(nil, ratio)(o)
+			o.traceOTLP = c
+		})
+	}
+	return opts
+}
+
+func (f *fileConfig) tcpOpts() []tcpOpts {
+	if f == nil || f.TCP == nil {
+		return nil
+	}
+	opts := make([]tcpOpts, 0)
+	if f.TCP.Bind != "" {
+		opts = append(opts, OptTCPBindAddr(f.TCP.Bind))
+	}
+	if d := parseDuration(f.TCP.ReadTimeout); d > 0 {
+		opts = append(opts, OptTCPReadTimeout(d))
+	}
+	return opts
+}
+
+func (f *fileConfig) brokerOpts() []mqttBrokerOpts {
+	if f == nil || f.MqttBroker == nil {
+		return nil
+	}
+	c := f.MqttBroker
+	opts := make([]mqttBrokerOpts, 0)
+	if c.Mqtt != "" {
+		opts = append(opts, OptMqttAddr(c.Mqtt))
+	}
+	if c.MqttTLS != "" {
+		opts = append(opts, OptMqttTlsFromFile(c.MqttTLS, c.Cert, c.Key, c.CA))
+	}
+	if c.MqttWeb != "" {
+		opts = append(opts, OptMqttWebAddr(c.MqttWeb))
+	}
+	if c.MqttWS != "" {
+		opts = append(opts, OptMqttWSAddr(c.MqttWS))
+	}
+	if c.AuthFile != "" {
+		opts = append(opts, OptMqttAuthFromfile(c.AuthFile))
+	}
+	if d := parseDuration(c.MaxMsgExpiry); d > 0 {
+		opts = append(opts, OptMqttMaxMsgExpirySeconds(d))
+	}
+	if d := parseDuration(c.MaxSessionExpiry); d > 0 {
+		opts = append(opts, OptMqttMaxSessionExpirySeconds(d))
+	}
+	if c.ClientBufferSize > 0 {
+		opts = append(opts, OptMqttClientBufferSize(c.ClientBufferSize))
+	}
+	return opts
+}
+
+func (f *fileConfig) webOpts() []webOpts {
+	if f == nil || f.Web == nil {
+		return nil
+	}
+	c := f.Web
+	opts := make([]webOpts, 0)
+	if c.Bind != "" {
+		opts = append(opts, OptWebBind(c.Bind, c.Cert, c.Key))
+	}
+	if len(c.Hosts) > 0 {
+		opts = append(opts, OptWebHosts(c.Hosts...))
+	}
+	if c.ReadTimeout != "" || c.WriteTimeout != "" || c.IdleTimeout != "" {
+		read, write, idle := parseDuration(c.ReadTimeout), parseDuration(c.WriteTimeout), parseDuration(c.IdleTimeout)
+		opts = append(opts, func(o *webSvr) {
+			if read > 0 {
+				o.readTimeout = read
+			}
+			if write > 0 {
+				o.writeTimeout = write
+			}
+			if idle > 0 {
+				o.idleTimeout = idle
+			}
+		})
+	}
+	return opts
+}
+
+func (c *fileRedisConfig) opts() []redisOpts {
+	if c == nil {
+		return nil
+	}
+	opts := make([]redisOpts, 0)
+	if c.Addr != "" {
+		opts = append(opts, OptRedisAddr(c.Addr))
+	}
+	switch {
+	case c.Master != "":
+		opts = append(opts, OptRedisSentinel(c.Master, c.Nodes...))
+	case c.Cluster:
+		opts = append(opts, OptRedisCluster(c.Nodes...))
+	}
+	if c.User != "" || c.Password != "" {
+		opts = append(opts, OptRedisAuth(c.User, c.Password))
+	}
+	if c.Database > 0 {
+		opts = append(opts, OptRedisDatabase(c.Database))
+	}
+	if d := parseDuration(c.ReadTimeout); d > 0 {
+		opts = append(opts, OptRedisReadTimeout(d))
+	}
+	if d := parseDuration(c.WriteTimeout); d > 0 {
+		opts = append(opts, OptRedisWriteTimeout(d))
+	}
+	switch {
+	case c.Cert != "" || c.Key != "" || c.CA != "":
+		opts = append(opts, OptRedisTLSFromFile(c.Cert, c.Key, c.CA))
+	case c.TLS:
+		opts = append(opts, OptRedisTLS(&tls.Config{}))
+	}
+	if c.Insecure {
+		opts = append(opts, OptRedisTLSInsecure(true))
+	}
+	if c.KeyEvents {
+		opts = append(opts, OptRedisKeyEvents(true))
+	}
+	return opts
+}
+
+func (f *fileConfig) redisOpts() []redisOpts {
+	if f == nil {
+		return nil
+	}
+	return f.Redis.opts()
+}
+
+func (f *fileConfig) discoverOpts() []discoverOpts {
+	if f == nil || f.Discover == nil {
+		return nil
+	}
+	c := f.Discover
+	opts := make([]discoverOpts, 0)
+	if c.Name != "" || len(c.Address) > 0 {
+		addr := make(map[ProtocolType]string)
+		for k, v := range c.Address {
+			if p, ok := protocolNames[strings.ToLower(k)]; ok {
+				addr[p] = v
+			}
+		}
+		opts = append(opts, OptDiscoverInfo(c.Name, c.Alias, c.Source, c.RootPath, addr))
+	}
+	if c.Weight > 0 {
+		opts = append(opts, OptDiscoverWeight(c.Weight))
+	}
+	if c.Version != "" {
+		opts = append(opts, OptDiscoverVersion(c.Version))
+	}
+	if c.Zone != "" {
+		opts = append(opts, OptDiscoverZone(c.Zone))
+	}
+	if len(c.Tags) > 0 {
+		opts = append(opts, OptDiscoverTags(c.Tags...))
+	}
+	if len(c.Metadata) > 0 {
+		opts = append(opts, OptDiscoverMetadata(c.Metadata))
+	}
+	if c.InstanceID != "" {
+		opts = append(opts, OptDiscoverInstanceID(c.InstanceID))
+	}
+	if c.AdvertiseIP != "" {
+		opts = append(opts, OptDiscoverAdvertiseIP(c.AdvertiseIP))
+	}
+	if st, ok := pickStrategyNames[strings.ToLower(c.Pick)]; ok {
+		opts = append(opts, OptDiscoverPickStrategy(st))
+	}
+	switch strings.ToLower(c.By) {
+	case "redis":
+		opts = append(opts, OptDiscoverByRedis(c.Redis.opts()...))
+	case "udp":
+		opts = append(opts, OptDiscoverByUDP(c.UDPPort))
+		if c.Multicast != "" {
+			opts = append(opts, OptDiscoverMulticast(c.Multicast))
+		}
+		if c.Interface != "" {
+			opts = append(opts, OptDiscoverInterface(c.Interface))
+		}
+		if c.TTL > 0 {
+			opts = append(opts, OptDiscoverTTL(c.TTL))
+		}
+		if len(c.Seeds) > 0 {
+			opts = append(opts, OptDiscoverSeeds(c.Seeds...))
+		}
+		if c.KeyFile != "" {
+			opts = append(opts, OptDiscoverKeysFromFile(c.KeyFile, c.TrustedKeyFiles...))
+		}
+	case "static":
+		rr := make([]SRVRecord, 0, len(c.SRV))
+		for _, v := range c.SRV {
+			rr = append(rr, SRVRecord{Name: v.Name, Record: v.Record, Protocol: protocolNames[strings.ToLower(v.Protocol)]})
+		}
+		opts = append(opts, OptDiscoverBackend(NewStaticBackend(c.StaticFile, rr...)))
+	case "bolt":
+		file := c.BoltFile
+		opts = append(opts, func(o *discover) {
+			o.discoverType = byBolt
+			o.boltFile = file
+		})
+	}
+	if c.InfoTimeout != "" || c.PublishInterval != "" {
+		timeo, interval := parseDuration(c.InfoTimeout), parseDuration(c.PublishInterval)
+		opts = append(opts, func(o *discover) {
+			if timeo == 0 {
+				timeo = o.infoTimeout
+			}
+			if interval == 0 {
+				interval = o.publishInterval
+			}
+			OptDiscoverInfoTimeout(timeo, interval)(o)
+		})
+	}
+	return opts
+}
+
+func (f *fileConfig) mqttOpts() []mqttOpts {
+	if f == nil || f.Mqtt == nil {
+		return nil
+	}
+	c := f.Mqtt
+	opts := make([]mqttOpts, 0)
+	if c.Addr != "" {
+		opts = append(opts, OptMqttHost(c.Addr, nil))
+	}
+	if c.User != "" || c.Password != "" {
+		opts = append(opts, OptMqttAuth(c.User, c.Password))
+	}
+	if c.ClientID != "" {
+		opts = append(opts, OptMqttClientID(c.ClientID))
+	}
+	if d := parseDuration(c.SendTimeout); d > 0 {
+		opts = append(opts, OptMqttSendTimeout(d))
+	}
+	if len(c.Subscribe) > 0 {
+		opts = append(opts, OptMqttSubscribe(c.Subscribe))
+	}
+	return opts
+}
+
+func (f *fileConfig) rmqOpts() []rmqOpts {
+	if f == nil || f.Rmq == nil {
+		return nil
+	}
+	c := f.Rmq
+	opts := make([]rmqOpts, 0)
+	if c.Addr != "" {
+		opts = append(opts, func(o *cliRmq) {
+			OptRmqAuth(c.Addr, c.VHost, c.User, c.Password, o.tlsc)(o)
+			if c.VHost == "" {
+				o.vhost = "/"
+			}
+		})
+	}
+	if c.Producer {
+		opts = append(opts, OptRmqProducer(c.Exchange))
+	}
+	if c.Consumer {
+		opts = append(opts, func(o *cliRmq) {
+			queue := c.Queue
+			if queue == "" {
+				queue = o.queueName
+			}
+			OptRmqConsumer(c.Exchange, queue, c.Durable, c.AutoDelete, o.recvFunc)(o)
+		})
+	}
+	return opts
+}
+
+func (f *fileConfig) dbOpts() []dbOpts {
+	if f == nil || f.DB == nil {
+		return nil
+	}
+	c := f.DB
+	if c.Host == "" {
+		return nil
+	}
+	driver := db.Drive(strings.ToLower(c.Driver))
+	if driver == "" {
+		driver = db.DriveMySQL
+	}
+	return []dbOpts{OptDBHost(driver, c.Host, c.User, c.Password, c.Databases...)}
+}
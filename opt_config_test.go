@@ -0,0 +1,111 @@
+package gofactory
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xyzj/toolbox/db"
+	"github.com/xyzj/toolbox/logger"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		body   string
+	}{
+		{"yaml", "yaml", "mode: release\nshutdown_timeout: 3s\nredis:\n  addr: 10.0.0.1:6379\n  database: 2\ndb:\n  driver: postgre\n  host: 10.0.0.2\n  databases: [a, b]\n"},
+		{"toml", "toml", "mode = \"release\"\nshutdown_timeout = \"3s\"\n[redis]\naddr = \"10.0.0.1:6379\"\ndatabase = 2\n[db]\ndriver = \"postgre\"\nhost = \"10.0.0.2\"\ndatabases = [\"a\", \"b\"]\n"},
+		{"json", "json", `{"mode":"release","shutdown_timeout":"3s","redis":{"addr":"10.0.0.1:6379","database":2},"db":{"driver":"postgre","host":"10.0.0.2","databases":["a","b"]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseConfig([]byte(tt.body), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Mode != "release" || f.ShutdownTimeout != "3s" {
+				t.Fatalf("mode %q, shutdown_timeout %q", f.Mode, f.ShutdownTimeout)
+			}
+			if f.Redis == nil || f.Redis.Addr != "10.0.0.1:6379" || f.Redis.Database != 2 {
+				t.Fatalf("redis %+v", f.Redis)
+			}
+			if f.DB == nil || f.DB.Driver != "postgre" || f.DB.Host != "10.0.0.2" || !slices.Equal(f.DB.Databases, []string{"a", "b"}) {
+				t.Fatalf("db %+v", f.DB)
+			}
+		})
+	}
+}
+
+func TestParseConfigError(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		body   string
+		err    string
+	}{
+		{"format", "ini", "mode=dev", "unsupported format"},
+		{"syntax", "yaml", "mode: [dev", "parse error"},
+		{"mode", "yaml", "mode: prod", "unknown mode"},
+		{"duration", "yaml", "shutdown_timeout: 3x", "shutdown_timeout"},
+		{"db driver", "yaml", "db:\n  driver: oracle\n  host: 10.0.0.2", "unknown db.driver"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.body), tt.format)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	t.Setenv("GOFACTORY_REDIS_ADDR", "10.0.0.3:6379")
+	t.Setenv("GOFACTORY_DB_DRIVER", "sqlserver")
+	t.Setenv("GOFACTORY_SHUTDOWN_TIMEOUT", "5s")
+	f, err := parseConfig([]byte("shutdown_timeout: 3s\nredis:\n  addr: 10.0.0.1:6379\n  database: 2\n"), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ShutdownTimeout != "5s" {
+		t.Fatalf("shutdown_timeout %q", f.ShutdownTimeout)
+	}
+	if f.Redis.Addr != "10.0.0.3:6379" || f.Redis.Database != 2 {
+		t.Fatalf("redis %+v", f.Redis)
+	}
+	// 环境变量创建了文件中没有的段
+	if f.DB == nil || f.DB.Driver != "sqlserver" {
+		t.Fatalf("db %+v", f.DB)
+	}
+	t.Setenv("GOFACTORY_REDIS_DATABASE", "x")
+	if _, err = parseConfig(nil, "yaml"); err == nil || !strings.Contains(err.Error(), "GOFACTORY_REDIS_DATABASE") {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestConfigFileOverride(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte("shutdown_timeout: 3s\nredis:\n  addr: 10.0.0.1:6379\n  database: 2\ndb:\n  host: 10.0.0.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// 显式的选项无论位置都优先于文件
+	s, err := New(WithShutdownTimeout(time.Second*7), WithRedisClient(OptRedisAddr("10.0.0.4:6379")),
+		WithLogger(logger.NewNilLogger()), FromConfigFile(name), WithDBClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.opt.shutdownTimeout != time.Second*7 {
+		t.Fatalf("shutdown timeout %v", s.opt.shutdownTimeout)
+	}
+	if s.opt.cliredis.addr != "10.0.0.4:6379" || s.opt.cliredis.database != 2 {
+		t.Fatalf("redis addr %s, database %d", s.opt.cliredis.addr, s.opt.cliredis.database)
+	}
+	if s.opt.clidb.addr != "10.0.0.2" || s.opt.clidb.driver != db.DriveMySQL {
+		t.Fatalf("db addr %s, driver %q", s.opt.clidb.addr, s.opt.clidb.driver)
+	}
+}
@@ -3,6 +3,7 @@ package gofactory
 import (
 	"crypto/tls"
 	"errors"
+	"io"
 	"time"
 
 	"github.com/xyzj/mqtt-server/cmd/server"
@@ -29,6 +30,9 @@ func (opt *mqttBroker) build(l logger.Logger, mode RunMode) (*server.MqttServer,
 	if !opt.enable {
 		return nil, errors.New("[mqtt-broker] not enable")
 	}
+	if l.DefaultWriter() == nil {
+		l = discardLogger{Logger: l}
+	}
 	mopt := &server.Opt{
 		ClientsBufferSize:       opt.clientsBufferSize,
 		MaxMsgExpirySeconds:     int(opt.maxMsgExpiry.Seconds()),
@@ -55,6 +59,29 @@ func (opt *mqttBroker) build(l logger.Logger, mode RunMode) (*server.MqttServer,
 	return server.NewServer(mopt), nil
 }
 
+// discardLogger gives the broker core a writer for its logs when the logger has none, like the NilLogger
+type discardLogger struct {
+	logger.Logger
+}
+
+func (discardLogger) DefaultWriter() io.Writer {
+	return io.Discard
+}
+
+// addrs returns the addresses the broker listens to
+func (opt *mqttBroker) addrs() []string {
+	ss := make([]string, 0, 4)
+	for _, v := range []string{opt.mqtt, opt.mqtttls, opt.mqttws, opt.mqttweb} {
+		if v == opt.mqtttls && (opt.tlsc == nil || opt.tlsc.Certificates == nil) {
+			continue
+		}
+		if _, ok := checkTCPAddr(v); ok {
+			ss = append(ss, v)
+		}
+	}
+	return ss
+}
+
 var defaultMqttBroker = mqttBroker{
 	mqtt:              ":1883",
 	mqtttls:           "",
@@ -93,7 +120,7 @@ func OptMqttTlsFromFile(s, cert, key, ca string) mqttBrokerOpts {
 		if err != nil {
 			o.mqtttls = ""
 		} else {
-			OptMqttTlsAddr(s, t)
+			OptMqttTlsAddr(s, t)(o)
 		}
 	}
 }
@@ -130,7 +157,7 @@ func OptMqttClientBufferSize(s int) mqttBrokerOpts {
 
 func OptMqttInsideClient(b bool) mqttBrokerOpts {
 	return func(o *mqttBroker) {
-		o.insidejob = true
+		o.insidejob = b
 	}
 }
 
@@ -2,6 +2,8 @@ package gofactory
 
 import (
 	"errors"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/xyzj/toolbox/logger"
@@ -9,6 +11,7 @@ import (
 )
 
 type tcpSvr struct {
+	listening     chan struct{} // 开始监听后关闭
 	helloMessages []*tcpfactory.SendMessage
 	client        tcpfactory.Client
 	readTimeout   time.Duration
@@ -16,13 +19,18 @@ type tcpSvr struct {
 	enable        bool
 }
 
-func (opt *tcpSvr) build(l logger.Logger) (*tcpfactory.TCPManager, error) {
+// build creates the tcp server, listening is called on the goroutine of Listen once the address is bound.
+func (opt *tcpSvr) build(l logger.Logger, listening func()) (*tcpfactory.TCPManager, error) {
 	if !opt.enable {
 		return nil, errors.New("[tcp] server not enable")
 	}
+	opt.listening = make(chan struct{})
 	tcpserver, err := tcpfactory.NewTcpFactory(
 		tcpfactory.OptBindAddr(opt.bind),
-		tcpfactory.OptLogger(l),
+		tcpfactory.OptLogger(&tcpLogger{Logger: l, listening: func() {
+			listening()
+			close(opt.listening)
+		}}),
 		tcpfactory.OptHelloMessages(opt.helloMessages...),
 		tcpfactory.OptMatchMultiTargets(true),
 		tcpfactory.OptReadTimeout(opt.readTimeout),
@@ -35,6 +43,19 @@ func (opt *tcpSvr) build(l logger.Logger) (*tcpfactory.TCPManager, error) {
 	return tcpserver, nil
 }
 
+// tcpLogger tells when the tcp server is listening. Listen returns the bind error,
+// or keeps the bound listener and then gets the writer of its logger to run the accept loop.
+type tcpLogger struct {
+	logger.Logger
+	listening func()
+	once      sync.Once
+}
+
+func (l *tcpLogger) DefaultWriter() io.Writer {
+	l.once.Do(l.listening)
+	return l.Logger.DefaultWriter()
+}
+
 var defaultTCPServer = tcpSvr{
 	bind:          ":6881",
 	client:        &tcpfactory.EchoClient{},
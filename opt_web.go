@@ -16,7 +16,7 @@ import (
 var favicon []byte
 
 var defaultWebServer = webSvr{
-	engineFunc:   func() *gin.Engine { return gin.New() },
+	engineFunc:   func(h *gin.Engine) {},
 	readTimeout:  time.Second * 120,
 	writeTimeout: time.Second * 120,
 	idleTimeout:  time.Second * 60,
@@ -28,7 +28,7 @@ var defaultWebServer = webSvr{
 
 // Opt 通用化http框架
 type webSvr struct {
-	engineFunc   func() *gin.Engine
+	engineFunc   func(h *gin.Engine)
 	hosts        []string
 	tlsc         *tls.Config
 	readTimeout  time.Duration
@@ -43,32 +43,69 @@ func (opt *webSvr) build(l logger.Logger) (*http.Server, error) {
 	if opt.bind == "" {
 		return nil, errors.New("[web] services not enable")
 	}
+	// 请求的读写超时由webMiddleware设置,以便重新加载配置时生效
+	idle := opt.idleTimeout
+	if idle == 0 {
+		idle = opt.readTimeout
+	}
 	s := &http.Server{
-		Addr:         opt.bind,
-		ReadTimeout:  opt.readTimeout,
-		WriteTimeout: opt.writeTimeout,
-		IdleTimeout:  opt.idleTimeout,
-		TLSConfig:    opt.tlsc,
+		Addr:              opt.bind,
+		ReadHeaderTimeout: opt.readTimeout,
+		IdleTimeout:       idle,
+		TLSConfig:         opt.tlsc,
 	}
 	return s, nil
 }
 
-func (opt *webSvr) buildRoutes() (*gin.Engine, error) {
-	h := opt.engineFunc()
+// buildRoutes creates the engine with the middlewares, then registers the routes of engineFunc and the built-in GET routes,
+// routes already defined by engineFunc are kept.
+func (opt *webSvr) buildRoutes(mw []gin.HandlerFunc, routes map[string]gin.HandlerFunc) (*gin.Engine, error) {
+	h := gin.New()
+	h.Use(mw...)
+	opt.engineFunc(h)
+	if routes == nil {
+		routes = make(map[string]gin.HandlerFunc)
+	}
+	routes["/favicon.ico"] = func(c *gin.Context) {
+		c.Writer.Write(favicon)
+	}
 	for _, v := range h.Routes() {
-		if v.Path == "/favicon.ico" {
-			return h, nil
+		if v.Method == http.MethodGet {
+			delete(routes, v.Path)
 		}
 	}
-	h.GET("/favicon.ico", func(c *gin.Context) {
-		c.Writer.Write(favicon)
-	})
+	for p, f := range routes {
+		h.GET(p, f)
+	}
 	return h, nil
 }
 
+// webMiddleware sets the read and write deadlines of the request, then traces and records it.
+// It is used before any route is registered so that c.FullPath() names the matched route.
+func (s *Service) webMiddleware(c *gin.Context) {
+	t := time.Now()
+	live := s.live.Load()
+	rc := http.NewResponseController(c.Writer)
+	if live.webRead > 0 {
+		rc.SetReadDeadline(t.Add(live.webRead))
+	}
+	if live.webWrite > 0 {
+		rc.SetWriteDeadline(t.Add(live.webWrite))
+	}
+	route := c.FullPath()
+	r, span := s.traceRequest(c.Request, route)
+	c.Request = r
+	c.Next()
+	status := c.Writer.Status()
+	finishRequest(span, status)
+	s.metrics.observeHTTP(r.Method, route, status, time.Since(t))
+}
+
 type webOpts func(opt *webSvr)
 
-func OptWebEngineFunc(f func() *gin.Engine) webOpts {
+// OptWebEngineFunc sets the function which registers the middlewares and routes on the gin engine,
+// the engine is created by the service and all its requests are traced and recorded.
+func OptWebEngineFunc(f func(h *gin.Engine)) webOpts {
 	return func(opt *webSvr) {
 		opt.engineFunc = f
 	}
@@ -80,6 +117,8 @@ func OptWebHosts(hosts ...string) webOpts {
 	}
 }
 
+// OptWebTimeout sets the timeouts of the web server, the read and write timeouts apply to every request and can be reloaded,
+// while the read timeout of the request header and the idle timeout are set when the server starts.
 func OptWebTimeout(read, write, idle time.Duration) webOpts {
 	return func(opt *webSvr) {
 		opt.readTimeout = read
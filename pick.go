@@ -0,0 +1,188 @@
+package gofactory
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PickStrategy decides which instance is returned when several instances serve the same name.
+type PickStrategy byte
+
+const (
+	// PickRoundRobin returns the instances in turn, it is the default strategy
+	PickRoundRobin PickStrategy = iota
+	// PickRandom returns a random instance
+	PickRandom
+	// PickLeastRecent returns the instance which has not been picked for the longest time
+	PickLeastRecent
+	// PickHash returns the same instance for the same key as long as the instance is alive,
+	// only the keys of a removed instance move to other instances
+	PickHash
+	// PickWeighted returns a random instance with the probability of its Weight
+	PickWeighted
+)
+
+var pickStrategyNames = map[string]PickStrategy{
+	"round_robin":  PickRoundRobin,
+	"random":       PickRandom,
+	"least_recent": PickLeastRecent,
+	"hash":         PickHash,
+	"weighted":     PickWeighted,
+}
+
+// instance is a live service instance found by discover
+type instance struct {
+	info     svrinfo
+	addr     string
+	rootPath string
+	protocol ProtocolType
+	weight   int
+	stamp    int64
+}
+
+const (
+	callTries     = 3                // CallService最多尝试的实例数
+	ejectFailures = 3                // 连续失败次数达到后暂停使用实例
+	ejectDuration = time.Second * 30 // 暂停使用时长
+)
+
+// url returns the url of path on the instance, path is appended to the root path of the instance
+func (x instance) url(path string) string {
+	addr := x.addr
+	if !strings.Contains(addr, "://") {
+		if x.protocol == ProtocolHTTPS {
+			addr = "https://" + addr
+		} else {
+			addr = "http://" + addr
+		}
+	}
+	path = appendRootPath(x.rootPath, "/"+strings.TrimPrefix(path, "/"), "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+// picker keeps the state of the strategies and the ejected instances
+type picker struct {
+	counters sync.Map             // 轮询计数, key为 name/protocol
+	picked   map[string]int64     // 最后选中时间, key为地址
+	fails    map[string]int       // 连续失败次数, key为地址
+	ejected  map[string]time.Time // 暂停使用的实例, value为恢复时间
+	mu       sync.Mutex
+}
+
+func (p *picker) ensure() {
+	if p.picked == nil {
+		p.picked = make(map[string]int64)
+		p.fails = make(map[string]int)
+		p.ejected = make(map[string]time.Time)
+	}
+}
+
+// healthy returns the instances of ss which are not ejected,
+// all of ss are returned when every instance is ejected.
+func (p *picker) healthy(ss []instance) []instance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ensure()
+	x := make([]instance, 0, len(ss))
+	for _, v := range ss {
+		if t, ok := p.ejected[v.addr]; ok {
+			if time.Now().Before(t) {
+				continue
+			}
+			delete(p.ejected, v.addr)
+		}
+		x = append(x, v)
+	}
+	if len(x) == 0 {
+		return ss
+	}
+	return x
+}
+
+// report records the result of a call to addr,
+// the instance is ejected for ejectDuration after ejectFailures failures in a row.
+func (p *picker) report(addr string, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ensure()
+	if !failed {
+		delete(p.fails, addr)
+		return
+	}
+	p.fails[addr]++
+	if p.fails[addr] >= ejectFailures {
+		delete(p.fails, addr)
+		p.ejected[addr] = time.Now().Add(ejectDuration)
+	}
+}
+
+// pick selects one of ss, ss must not be empty and should be in a stable order
+func (p *picker) pick(strategy PickStrategy, counter, key string, ss []instance) instance {
+	switch strategy {
+	case PickRandom:
+		return ss[rand.IntN(len(ss))]
+	case PickLeastRecent:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.ensure()
+		idx := 0
+		for i, v := range ss {
+			if p.picked[v.addr] < p.picked[ss[idx].addr] {
+				idx = i
+			}
+		}
+		p.picked[ss[idx].addr] = time.Now().UnixNano()
+		return ss[idx]
+	case PickHash:
+		// rendezvous hashing, every instance scores the key and the highest one wins
+		idx := 0
+		var top uint64
+		for i, v := range ss {
+			if x := hashString(key + "\x00" + v.addr); i == 0 || x > top {
+				idx, top = i, x
+			}
+		}
+		return ss[idx]
+	case PickWeighted:
+		total := 0
+		for _, v := range ss {
+			total += v.weight
+		}
+		n := rand.IntN(total)
+		for _, v := range ss {
+			if n < v.weight {
+				return v
+			}
+			n -= v.weight
+		}
+		return ss[len(ss)-1]
+	default:
+		x, _ := p.counters.LoadOrStore(counter, &atomic.Uint64{})
+		return ss[(x.(*atomic.Uint64).Add(1)-1)%uint64(len(ss))]
+	}
+}
+
+// hashString is fnv-1a with a final mix, so that similar strings get well spread values
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func pickCounter(name string, protocol ProtocolType) string {
+	return name + "/" + strconv.Itoa(int(protocol))
+}
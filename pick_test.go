@@ -0,0 +1,74 @@
+package gofactory
+
+import (
+	"strconv"
+	"testing"
+)
+
+func testInstances(weights ...int) []instance {
+	ss := make([]instance, 0, len(weights))
+	for i, w := range weights {
+		ss = append(ss, instance{addr: "10.0.0." + strconv.Itoa(i+1) + ":6880", weight: w})
+	}
+	return ss
+}
+
+func TestPickStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy PickStrategy
+		weights  []int
+		share    []float64 // 各实例期望的选中比例
+		delta    float64   // 允许的偏差
+	}{
+		{"round robin", PickRoundRobin, []int{1, 1, 1}, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}, 0},
+		{"least recent", PickLeastRecent, []int{1, 1, 1}, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}, 0},
+		{"random", PickRandom, []int{1, 1, 1, 1}, []float64{0.25, 0.25, 0.25, 0.25}, 0.03},
+		{"weighted", PickWeighted, []int{1, 3, 6}, []float64{0.1, 0.3, 0.6}, 0.03},
+		{"hash", PickHash, []int{1, 1, 1, 1}, []float64{0.25, 0.25, 0.25, 0.25}, 0.03},
+	}
+	const n = 6000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &picker{}
+			ss := testInstances(tt.weights...)
+			count := make(map[string]int)
+			for i := 0; i < n; i++ {
+				count[p.pick(tt.strategy, "test", "key-"+strconv.Itoa(i), ss).addr]++
+			}
+			for i, v := range ss {
+				x := float64(count[v.addr]) / n
+				if x < tt.share[i]-tt.delta-1e-9 || x > tt.share[i]+tt.delta+1e-9 {
+					t.Fatalf("%s picked %.3f, want %.3f", v.addr, x, tt.share[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPickHashStable(t *testing.T) {
+	p := &picker{}
+	ss := testInstances(1, 1, 1, 1, 1)
+	removed := ss[2].addr
+	less := append(append([]instance{}, ss[:2]...), ss[3:]...)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		a := p.pick(PickHash, "test", key, ss)
+		if b := p.pick(PickHash, "test", key, ss); b.addr != a.addr {
+			t.Fatalf("%s picked %s then %s", key, a.addr, b.addr)
+		}
+		b := p.pick(PickHash, "test", key, less)
+		if a.addr == removed {
+			moved++
+			continue
+		}
+		// 只有被移除实例的key会变化
+		if b.addr != a.addr {
+			t.Fatalf("%s moved from %s to %s", key, a.addr, b.addr)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no key is picked on the removed instance")
+	}
+}
@@ -1,55 +1,110 @@
 package gofactory
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/xyzj/mqtt-server/cmd/server"
 	"github.com/xyzj/toolbox/db"
-	"github.com/xyzj/toolbox/httpclient"
 	"github.com/xyzj/toolbox/logger"
 	"github.com/xyzj/toolbox/loopfunc"
 	"github.com/xyzj/toolbox/tcpfactory"
 )
 
 type Service struct {
-	opt        *Opt
-	httpcli    *httpclient.Client
-	boltcli    *db.BoltDB
-	dbcli      *db.Conn
-	tcpserver  *tcpfactory.TCPManager
-	mqttbroker *server.MqttServer
-	webserver  *http.Server
+	opt         *Opt
+	opts        []Opts
+	httpcli     *http.Client
+	boltcli     *db.BoltDB
+	dbcli       *db.Conn
+	tcpserver   *tcpfactory.TCPManager
+	mqttbroker  *server.MqttServer
+	webserver   *http.Server
+	closeCtx    context.Context
+	closeFunc   context.CancelFunc
+	stopped     atomic.Bool
+	tcpUp       atomic.Bool
+	brokerUp    atomic.Bool
+	webUp       atomic.Bool
+	metrics     *serviceMetrics
+	tracer      *tracer
+	traceCancel context.CancelFunc
+	traceDone   chan struct{}
+	live        atomic.Pointer[liveOpt]
+	reloadMu    sync.Mutex
+	reloadFunc  []func(r ReloadResult)
 }
 
-func New(opts ...Opts) (*Service, error) {
-	opt := Opt{
-		logg: logger.NewConsoleLogger(),
-		mode: Debug,
+// loadOpt applies opts to o, the config file is applied first so that the explicit options override it.
+// The options may run twice and on every reload, so they only set values,
+// the side effects such as the gin mode and the trace exporter are applied by New and Reload.
+func loadOpt(o *Opt, opts []Opts) error {
+	fInit := func(f *fileConfig) {
+		*o = Opt{
+			file:            f,
+			logg:            logger.NewConsoleLogger(),
+			mode:            Debug,
+			shutdownTimeout: time.Second * 10,
+		}
 	}
-	for _, o := range opts {
-		o(&opt)
+	fInit(nil)
+	for _, v := range opts {
+		v(o)
+	}
+	if o.fileErr != nil {
+		return o.fileErr
+	}
+	if o.file != nil {
+		fInit(o.file)
+		for _, v := range append(o.file.opts(), opts...) {
+			v(o)
+		}
+	}
+	if !o.strictSet {
+		o.strict = o.mode == Release
+	}
+	return nil
+}
+
+func New(opts ...Opts) (*Service, error) {
+	opt := Opt{}
+	if err := loadOpt(&opt, opts); err != nil {
+		return nil, err
 	}
 	s := &Service{
-		opt: &opt,
-		httpcli: httpclient.New(
-			httpclient.OptLogger(opt.logg),
-			httpclient.OptTLS(&tls.Config{InsecureSkipVerify: true}),
-		),
+		opt:     &opt,
+		opts:    opts,
+		httpcli: newHTTPClient(),
 	}
-	if opt.mode == Debug {
+	s.closeCtx, s.closeFunc = context.WithCancel(context.Background())
+	s.live.Store(newLiveOpt(&opt))
+	s.initMetrics()
+	s.startTracer()
+	if opt.mode == Release {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	if opt.logLevel > 0 {
+		opt.logg.SetLevel(opt.logLevel)
+	} else if opt.mode == Debug {
 		opt.logg.SetLevel(logger.LogDebug)
 	}
 	var err error
+	errs := make([]error, 0)
 	// services
 	// tcp
 	if opt.tcpServer.enable {
-		s.tcpserver, err = opt.tcpServer.build(opt.logg)
+		opt.tcpServer.client = s.metrics.tcpClient(opt.tcpServer.client, opt.tcpServer.helloMessages)
+		s.tcpserver, err = opt.tcpServer.build(opt.logg, func() { s.tcpUp.Store(true) })
 		if err != nil {
-			opt.logg.Error("build tcp server error:" + err.Error())
+			errs = append(errs, s.failed(ComponentTCP, errors.New("build tcp server error:"+err.Error())))
 			opt.tcpServer.enable = false
 		}
 	}
@@ -57,7 +112,7 @@ func New(opts ...Opts) (*Service, error) {
 	if opt.mqttBroker.enable {
 		s.mqttbroker, err = opt.mqttBroker.build(opt.logg, opt.mode)
 		if err != nil {
-			opt.logg.Error("build mqtt server error:" + err.Error())
+			errs = append(errs, s.failed(ComponentMQTTBroker, errors.New("build mqtt server error:"+err.Error())))
 			opt.mqttBroker.enable = false
 		}
 	}
@@ -65,16 +120,17 @@ func New(opts ...Opts) (*Service, error) {
 	if opt.webServer.enable {
 		s.webserver, err = opt.webServer.build(opt.logg)
 		if err != nil {
-			opt.logg.Error("build web server error:" + err.Error())
+			errs = append(errs, s.failed(ComponentWeb, errors.New("build web server error:"+err.Error())))
 			opt.webServer.enable = false
 		}
 	}
 	// clients
+	opt.cliredis.hook = redisHook{s: s}
 	// boltdb
 	if s.opt.boltname != "" {
 		s.boltcli, err = db.NewBolt(opt.boltname)
 		if err != nil {
-			opt.logg.Error("create or load boltdb error:" + err.Error())
+			errs = append(errs, s.failed(ComponentBolt, errors.New("create or load boltdb error:"+err.Error())))
 		} else {
 			p, err := filepath.Abs(opt.boltname)
 			if err != nil {
@@ -83,148 +139,341 @@ func New(opts ...Opts) (*Service, error) {
 			opt.logg.System("[bolt] create or load boltdb from:" + p)
 		}
 	}
+	if err = errors.Join(errs...); err != nil {
+		if s.boltcli != nil {
+			s.boltcli.Close()
+		}
+		s.stopTracer(context.Background())
+		return nil, err
+	}
 	return s, nil
 }
 
+// failed logs the error of a component, and returns it only when the service is in strict mode
+// and the component is not optional.
+func (s *Service) failed(c Component, err error) error {
+	if err == nil {
+		return nil
+	}
+	s.opt.logg.Error(err.Error())
+	if live := s.live.Load(); !live.strict || live.optional[c] {
+		return nil
+	}
+	return err
+}
+
+// Start runs the service in background, use Stop to shut it down.
+// The error returned by Run is logged, use Run when the error is needed.
 func (s *Service) Start() {
 	loopfunc.GoFunc(func(params ...any) {
-		s.Run()
+		if err := s.Run(context.Background()); err != nil {
+			s.opt.logg.Error("[service] run error:" + err.Error())
+		}
 	}, "service", s.opt.logg.DefaultWriter())
 }
 
-func (s *Service) Run() {
+// Run starts all enabled servers and clients, and blocks until ctx is done or Stop is called.
+// When ctx is done, the service is stopped within the shutdown timeout and the shutdown error is returned.
+// If no server is enabled, Run returns right after the clients are started.
+func (s *Service) Run(ctx context.Context) error {
 	wg := sync.WaitGroup{}
-	if s.opt.emptyServer.enable {
-		wg.Add(1)
+	keep := s.opt.emptyServer.enable
+	fStop := func(err error) error {
+		sctx, cancel := context.WithTimeout(context.Background(), s.live.Load().shutdownTimeout)
+		defer cancel()
+		err = errors.Join(err, s.Stop(sctx))
+		wg.Wait()
+		return err
 	}
 	if s.opt.tcpServer.enable {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := s.tcpserver.Listen()
-			if err != nil {
-				s.opt.logg.Error("[tcp] listen error:" + err.Error())
-				return
-			}
-		}()
+		keep = true
+		if err := s.failed(ComponentTCP, s.startTCP(&wg)); err != nil {
+			return fStop(err)
+		}
 	}
 	if s.opt.mqttBroker.enable {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := s.mqttbroker.Start()
-			if err != nil {
-				s.opt.logg.Error("[mqtt-broker] start error:" + err.Error())
-				return
-			}
-		}()
+		keep = true
+		if err := s.failed(ComponentMQTTBroker, s.startBroker()); err != nil {
+			return fStop(err)
+		}
 	}
 	if s.opt.webServer.enable {
-		h, err := s.opt.webServer.buildRoutes()
-		if err != nil {
-			s.opt.logg.Error("[web] build routes error:" + err.Error())
-			return
+		keep = true
+		if err := s.failed(ComponentWeb, s.startWeb(&wg)); err != nil {
+			return fStop(err)
+		}
+	} else if s.opt.metricsBind != "" {
+		if err := s.failed(ComponentMetrics, s.startMetrics()); err != nil {
+			return fStop(err)
 		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			var err error
-			s.webserver.Handler = h
-			switch s.opt.webServer.protocol {
-			case ProtocolHTTP:
-				s.opt.logg.System("[web] http listening to " + s.webserver.Addr)
-				err = s.webserver.ListenAndServe()
-			case ProtocolHTTPS:
-				s.opt.logg.System("[web] https listening to " + s.webserver.Addr)
-				err = s.webserver.ListenAndServeTLS("", "")
-			default:
-				s.opt.logg.System("[web] no web service listening")
-				return
-			}
-			if err != nil {
-				s.opt.logg.Error("[web] serve web service failed:" + err.Error())
-			}
-		}()
 	}
 	// clients
 	// discover
 	if s.opt.discover.enable {
+		s.opt.discover.setAddress(s.registerAddress())
 		for p, v := range s.opt.discover.svrInfo.RegisterAddress {
-			switch p {
-			case ProtocolTCP:
-				if !s.opt.tcpServer.enable {
-					delete(s.opt.discover.svrInfo.RegisterAddress, ProtocolTCP)
-				}
-			case ProtocolHTTP:
-				if !s.opt.webServer.enable || s.opt.webServer.protocol != ProtocolHTTP {
-					delete(s.opt.discover.svrInfo.RegisterAddress, ProtocolHTTP)
-				}
-			case ProtocolHTTPS:
-				if !s.opt.webServer.enable || s.opt.webServer.protocol != ProtocolHTTPS {
-					delete(s.opt.discover.svrInfo.RegisterAddress, ProtocolHTTPS)
-				}
-			case ProtocolMQTT:
-			default:
-				s.opt.logg.System("[discover] " + v)
-			}
-			if strings.HasPrefix(v, "http://") {
-				s.opt.logg.System("[discover] http://" + v)
-			} else if strings.HasPrefix(v, "https://") {
-				s.opt.logg.System("[discover] https://" + v)
-			} else {
-				s.opt.logg.System("[discover] " + v)
-			}
+			s.opt.logg.System("[discover] register " + p.String() + " address: " + v)
 		}
-		if len(s.opt.discover.svrInfo.RegisterAddress) == 0 {
-		}
-		err := s.opt.discover.build(s.opt.logg)
-		if err != nil {
-			s.opt.logg.Error("build discover error:" + err.Error())
+		if err := s.opt.discover.build(s.closeCtx, s.opt.logg); err != nil {
+			if err = s.failed(ComponentDiscover, errors.New("build discover error:"+err.Error())); err != nil {
+				return fStop(err)
+			}
 		}
 	}
 	// redis
 	if s.opt.cliredis.enable {
-		err := s.opt.cliredis.build(s.opt.logg)
-		if err != nil {
-			s.opt.logg.Error("build redis client error:" + err.Error())
+		if err := s.opt.cliredis.build(s.closeCtx, s.opt.logg); err != nil {
+			if err = s.failed(ComponentRedis, errors.New("build redis client error:"+err.Error())); err != nil {
+				return fStop(err)
+			}
 		}
 	}
 	// mqtt
 	if s.opt.climqtt.enable {
-		err := s.opt.climqtt.build(s.opt.logg)
-		if err != nil {
-			s.opt.logg.Error("build mqtt client error:" + err.Error())
+		if err := s.opt.climqtt.build(s.opt.logg); err != nil {
+			if err = s.failed(ComponentMQTT, errors.New("build mqtt client error:"+err.Error())); err != nil {
+				return fStop(err)
+			}
 		}
 	}
 	// rmq
 	if s.opt.clirmq.enable {
-		err := s.opt.clirmq.build(s.opt.logg)
-		if err != nil {
-			s.opt.logg.Error("build rmq clients error:" + err.Error())
+		if err := s.opt.clirmq.build(s.opt.logg, s.rmqReceived); err != nil {
+			if err = s.failed(ComponentRMQ, errors.New("build rmq clients error:"+err.Error())); err != nil {
+				return fStop(err)
+			}
 		}
 	}
 	// db
 	if s.opt.clidb.enable {
-		err := s.opt.clidb.build(s.opt.logg)
-		if err != nil {
-			s.opt.logg.Error("build db client error:" + err.Error())
+		if err := s.opt.clidb.build(s.opt.logg); err != nil {
+			if err = s.failed(ComponentDB, errors.New("build db client error:"+err.Error())); err != nil {
+				return fStop(err)
+			}
 		}
+		s.dbcli = s.opt.clidb.cli
+	}
+	if s.opt.reload {
+		s.watchConfig(s.closeCtx)
+	}
+	if s.opt.discover.enable {
+		s.opt.discover.serve()
+	}
+	if !keep {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return fStop(nil)
+	case <-s.closeCtx.Done():
+		wg.Wait()
+		return nil
 	}
-	wg.Wait()
+}
+
+// startTCP starts the tcp server in background and waits until it is listening,
+// so that a bind failure is returned right away. tcpUp is kept while it is listening.
+func (s *Service) startTCP(wg *sync.WaitGroup) error {
+	listenErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := s.tcpserver.Listen()
+		s.tcpUp.Store(false)
+		listenErr <- err
+	}()
+	select {
+	case <-s.opt.tcpServer.listening:
+		return nil
+	case err := <-listenErr:
+		if err == nil {
+			err = errors.New("stopped")
+		}
+		return errors.New("[tcp] listen error:" + err.Error())
+	}
+}
+
+// startBroker starts the mqtt broker, the broker only logs the listener errors,
+// so the addresses are probed first, and brokerUp is set when the broker is started.
+func (s *Service) startBroker() error {
+	errs := make([]error, 0)
+	for _, v := range s.opt.mqttBroker.addrs() {
+		if err := probeTCPAddr(v); err != nil {
+			errs = append(errs, errors.New("[mqtt-broker] listen error:"+err.Error()))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if err := s.mqttbroker.Start(); err != nil {
+		return errors.New("[mqtt-broker] start error:" + err.Error())
+	}
+	s.watchBroker()
+	s.brokerUp.Store(true)
+	return nil
+}
+
+// startWeb binds the web server address and serves it in background,
+// so that a bind failure is returned right away.
+func (s *Service) startWeb(wg *sync.WaitGroup) error {
+	h, err := s.opt.webServer.buildRoutes([]gin.HandlerFunc{s.webMiddleware}, map[string]gin.HandlerFunc{
+		"/healthz": s.healthz,
+		"/readyz":  s.readyz,
+		"/metrics": gin.WrapH(s.MetricsHandler()),
+	})
+	if err != nil {
+		return errors.New("[web] build routes error:" + err.Error())
+	}
+	s.webserver.Handler = h
+	ln, err := net.Listen("tcp", s.webserver.Addr)
+	if err != nil {
+		s.opt.webServer.enable = false
+		return errors.New("[web] listen error:" + err.Error())
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		switch s.opt.webServer.protocol {
+		case ProtocolHTTP:
+			s.opt.logg.System("[web] http listening to " + s.webserver.Addr)
+			s.webUp.Store(true)
+			err = s.webserver.Serve(ln)
+		case ProtocolHTTPS:
+			s.opt.logg.System("[web] https listening to " + s.webserver.Addr)
+			s.webUp.Store(true)
+			err = s.webserver.ServeTLS(ln, "", "")
+		default:
+			ln.Close()
+			s.opt.logg.System("[web] no web service listening")
+			return
+		}
+		s.webUp.Store(false)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.opt.logg.Error("[web] serve web service failed:" + err.Error())
+		}
+	}()
+	return nil
+}
+
+// Stop gracefully shuts down the service.
+// It announces the draining status to discovery, drains the web server, stops the tcp and mqtt broker listeners,
+// deregisters from discovery, then closes all clients and databases.
+// If ctx expires before all components are stopped, the errors collected so far are returned joined with ctx.Err().
+func (s *Service) Stop(ctx context.Context) error {
+	if !s.stopped.CompareAndSwap(false, true) {
+		return nil
+	}
+	s.opt.logg.System("[service] shutting down")
+	s.closeFunc()
+	var locker sync.Mutex
+	errs := make([]error, 0)
+	fErr := func(err error) {
+		if err == nil {
+			return
+		}
+		locker.Lock()
+		errs = append(errs, err)
+		locker.Unlock()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// discover first, so that no more requests will be routed here
+		if s.opt.discover.enable {
+			fErr(s.opt.discover.drain())
+		}
+		// services
+		if s.opt.webServer.enable && s.webserver != nil {
+			if err := s.webserver.Shutdown(ctx); err != nil {
+				fErr(errors.New("[web] shutdown error:" + err.Error()))
+			}
+		}
+		if s.metrics.server != nil {
+			if err := s.metrics.server.Shutdown(ctx); err != nil {
+				fErr(errors.New("[metrics] shutdown error:" + err.Error()))
+			}
+		}
+		if s.opt.tcpServer.enable && s.tcpserver != nil {
+			s.tcpserver.Shutdown()
+		}
+		if s.opt.mqttBroker.enable && s.mqttbroker != nil {
+			s.mqttbroker.Stop()
+			s.brokerUp.Store(false)
+		}
+		// the running requests are finished, say goodbye
+		if s.opt.discover.enable {
+			fErr(s.opt.discover.close())
+		}
+		// clients
+		if s.opt.climqtt.enable {
+			if err := s.opt.climqtt.close(); err != nil {
+				fErr(errors.New("[mqtt] close error:" + err.Error()))
+			}
+		}
+		if s.opt.clirmq.enable {
+			if s.opt.clirmq.clip != nil {
+				s.opt.clirmq.clip.Close()
+			}
+			if s.opt.clirmq.clic != nil {
+				s.opt.clirmq.clic.Close()
+			}
+		}
+		if s.opt.cliredis.enable {
+			if err := s.opt.cliredis.close(); err != nil {
+				fErr(errors.New("[redis] close error:" + err.Error()))
+			}
+		}
+		if s.opt.clidb.enable && s.dbcli != nil {
+			for i := 1; i <= s.dbcli.MaxDBIdx(); i++ {
+				d, err := s.dbcli.SQLDB(i)
+				if err != nil {
+					continue
+				}
+				if err = d.Close(); err != nil {
+					fErr(errors.New("[db] close error:" + err.Error()))
+				}
+			}
+		}
+		if s.boltcli != nil {
+			if err := s.boltcli.Close(); err != nil {
+				fErr(errors.New("[bolt] close error:" + err.Error()))
+			}
+		}
+		// the spans of the shutdown are exported as well
+		fErr(s.stopTracer(ctx))
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fErr(errors.Join(errors.New("[service] shutdown not finished"), ctx.Err()))
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	if len(errs) > 0 {
+		s.opt.logg.Error("[service] shutdown error:" + errors.Join(errs...).Error())
+		return errors.Join(errs...)
+	}
+	s.opt.logg.System("[service] shutdown complete")
+	return nil
 }
 
 func (s *Service) AppendRootPath(ss, sep string) string {
 	if !s.opt.discover.enable {
 		return ss
 	}
-	if s.opt.discover.svrInfo.RootPath == "" {
+	return appendRootPath(s.opt.discover.svrInfo.RootPath, ss, sep)
+}
+
+func appendRootPath(root, ss, sep string) string {
+	if root == "" {
 		return ss
 	}
-	if strings.HasPrefix(ss, s.opt.discover.svrInfo.RootPath) {
+	if strings.HasPrefix(ss, root) {
 		return ss
 	}
 	if sep != "" && strings.HasPrefix(ss, sep) {
-		return s.opt.discover.svrInfo.RootPath + ss
+		return root + ss
 	}
-	return s.opt.discover.svrInfo.RootPath + sep + ss
+	return root + sep + ss
 }
@@ -1,34 +1,73 @@
 package gofactory
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/xyzj/toolbox/config"
 	"github.com/xyzj/toolbox/db"
 	"gorm.io/gorm"
 )
 
 func (s *Service) DBQuery(sql string, rowcount int, args ...interface{}) (*db.QueryData, error) {
-	return s.dbcli.Query(sql, rowcount, args...)
+	return s.DBQueryCtx(context.Background(), sql, rowcount, args...)
+}
+
+// DBQueryCtx runs the query on the default database, it is traced when ctx carries a span.
+// The query is canceled when ctx is done or the timeout of the db client is reached.
+func (s *Service) DBQueryCtx(ctx context.Context, sql string, rowcount int, args ...interface{}) (*db.QueryData, error) {
+	return s.dbQuery(ctx, 0, sql, rowcount, args...)
 }
 
 func (s *Service) DBExec(sql string, args ...interface{}) (int64, int64, error) {
-	return s.dbcli.Exec(sql, args...)
+	return s.DBExecCtx(context.Background(), sql, args...)
+}
+
+// DBExecCtx runs the statement in a transaction on the default database, it is traced when ctx carries a span.
+// The transaction is rolled back when ctx is done before it is committed.
+func (s *Service) DBExecCtx(ctx context.Context, sql string, args ...interface{}) (int64, int64, error) {
+	return s.dbExec(ctx, 0, sql, args...)
 }
 
 func (s *Service) DBExecPrepare(sql string, args ...interface{}) error {
-	return s.dbcli.ExecPrepare(sql, 0, args...)
+	return s.DBExecPrepareCtx(context.Background(), sql, args...)
+}
+
+// DBExecPrepareCtx prepares the statement and runs it once for every group of args in a transaction on the default database,
+// the size of a group is the count of ? in the statement. The transaction is rolled back when ctx is done before it is committed.
+func (s *Service) DBExecPrepareCtx(ctx context.Context, sql string, args ...interface{}) error {
+	return s.dbExecPrepare(ctx, 0, sql, args...)
 }
 
 func (s *Service) DBQueryBydb(dbidx int, sql string, rowcount int, args ...interface{}) (*db.QueryData, error) {
-	return s.dbcli.QueryByDB(dbidx, sql, rowcount, args...)
+	return s.DBQueryBydbCtx(context.Background(), dbidx, sql, rowcount, args...)
+}
+
+// DBQueryBydbCtx is DBQueryCtx on the database of dbidx
+func (s *Service) DBQueryBydbCtx(ctx context.Context, dbidx int, sql string, rowcount int, args ...interface{}) (*db.QueryData, error) {
+	return s.dbQuery(ctx, dbidx, sql, rowcount, args...)
 }
 
 func (s *Service) DBExecBydb(dbidx int, sql string, args ...interface{}) (int64, int64, error) {
-	return s.dbcli.ExecByDB(dbidx, sql, args...)
+	return s.DBExecBydbCtx(context.Background(), dbidx, sql, args...)
+}
+
+// DBExecBydbCtx is DBExecCtx on the database of dbidx
+func (s *Service) DBExecBydbCtx(ctx context.Context, dbidx int, sql string, args ...interface{}) (int64, int64, error) {
+	return s.dbExec(ctx, dbidx, sql, args...)
 }
 
 func (s *Service) DBExecPrepareBydb(dbidx int, sql string, args ...interface{}) error {
-	return s.dbcli.ExecPrepareByDB(dbidx, sql, 0, args...)
+	return s.DBExecPrepareBydbCtx(context.Background(), dbidx, sql, args...)
+}
+
+// DBExecPrepareBydbCtx is DBExecPrepareCtx on the database of dbidx
+func (s *Service) DBExecPrepareBydbCtx(ctx context.Context, dbidx int, sql string, args ...interface{}) error {
+	return s.dbExecPrepare(ctx, dbidx, sql, args...)
 }
 
 func (s *Service) DBOrm(dbidx int) (*gorm.DB, error) {
@@ -42,3 +81,176 @@ func (s *Service) DBClient(dbidx int) (*sql.DB, error) {
 	dbidx = min(max(dbidx, 1), len(s.opt.clidb.database))
 	return s.dbcli.SQLDB(dbidx)
 }
+
+// dbObserve calls f with the metrics and the span of the db call, dbidx 0 is the default database
+func (s *Service) dbObserve(ctx context.Context, op string, dbidx int, statement string, f func(ctx context.Context) error) error {
+	ctx, span := s.startChildSpan(ctx, "db "+op, SpanKindClient)
+	span.SetAttr("db.system", string(s.opt.clidb.driver))
+	span.SetAttr("db.operation.name", op)
+	span.SetAttr("db.query.text", statement)
+	t := time.Now()
+	err := f(ctx)
+	s.metrics.observeDB(op, dbidx, t, err)
+	span.SetError(err)
+	span.Finish()
+	return err
+}
+
+func (s *Service) dbQuery(ctx context.Context, dbidx int, statement string, rowcount int, args ...interface{}) (*db.QueryData, error) {
+	var ans *db.QueryData
+	err := s.dbObserve(ctx, "query", dbidx, statement, func(ctx context.Context) error {
+		sqldb, err := s.dbcli.SQLDB(s.dbIndex(dbidx))
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, s.opt.clidb.timeout)
+		defer cancel()
+		rows, err := sqldb.QueryContext(ctx, statement, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		ans, err = scanQueryData(rows, rowcount)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+func (s *Service) dbExecPrepare(ctx context.Context, dbidx int, statement string, args ...interface{}) error {
+	return s.dbObserve(ctx, "exec_prepare", dbidx, statement, func(ctx context.Context) error {
+		n := strings.Count(statement, "?")
+		if n == 0 || len(args)%n != 0 {
+			return errors.New("[db] the count of args does not match the placeholders")
+		}
+		return s.dbTx(ctx, dbidx, func(ctx context.Context, tx *sql.Tx) error {
+			stmt, err := tx.PrepareContext(ctx, statement)
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			for i := 0; i < len(args); i += n {
+				if _, err := stmt.ExecContext(ctx, args[i:i+n]...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// dbExec runs the statement in a transaction bound to ctx, dbidx 0 is the default database.
+func (s *Service) dbExec(ctx context.Context, dbidx int, statement string, args ...interface{}) (int64, int64, error) {
+	var rows, id int64
+	err := s.dbObserve(ctx, "exec", dbidx, statement, func(ctx context.Context) error {
+		return s.dbTx(ctx, dbidx, func(ctx context.Context, tx *sql.Tx) error {
+			res, err := tx.ExecContext(ctx, statement, args...)
+			if err != nil {
+				return err
+			}
+			id, _ = res.LastInsertId()
+			rows, _ = res.RowsAffected()
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return rows, id, nil
+}
+
+// dbTx runs f in a transaction bound to ctx and the timeout of the db client,
+// the transaction is committed when f returns nil.
+func (s *Service) dbTx(ctx context.Context, dbidx int, f func(ctx context.Context, tx *sql.Tx) error) error {
+	sqldb, err := s.dbcli.SQLDB(s.dbIndex(dbidx))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opt.clidb.timeout)
+	defer cancel()
+	tx, err := sqldb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.opt.logg.Error("[db] rollback error:" + err.Error())
+		}
+	}()
+	if err := f(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbIndex returns the index of the default database for 0, which is the first database of OptDBHost
+func (s *Service) dbIndex(dbidx int) int {
+	if dbidx == 0 {
+		return s.dbcli.GetIdx(s.opt.clidb.database[0])
+	}
+	return dbidx
+}
+
+// scanQueryData reads the rows like the db client does, rowcount 0 returns all rows,
+// Total is the count of all rows. CacheTag is empty, the db client is built without a query cache.
+func scanQueryData(rows *sql.Rows, rowcount int) (*db.QueryData, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	ans := &db.QueryData{
+		Columns: columns,
+		Rows:    make([]*db.QueryDataRow, 0),
+	}
+	values := make([]interface{}, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	for rows.Next() {
+		ans.Total++
+		if rowcount > 0 && ans.Total > rowcount {
+			continue
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, err
+		}
+		row := &db.QueryDataRow{
+			Cells:  make([]string, len(columns)),
+			VCells: make([]*config.Value, len(columns)),
+		}
+		for k, v := range values {
+			row.VCells[k] = dbValue(v)
+			row.Cells[k] = row.VCells[k].String()
+		}
+		ans.Rows = append(ans.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ans, nil
+}
+
+// dbValue converts a scanned value as the db client does
+func dbValue(v interface{}) *config.Value {
+	switch b := v.(type) {
+	case nil:
+		return config.EmptyValue
+	case int64:
+		return config.NewInt64Value(b)
+	case uint64:
+		return config.NewUint64Value(b)
+	case float32:
+		return config.NewFloat64Value(float64(b))
+	case float64:
+		return config.NewFloat64Value(b)
+	case []byte:
+		return config.NewValue(string(b))
+	case time.Time:
+		return config.NewValue(b.Format("2006-01-02 15:04:05"))
+	default:
+		return config.NewValue(fmt.Sprintf("%v", v))
+	}
+}
@@ -1,31 +1,139 @@
 package gofactory
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/xyzj/toolbox/httpclient"
+	"github.com/xyzj/toolbox/json"
 )
 
-func (s *Service) PickService(name string, protocol ProtocolType) (string, error) {
-	var ss string
-	var ok bool
-	s.opt.discover.infos.ForEach(func(key string, value svrinfo) bool {
-		if value.SvrName == name {
-			if ss, ok = value.RegisterAddress[protocol]; ok {
-				return false
-			}
+// PickService returns the address of an instance of name which registered the protocol,
+// the instance is selected by the strategy set with OptDiscoverPickStrategy from the instances which pass the filters.
+// When no instance is found, the peers of name are queried right away, the udp peers reply within 300 milliseconds.
+func (s *Service) PickService(name string, protocol ProtocolType, filters ...PickFilter) (string, error) {
+	return s.PickServiceBy(name, protocol, s.live.Load().strategy, "", filters...)
+}
+
+// PickServiceBy returns the address of an instance of name which registered the protocol,
+// the instance is selected by strategy from the instances which pass the filters, key is only used by PickHash.
+func (s *Service) PickServiceBy(name string, protocol ProtocolType, strategy PickStrategy, key string, filters ...PickFilter) (string, error) {
+	if err := s.opt.discover.ready(); err != nil {
+		return "", err
+	}
+	ss := filterInstances(s.opt.discover.lookup(name, protocol), s.opt.discover.svrInfo, filters)
+	if len(ss) == 0 {
+		return "", errors.New("service not found")
+	}
+	return s.opt.discover.picker.pick(strategy, pickCounter(name, protocol), key, s.opt.discover.picker.healthy(ss)).addr, nil
+}
+
+// PickServices returns the addresses of all live instances of name which registered the protocol and pass the filters,
+// ordered by address. It returns nothing when discover is not enabled or not started.
+func (s *Service) PickServices(name string, protocol ProtocolType, filters ...PickFilter) []string {
+	if s.opt.discover.ready() != nil {
+		return []string{}
+	}
+	ss := filterInstances(s.opt.discover.lookup(name, protocol), s.opt.discover.svrInfo, filters)
+	addrs := make([]string, 0, len(ss))
+	for _, v := range ss {
+		addrs = append(addrs, v.addr)
+	}
+	return addrs
+}
+
+// registerAddress returns the addresses of the enabled servers to register.
+// The addresses set by OptDiscoverInfo take priority, an address without host gets the advertise ip,
+// and the tcp, http and https addresses of disabled servers are removed.
+func (s *Service) registerAddress() map[ProtocolType]string {
+	d := &s.opt.discover
+	addrs := make(map[ProtocolType]string)
+	for p, v := range d.address {
+		if v != "" {
+			addrs[p] = d.fillHost(v)
 		}
-		return true
-	})
-	if ok {
-		return ss, nil
 	}
-	return "", errors.New("service not found")
+	fAdd := func(p ProtocolType, bind string) {
+		if _, ok := addrs[p]; ok {
+			return
+		}
+		if hp := d.advertise(bind); hp != "" {
+			addrs[p] = p.scheme() + hp
+		}
+	}
+	if s.opt.tcpServer.enable {
+		fAdd(ProtocolTCP, s.opt.tcpServer.bind)
+	} else {
+		delete(addrs, ProtocolTCP)
+	}
+	if !s.opt.webServer.enable || s.opt.webServer.protocol != ProtocolHTTP {
+		delete(addrs, ProtocolHTTP)
+	}
+	if !s.opt.webServer.enable || s.opt.webServer.protocol != ProtocolHTTPS {
+		delete(addrs, ProtocolHTTPS)
+	}
+	if s.opt.webServer.enable {
+		switch s.opt.webServer.protocol {
+		case ProtocolHTTP:
+			fAdd(ProtocolHTTP, s.opt.webServer.bind)
+		case ProtocolHTTPS:
+			fAdd(ProtocolHTTPS, s.opt.webServer.bind)
+		}
+	}
+	if s.opt.mqttBroker.enable {
+		fAdd(ProtocolMQTT, s.opt.mqttBroker.mqtt)
+		if s.opt.mqttBroker.tlsc != nil && s.opt.mqttBroker.tlsc.Certificates != nil {
+			fAdd(ProtocolMQTTTLS, s.opt.mqttBroker.mqtttls)
+		}
+		fAdd(ProtocolMQTTWS, s.opt.mqttBroker.mqttws)
+	}
+	return addrs
+}
+
+// Drain announces the draining status right away, the peers stop picking this instance
+// while the running requests are still served. Stop drains the service as well,
+// call Drain and wait for the peers to notice before Stop for a zero downtime rolling upgrade.
+func (s *Service) Drain() error {
+	if !s.opt.discover.enable {
+		return nil
+	}
+	return s.opt.discover.drain()
+}
+
+// WatchServices returns a channel which receives the changes of the instances of name,
+// or of all services when name is empty. The current instances are sent as ServiceAdded first,
+// then the changes are checked every second. The channel is closed when ctx is done or the service is stopped.
+//
+// The events should be read promptly, the events are dropped and a warning is logged when the buffer of the channel is full.
+func (s *Service) WatchServices(ctx context.Context, name string) <-chan ServiceEvent {
+	ctx, cancel := context.WithCancel(ctx)
+	if !s.opt.discover.enable {
+		cancel()
+		ch := make(chan ServiceEvent)
+		close(ch)
+		return ch
+	}
+	context.AfterFunc(s.closeCtx, cancel)
+	return s.opt.discover.watch(ctx, name)
 }
 
 func (s *Service) PickAll() map[string]string {
-	var ss map[string]string
+	ss := make(map[string]string)
+	if s.opt.discover.ready() != nil {
+		return ss
+	}
+	s.opt.discover.infosMu.RLock()
+	defer s.opt.discover.infosMu.RUnlock()
 	s.opt.discover.infos.ForEach(func(key string, value svrinfo) bool {
 		ss[key] = value.Json()
 		return true
@@ -33,6 +141,153 @@ func (s *Service) PickAll() map[string]string {
 	return ss
 }
 
+// CallService sends a request to an instance of name, which is picked from the instances registered an https or http address,
+// path is appended to the root path of the instance, and the response is returned as DoRequestCtx.
+//
+// When the connection to the instance fails, the request is sent to another instance, up to 3 instances are tried,
+// the requests of idempotent methods, such as GET and PUT, are sent again after the other errors as well.
+// An instance which fails 3 times in a row is not picked for 30 seconds, unless all instances are failing.
+// The filters carried by ctx are applied, see ContextWithPickFilters.
+func (s *Service) CallService(ctx context.Context, name, method, path string, body []byte, opts ...httpclient.ReqOpts) (int, []byte, map[string]string, error) {
+	if err := s.opt.discover.ready(); err != nil {
+		return http.StatusServiceUnavailable, nil, nil, err
+	}
+	ss := filterInstances(s.opt.discover.lookup(name, ProtocolHTTPS, ProtocolHTTP), s.opt.discover.svrInfo, pickFiltersFromContext(ctx))
+	if len(ss) == 0 {
+		return http.StatusServiceUnavailable, nil, nil, errors.New("service not found")
+	}
+	var lastErr error
+	for range min(len(ss), callTries) {
+		x := s.opt.discover.picker.pick(s.live.Load().strategy, pickCounter(name, ProtocolHTTP), "", s.opt.discover.picker.healthy(ss))
+		ss = slices.DeleteFunc(ss, func(v instance) bool { return v.addr == x.addr })
+		req, err := http.NewRequest(method, x.url(path), bytes.NewReader(body))
+		if err != nil {
+			return http.StatusBadRequest, nil, nil, errors.New("[discover] create request error:" + err.Error())
+		}
+		code, b, h, err := s.DoRequestCtx(ctx, req, opts...)
+		if err == nil {
+			s.opt.discover.picker.report(x.addr, false)
+			return code, b, h, nil
+		}
+		if ctx.Err() != nil {
+			return code, b, h, err
+		}
+		s.opt.discover.picker.report(x.addr, true)
+		if !retryable(method, err) {
+			return code, b, h, err
+		}
+		lastErr = err
+	}
+	return http.StatusBadGateway, nil, nil, errors.New("[discover] call " + name + " failed:" + lastErr.Error())
+}
+
+// retryable reports whether a failed request can be sent to another instance,
+// which is true when the connection is not established, so the request is not sent,
+// or the method is idempotent.
+func retryable(method string, err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "dial" {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// DoRequest sends the request with the http client,
+// the trace context of req.Context() is sent in the traceparent header.
 func (s *Service) DoRequest(req *http.Request, opts ...httpclient.ReqOpts) (int, []byte, map[string]string, error) {
-	return s.httpcli.DoRequest(req, opts...)
+	return s.DoRequestCtx(req.Context(), req, opts...)
+}
+
+// DoRequestCtx sends the request with the http client, the request is cancelled when ctx is done,
+// the trace context of ctx is sent in the traceparent header.
+// The options are the ones of the toolbox http client, the default timeout is 10 seconds.
+func (s *Service) DoRequestCtx(ctx context.Context, req *http.Request, opts ...httpclient.ReqOpts) (int, []byte, map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return http.StatusBadGateway, nil, nil, err
+	}
+	timeout, notLog := reqOptions(opts...)
+	ctx, span := s.tracer.start(ctx, req.Method, SpanKindClient)
+	span.SetAttr("http.request.method", req.Method)
+	span.SetAttr("url.full", req.URL.String())
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req = req.Clone(tctx)
+	if tp := Traceparent(ctx); tp != "" {
+		req.Header.Set(TraceparentHeader, tp)
+	}
+	code, b, h, err := s.sendRequest(req, notLog)
+	span.SetAttr("http.response.status_code", strconv.Itoa(code))
+	if err == nil && code >= http.StatusBadRequest {
+		span.SetError(errors.New(http.StatusText(code)))
+	}
+	span.SetError(err)
+	span.Finish()
+	return code, b, h, err
+}
+
+// sendRequest sends req bound to its context, the response and the logs are the same as the toolbox http client
+func (s *Service) sendRequest(req *http.Request, notLog bool) (int, []byte, map[string]string, error) {
+	if req.Header.Get("Content-Type") == "" {
+		switch req.Method {
+		case http.MethodGet:
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		case http.MethodPost:
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	start := time.Now()
+	resp, err := s.httpcli.Do(req)
+	if err != nil {
+		s.opt.logg.Error("REQ ERR:" + fmt.Sprintf("%s %s>%s", req.Method, req.URL.String(), err.Error()))
+		return http.StatusBadGateway, nil, nil, err
+	}
+	defer resp.Body.Close()
+	sc := resp.StatusCode
+	if sc >= http.StatusBadRequest {
+		s.opt.logg.Warning("REQ NOT OK:" + fmt.Sprintf("%s %s>%d", req.Method, req.URL.String(), sc))
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.opt.logg.Error("RESP READ ERR:" + fmt.Sprintf("%s %s>%s", req.Method, req.URL.String(), err.Error()))
+		return sc, nil, nil, err
+	}
+	h := make(map[string]string)
+	h[httpclient.HEADER_RESP_FROM] = req.Host
+	h[httpclient.HEADER_RESP_DURATION] = time.Since(start).String()
+	for k := range resp.Header {
+		h[k] = resp.Header.Get(k)
+	}
+	if !notLog {
+		s.opt.logg.Info("REQ:" + fmt.Sprintf("|%d| %-13s |%s %s>%s", sc, h[httpclient.HEADER_RESP_DURATION], req.Method, req.URL.String(), json.String(b)))
+	}
+	return sc, b, h, nil
+}
+
+// reqOptions returns the timeout and the log switch of opts, the toolbox keeps the fields of httpclient.ReqOpt unexported
+func reqOptions(opts ...httpclient.ReqOpts) (time.Duration, bool) {
+	o := httpclient.ReqOpt{}
+	httpclient.OptTimeout(time.Second * 10)(&o)
+	for _, f := range opts {
+		f(&o)
+	}
+	v := reflect.ValueOf(o)
+	return time.Duration(v.FieldByName("timeout").Int()), v.FieldByName("notLog").Bool()
+}
+
+// newHTTPClient returns the client of DoRequestCtx, the transport has the same settings as the toolbox http client
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			IdleConnTimeout:     time.Second * 10,
+			MaxConnsPerHost:     777,
+			MaxIdleConns:        1,
+			MaxIdleConnsPerHost: 1,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		},
+	}
 }
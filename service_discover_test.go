@@ -0,0 +1,188 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xyzj/toolbox/cache"
+	"github.com/xyzj/toolbox/httpclient"
+	"github.com/xyzj/toolbox/logger"
+)
+
+// testCallService returns a service whose discover lists addrs as the instances of svc
+func testCallService(t *testing.T, addrs ...string) *Service {
+	t.Helper()
+	s, err := New(WithLogger(logger.NewNilLogger()), WithDiscover(OptDiscoverInfo("", "", "", "/test-root", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.opt.discover.infos = cache.NewAnyCache[svrinfo](time.Minute)
+	t.Cleanup(s.opt.discover.infos.Close)
+	for i, a := range addrs {
+		s.opt.discover.infos.Store("svc-"+strconv.Itoa(i), svrinfo{SvrName: "svc", RegisterAddress: map[ProtocolType]string{ProtocolHTTP: a}})
+	}
+	s.opt.discover.started.Store(true)
+	return s
+}
+
+// testCallServer returns the address of a server which counts the requests in hits,
+// a hangup server closes the connection without a response.
+func testCallServer(t *testing.T, hangup bool, hits *atomic.Int32) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if hangup {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestCallServiceRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		servers string // d: 无法连接, h: 断开连接, o: 正常
+		code    int
+		ok      int32 // 正常实例收到的请求数
+		hangup  int32 // 断开连接的实例收到的请求数, -1 为不检查
+	}{
+		{"get dial error", http.MethodGet, "ddo", http.StatusOK, 1, 0},
+		{"post dial error", http.MethodPost, "do", http.StatusOK, 1, 0},
+		{"get hangup", http.MethodGet, "hho", http.StatusOK, 1, -1},
+		{"post hangup", http.MethodPost, "hh", http.StatusBadGateway, 0, 1},
+		{"all failed", http.MethodGet, "hhhh", http.StatusBadGateway, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ok, hangup atomic.Int32
+			addrs := make([]string, 0, len(tt.servers))
+			for _, c := range tt.servers {
+				switch c {
+				case 'd':
+					addrs = append(addrs, freeAddr(t))
+				case 'h':
+					addrs = append(addrs, testCallServer(t, true, &hangup))
+				default:
+					addrs = append(addrs, testCallServer(t, false, &ok))
+				}
+			}
+			s := testCallService(t, addrs...)
+			code, b, _, err := s.CallService(context.Background(), "svc", tt.method, "/x", nil)
+			if code != tt.code {
+				t.Fatalf("code %d, error %v", code, err)
+			}
+			if (err == nil) != (tt.code == http.StatusOK) {
+				t.Fatalf("error %v", err)
+			}
+			if err == nil && string(b) != "ok" {
+				t.Fatalf("body %s", b)
+			}
+			if ok.Load() != tt.ok || (tt.hangup >= 0 && hangup.Load() != tt.hangup) {
+				t.Fatalf("requests ok %d, hangup %d", ok.Load(), hangup.Load())
+			}
+		})
+	}
+}
+
+func TestCallServiceEject(t *testing.T) {
+	var hitA, hitB atomic.Int32
+	a := testCallServer(t, false, &hitA)
+	b := testCallServer(t, false, &hitB)
+	s := testCallService(t, a, b)
+	for range ejectFailures {
+		s.opt.discover.picker.report(a, true)
+	}
+	for range 4 {
+		if code, _, _, err := s.CallService(context.Background(), "svc", http.MethodGet, "/x", nil); err != nil || code != http.StatusOK {
+			t.Fatalf("code %d, error %v", code, err)
+		}
+	}
+	if hitA.Load() != 0 || hitB.Load() != 4 {
+		t.Fatalf("requests a %d, b %d", hitA.Load(), hitB.Load())
+	}
+	// 全部实例暂停使用时仍然选择
+	for range ejectFailures {
+		s.opt.discover.picker.report(b, true)
+	}
+	for range 4 {
+		if code, _, _, err := s.CallService(context.Background(), "svc", http.MethodGet, "/x", nil); err != nil || code != http.StatusOK {
+			t.Fatalf("code %d, error %v", code, err)
+		}
+	}
+	if hitA.Load()+hitB.Load() != 8 {
+		t.Fatalf("requests a %d, b %d", hitA.Load(), hitB.Load())
+	}
+}
+
+func TestPickAllWhileRead(t *testing.T) {
+	s := testCallService(t, "127.0.0.1:1")
+	name := filepath.Join(t.TempDir(), "instances.yaml")
+	if err := os.WriteFile(name, []byte("- name: svc\n  address:\n    http: http://127.0.0.1:1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s.opt.discover.backend = NewStaticBackend(name)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			if err := s.opt.discover.read(ctx, logger.NewNilLogger()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	// 缓存中的实例被原地更新
+	for end := time.Now().Add(time.Second); time.Now().Before(end); {
+		for _, v := range s.PickAll() {
+			if v == "" {
+				t.Fatal("empty info")
+			}
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestDoRequestCtxCancel(t *testing.T) {
+	s := testCallService(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	t1 := time.Now()
+	if _, _, _, err := s.DoRequestCtx(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v", err)
+	}
+	// 请求选项中的超时同样生效
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, _, _, err := s.DoRequestCtx(context.Background(), req, httpclient.OptTimeout(time.Millisecond*200)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v", err)
+	}
+	if d := time.Since(t1); d > time.Second*2 {
+		t.Fatalf("requests are not cancelled, took %s", d)
+	}
+}
@@ -0,0 +1,54 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+)
+
+// Campaign joins the election of name with the other instances which use the same redis,
+// and returns the leadership of this instance. Only one instance is the leader at a time,
+// the leader holds a lease of 10 seconds in redis, which is renewed every few seconds.
+// Every term gets a new fencing token, see Leadership.Token.
+//
+// The campaign is stopped when ctx is done, Resign is called, or the service is stopped.
+func (s *Service) Campaign(ctx context.Context, name string) (*Leadership, error) {
+	if err := electionName(name); err != nil {
+		return nil, err
+	}
+	if !s.opt.cliredis.enable {
+		return nil, errors.New("[election] redis client is not enabled")
+	}
+	id, root := newInstanceID(), ""
+	if s.opt.discover.enable {
+		root = s.opt.discover.svrInfo.RootPath
+		if s.opt.discover.svrInfo.InstanceID != "" {
+			id = s.opt.discover.svrInfo.InstanceID
+		}
+	}
+	return s.campaign(ctx, name, newRedisElector(&s.opt.cliredis, root, name, id)), nil
+}
+
+// CampaignLocal joins the election of name with the other processes on the same host,
+// the leader holds the lock of the bolt file at path, use a file for each election.
+// The lock is released by the system when the leader exits.
+func (s *Service) CampaignLocal(ctx context.Context, name, path string) (*Leadership, error) {
+	if err := electionName(name); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, errors.New("[election] path is empty")
+	}
+	return s.campaign(ctx, name, &boltElector{path: path, name: []byte(name)}), nil
+}
+
+func (s *Service) campaign(ctx context.Context, name string, el elector) *Leadership {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.closeCtx, cancel)
+	e := startCampaign(ctx, name, el, s.opt.logg)
+	go func() {
+		<-e.done
+		stop()
+		cancel()
+	}()
+	return e
+}
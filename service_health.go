@@ -0,0 +1,130 @@
+package gofactory
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ComponentStatus is the live status of one enabled component.
+type ComponentStatus struct {
+	Component Component `json:"component"`
+	Name      string    `json:"name,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Ready     bool      `json:"ready"`
+	Optional  bool      `json:"optional,omitempty"`
+}
+
+// HealthReport returns the live status of every enabled component, the databases are pinged.
+func (s *Service) HealthReport() []ComponentStatus {
+	st := make([]ComponentStatus, 0)
+	fAdd := func(c ComponentStatus) {
+		c.Optional = s.live.Load().optional[c.Component]
+		st = append(st, c)
+	}
+	// services
+	if s.opt.tcpServer.enable {
+		fAdd(ComponentStatus{Component: ComponentTCP, Name: s.opt.tcpServer.bind, Ready: s.tcpUp.Load()})
+	}
+	if s.opt.mqttBroker.enable {
+		fAdd(ComponentStatus{Component: ComponentMQTTBroker, Name: s.opt.mqttBroker.mqtt, Ready: s.brokerUp.Load()})
+	}
+	if s.opt.webServer.enable {
+		fAdd(ComponentStatus{Component: ComponentWeb, Name: s.opt.webServer.bind, Ready: s.webUp.Load()})
+	}
+	// clients
+	if s.opt.discover.enable {
+		c := ComponentStatus{Component: ComponentDiscover, Name: s.opt.discover.svrInfo.SvrName}
+		st := s.opt.discover.status()
+		if t := s.opt.discover.published.Load(); t > 0 {
+			c.Detail = string(st) + ", last publish at " + time.Unix(t, 0).Format("2006-01-02 15:04:05")
+			c.Ready = time.Since(time.Unix(t, 0)) <= s.opt.discover.infoTimeout && st != StatusDraining && st != StatusLeaving
+		} else {
+			c.Detail = "not published yet"
+		}
+		fAdd(c)
+	}
+	if s.opt.cliredis.enable {
+		fAdd(ComponentStatus{Component: ComponentRedis, Name: s.opt.cliredis.endpoint(), Ready: s.opt.cliredis.loaded.Load()})
+	}
+	if s.opt.climqtt.enable {
+		fAdd(ComponentStatus{Component: ComponentMQTT, Name: s.opt.climqtt.addr, Ready: s.opt.climqtt.client() != nil && s.opt.climqtt.client().IsConnectionOpen()})
+	}
+	if s.opt.clirmq.enable {
+		if s.opt.clirmq.enableP {
+			fAdd(ComponentStatus{Component: ComponentRMQ, Name: "producer", Ready: s.opt.clirmq.clip != nil && s.opt.clirmq.clip.Enable()})
+		}
+		if s.opt.clirmq.enableC {
+			fAdd(ComponentStatus{Component: ComponentRMQ, Name: "consumer", Ready: s.opt.clirmq.clic != nil && s.opt.clirmq.clic.Enable()})
+		}
+	}
+	if s.opt.clidb.enable {
+		if s.dbcli == nil {
+			fAdd(ComponentStatus{Component: ComponentDB, Detail: "not connected"})
+		} else {
+			// ping the databases at the same time, or a slow one delays the others
+			cs := make([]ComponentStatus, s.dbcli.MaxDBIdx())
+			wg := sync.WaitGroup{}
+			for i := range cs {
+				cs[i] = ComponentStatus{Component: ComponentDB, Name: strconv.Itoa(i+1) + ":" + s.dbcli.GetName(i+1)}
+				wg.Add(1)
+				go func(c *ComponentStatus, dbidx int) {
+					defer wg.Done()
+					if err := s.pingDB(dbidx); err != nil {
+						c.Detail = err.Error()
+					} else {
+						c.Ready = true
+					}
+				}(&cs[i], i+1)
+			}
+			wg.Wait()
+			for _, c := range cs {
+				fAdd(c)
+			}
+		}
+	}
+	if s.opt.boltname != "" {
+		fAdd(ComponentStatus{Component: ComponentBolt, Name: s.opt.boltname, Ready: s.boltcli != nil})
+	}
+	return st
+}
+
+func (s *Service) pingDB(dbidx int) error {
+	d, err := s.dbcli.SQLDB(dbidx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	return d.PingContext(ctx)
+}
+
+// healthz responds 200 while the process is alive, the components are reported but only checked by readyz.
+func (s *Service) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "ok",
+		"components": s.HealthReport(),
+	})
+}
+
+// readyz responds 503 while any required component is down.
+func (s *Service) readyz(c *gin.Context) {
+	st := s.HealthReport()
+	for _, v := range st {
+		if !v.Ready && !v.Optional {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":     "not ready",
+				"components": st,
+			})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "ready",
+		"components": st,
+	})
+}
@@ -0,0 +1,36 @@
+package gofactory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/toolbox/logger"
+)
+
+func TestHealthz(t *testing.T) {
+	s, err := New(WithLogger(logger.NewNilLogger()), WithMqttClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		name string
+		h    gin.HandlerFunc
+		code int
+		body string
+	}{
+		// 组件未就绪不影响存活状态
+		{name: "healthz", h: s.healthz, code: http.StatusOK, body: `"ready":false}],"status":"ok"`},
+		// mqtt客户端未连接
+		{name: "readyz", h: s.readyz, code: http.StatusServiceUnavailable, body: `"component":"mqtt"`},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		v.h(c)
+		if w.Code != v.code || !strings.Contains(w.Body.String(), v.body) {
+			t.Fatalf("%s: %d %s", v.name, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/xyzj/deepcopy"
+	mqtt "github.com/xyzj/mqtt-server"
+	"github.com/xyzj/mqtt-server/packets"
+	"github.com/xyzj/toolbox/mq"
+	"github.com/xyzj/toolbox/tcpfactory"
+)
+
+// serviceMetrics holds the metrics of all built-in components.
+type serviceMetrics struct {
+	reg          *metricRegistry
+	httpRequests *metricFamily
+	httpDuration *metricFamily
+	tcpConns     *metricFamily
+	tcpAccepted  *metricFamily
+	tcpRecv      *metricFamily
+	tcpSent      *metricFamily
+	tcpWritten   *metricFamily
+	tcpMatched   *metricFamily
+	mqttPublish  *metricFamily
+	redisLatency *metricFamily
+	redisErrors  *metricFamily
+	dbLatency    *metricFamily
+	dbErrors     *metricFamily
+	brokerStats  sync.Map     // $SYS/broker/... -> float64
+	server       *http.Server // 独立的metrics服务，未启用web服务时使用
+}
+
+func (s *Service) initMetrics() {
+	r := &metricRegistry{}
+	m := &serviceMetrics{
+		reg:          r,
+		httpRequests: r.counter("gofactory_http_requests_total", "Total number of http requests.", "method", "route", "code"),
+		httpDuration: r.histogram("gofactory_http_request_duration_seconds", "Latency of http requests.", defaultBuckets, "method", "route"),
+		tcpConns:     r.gauge("gofactory_tcp_connections", "Number of open tcp connections."),
+		tcpAccepted:  r.counter("gofactory_tcp_connections_total", "Total number of accepted tcp connections."),
+		tcpRecv:      r.counter("gofactory_tcp_received_bytes_total", "Total bytes received by the tcp server."),
+		tcpSent:      r.counter("gofactory_tcp_sent_bytes_total", "Total bytes of the hello and reply messages queued to send by the tcp server."),
+		tcpWritten:   r.counter("gofactory_tcp_write_bytes_total", "Total bytes written with TcpWrite, counted once for all the matched connections."),
+		tcpMatched:   r.counter("gofactory_tcp_write_matched_total", "Total number of connections matched by TcpWrite."),
+		// the mqtt client does not expose the length of its resend cache, the cached publishes are counted by result
+		mqttPublish:  r.counter("gofactory_mqtt_publish_total", "Total number of mqtt client publishes by result.", "result"),
+		redisLatency: r.histogram("gofactory_redis_command_duration_seconds", "Latency of redis commands.", defaultBuckets, "command"),
+		redisErrors:  r.counter("gofactory_redis_errors_total", "Total number of failed redis commands.", "command"),
+		dbLatency:    r.histogram("gofactory_db_duration_seconds", "Latency of db queries and executions.", defaultBuckets, "op", "db"),
+		dbErrors:     r.counter("gofactory_db_errors_total", "Total number of failed db queries and executions.", "op", "db"),
+	}
+	// mqtt broker, values are read from the $SYS topics
+	for _, v := range []struct {
+		kind  metricKind
+		name  string
+		help  string
+		topic string
+	}{
+		{kindGauge, "gofactory_mqtt_broker_clients_connected", "Number of clients connected to the mqtt broker.", "clients/connected"},
+		{kindGauge, "gofactory_mqtt_broker_clients_total", "Number of connected and persistent clients of the mqtt broker.", "clients/total"},
+		{kindGauge, "gofactory_mqtt_broker_subscriptions", "Number of active subscriptions on the mqtt broker.", "subscriptions"},
+		{kindGauge, "gofactory_mqtt_broker_retained", "Number of retained messages on the mqtt broker.", "retained"},
+		{kindCounter, "gofactory_mqtt_broker_messages_received_total", "Total publish messages received by the mqtt broker.", "messages/received"},
+		{kindCounter, "gofactory_mqtt_broker_messages_sent_total", "Total publish messages sent by the mqtt broker.", "messages/sent"},
+		{kindCounter, "gofactory_mqtt_broker_messages_dropped_total", "Total publish messages dropped by the mqtt broker.", "messages/dropped"},
+		{kindCounter, "gofactory_mqtt_broker_received_bytes_total", "Total bytes received by the mqtt broker.", "load/bytes/received"},
+		{kindCounter, "gofactory_mqtt_broker_sent_bytes_total", "Total bytes sent by the mqtt broker.", "load/bytes/sent"},
+	} {
+		topic := v.topic
+		r.collector(v.kind, v.name, v.help, func(emit func(v float64, lvs ...string)) {
+			if x, ok := m.brokerStats.Load(topic); ok {
+				emit(x.(float64))
+			}
+		})
+	}
+	r.collector(kindGauge, "gofactory_discover_peers", "Number of discovered service instances by name.", func(emit func(v float64, lvs ...string)) {
+		if s.opt.discover.ready() != nil {
+			return
+		}
+		c := make(map[string]int)
+		for _, v := range s.opt.discover.snapshotInfos() {
+			c[v.SvrName]++
+		}
+		for k, v := range c {
+			emit(float64(v), k)
+		}
+	}, "name")
+	s.metrics = m
+}
+
+// MetricsHandler returns the handler which writes all metrics in the prometheus text format.
+// It is served at /metrics on the web server, or on the WithMetrics address when the web server is not enabled.
+func (s *Service) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.metrics.reg.writeTo(w)
+	})
+}
+
+// observeHTTP records a http request of route, which is "unmatched" when no route handles it
+func (m *serviceMetrics) observeHTTP(method, route string, status int, d time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	m.httpRequests.add(1, method, route, strconv.Itoa(status))
+	m.httpDuration.observe(d.Seconds(), method, route)
+}
+
+// startMetrics serves the metrics on a separate address, used when the web server is not enabled.
+func (s *Service) startMetrics() error {
+	ln, err := net.Listen("tcp", s.opt.metricsBind)
+	if err != nil {
+		return errors.New("[metrics] listen error:" + err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	s.metrics.server = &http.Server{
+		Handler:     mux,
+		ReadTimeout: time.Second * 10,
+		IdleTimeout: time.Second * 60,
+	}
+	go func() {
+		s.opt.logg.System("[metrics] http listening to " + s.opt.metricsBind)
+		if err := s.metrics.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.opt.logg.Error("[metrics] serve failed:" + err.Error())
+		}
+	}()
+	return nil
+}
+
+// watchBroker reads the broker statistics from the $SYS topics, it needs the inline client of the broker.
+func (s *Service) watchBroker() {
+	if !s.opt.mqttBroker.insidejob {
+		s.opt.logg.Warning("[metrics] mqtt broker metrics need OptMqttInsideClient(true)")
+		return
+	}
+	err := s.mqttbroker.Subscribe("$SYS/broker/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		v, err := strconv.ParseFloat(string(pk.Payload), 64)
+		if err != nil {
+			return
+		}
+		s.metrics.brokerStats.Store(strings.TrimPrefix(pk.TopicName, "$SYS/broker/"), v)
+	})
+	if err != nil {
+		s.opt.logg.Error("[metrics] subscribe mqtt broker $SYS topics error:" + err.Error())
+	}
+}
+
+// mqttPublished records the result of a mqtt client publish
+func (m *serviceMetrics) mqttPublished(err error) {
+	switch {
+	case err == nil:
+		m.mqttPublish.add(1, "success")
+	case errors.Is(err, mq.ErrorResendCache):
+		m.mqttPublish.add(1, "cached")
+	default:
+		m.mqttPublish.add(1, "failure")
+	}
+}
+
+// observeDB records the latency of a db query or execution
+func (m *serviceMetrics) observeDB(op string, dbidx int, t time.Time, err error) {
+	idx := "default"
+	if dbidx > 0 {
+		idx = strconv.Itoa(dbidx)
+	}
+	m.dbLatency.observe(time.Since(t).Seconds(), op, idx)
+	if err != nil {
+		m.dbErrors.add(1, op, idx)
+	}
+}
+
+func sendSize(msgs []*tcpfactory.SendMessage) int {
+	n := 0
+	for _, v := range msgs {
+		if v != nil {
+			n += len(v.Data)
+		}
+	}
+	return n
+}
+
+// tcpClient wraps c to record the connections and traffic of the tcp server
+func (m *serviceMetrics) tcpClient(c tcpfactory.Client, hello []*tcpfactory.SendMessage) tcpfactory.Client {
+	return &tcpMetricsClient{
+		Client: c,
+		m:      m,
+		hello:  sendSize(hello),
+	}
+}
+
+// tcpMetricsClient is copied for every connection by the tcp server,
+// DeepCopy keeps the shared metrics in the copies.
+type tcpMetricsClient struct {
+	tcpfactory.Client
+	m       *serviceMetrics
+	hello   int
+	pending int // 上次未处理完的数据长度，会随新数据再次传入
+}
+
+func (c *tcpMetricsClient) DeepCopy() any {
+	return &tcpMetricsClient{
+		Client: deepcopy.CopyAny(c.Client),
+		m:      c.m,
+		hello:  c.hello,
+	}
+}
+
+func (c *tcpMetricsClient) OnConnect(conn *net.TCPConn) {
+	c.pending = 0
+	c.m.tcpConns.add(1)
+	c.m.tcpAccepted.add(1)
+	if c.hello > 0 {
+		c.m.tcpSent.add(float64(c.hello))
+	}
+	c.Client.OnConnect(conn)
+}
+
+func (c *tcpMetricsClient) OnDisconnect(reason string) {
+	c.m.tcpConns.add(-1)
+	c.Client.OnDisconnect(reason)
+}
+
+func (c *tcpMetricsClient) OnRecive(data []byte) ([]byte, []*tcpfactory.SendMessage) {
+	c.m.tcpRecv.add(float64(max(len(data)-c.pending, 0)))
+	unfinish, echo := c.Client.OnRecive(data)
+	c.pending = len(unfinish)
+	if n := sendSize(echo); n > 0 {
+		c.m.tcpSent.add(float64(n))
+	}
+	return unfinish, echo
+}
+
+// MatchTarget counts the connections matched by TcpWrite
+func (c *tcpMetricsClient) MatchTarget(target string) bool {
+	if !c.Client.MatchTarget(target) {
+		return false
+	}
+	c.m.tcpMatched.add(1)
+	return true
+}
+
+// redisHook records the latency and errors of every redis command,
+// and traces the commands called with a span in ctx.
+type redisHook struct {
+	s *Service
+}
+
+func (h redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := h.s.startChildSpan(ctx, "redis "+cmd.Name(), SpanKindClient)
+		t := time.Now()
+		err := next(ctx, cmd)
+		h.observe(cmd.Name(), t, err, span)
+		return err
+	}
+}
+
+func (h redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, span := h.s.startChildSpan(ctx, "redis pipeline", SpanKindClient)
+		t := time.Now()
+		err := next(ctx, cmds)
+		h.observe("pipeline", t, err, span)
+		return err
+	}
+}
+
+func (h redisHook) observe(cmd string, t time.Time, err error, span *Span) {
+	h.s.metrics.redisLatency.observe(time.Since(t).Seconds(), cmd)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.s.metrics.redisErrors.add(1, cmd)
+		span.SetError(err)
+	}
+	span.SetAttr("db.system", "redis")
+	span.SetAttr("db.operation.name", cmd)
+	span.Finish()
+}
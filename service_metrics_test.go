@@ -0,0 +1,176 @@
+package gofactory
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/tcpfactory"
+)
+
+// newTestService returns a service without servers, the spans are exported to exp when it is not nil
+func newTestService(t *testing.T, exp SpanExporter) *Service {
+	t.Helper()
+	opts := []Opts{WithLogger(logger.NewNilLogger())}
+	if exp != nil {
+		opts = append(opts, WithTracing(exp, 1))
+	}
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.stopTracer(context.Background()) })
+	return s
+}
+
+// newTestWeb serves the routes of the engine made by f as the web server of s does
+func newTestWeb(t *testing.T, s *Service, f func(e *gin.Engine)) *httptest.Server {
+	t.Helper()
+	w := webSvr{engineFunc: f}
+	h, err := w.buildRoutes([]gin.HandlerFunc{s.webMiddleware}, map[string]gin.HandlerFunc{
+		"/metrics": gin.WrapH(s.MetricsHandler()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testTCPClient matches the target "test"
+type testTCPClient struct {
+	tcpfactory.EmptyClient
+}
+
+func (c *testTCPClient) MatchTarget(target string) bool {
+	return target == "test"
+}
+
+// scrapeMetrics returns the lines of the metrics served at url
+func scrapeMetrics(t *testing.T, url string) []string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %s", ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(b), "\n")
+}
+
+func hasLine(ss []string, line string) bool {
+	for _, v := range ss {
+		if v == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetricsHTTP(t *testing.T) {
+	s := newTestService(t, nil)
+	// 用户在engine中注册的路由
+	srv := newTestWeb(t, s, func(e *gin.Engine) {
+		e.GET("/user/:id", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+		e.GET("/user/me", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	})
+	for _, p := range []string{"/user/1", "/user/2", "/user/me", "/nope"} {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	ss := scrapeMetrics(t, srv.URL+"/metrics")
+	for _, v := range []string{
+		"# TYPE gofactory_http_requests_total counter",
+		`gofactory_http_requests_total{method="GET",route="/user/:id",code="200"} 2`,
+		`gofactory_http_requests_total{method="GET",route="/user/me",code="500"} 1`,
+		`gofactory_http_requests_total{method="GET",route="unmatched",code="404"} 1`,
+		"# TYPE gofactory_http_request_duration_seconds histogram",
+		`gofactory_http_request_duration_seconds_count{method="GET",route="/user/:id"} 2`,
+		`gofactory_http_request_duration_seconds_bucket{method="GET",route="/user/:id",le="+Inf"} 2`,
+	} {
+		if !hasLine(ss, v) {
+			t.Errorf("no line %s in:\n%s", v, strings.Join(ss, "\n"))
+		}
+	}
+}
+
+func TestMetricsTCP(t *testing.T) {
+	s := newTestService(t, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	hello := []*tcpfactory.SendMessage{{Data: []byte("hello")}}
+	o := tcpSvr{
+		bind:          addr,
+		enable:        true,
+		readTimeout:   time.Second * 5,
+		helloMessages: hello,
+		client:        s.metrics.tcpClient(&testTCPClient{}, hello),
+	}
+	s.tcpserver, err = o.build(logger.NewNilLogger(), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.tcpserver.Listen()
+	<-o.listening
+	defer s.tcpserver.Shutdown()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("abc"))
+	buf := make([]byte, 5)
+	c.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	s.TcpWrite("test", &tcpfactory.SendMessage{Data: []byte("xyzw")})
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"gofactory_tcp_connections 1",
+		"gofactory_tcp_connections_total 1",
+		"gofactory_tcp_received_bytes_total 3",
+		"gofactory_tcp_sent_bytes_total 5",
+		"gofactory_tcp_write_bytes_total 4",
+		"gofactory_tcp_write_matched_total 1",
+	}
+	var ss []string
+	// 接收在另一个协程中记录
+	for range 50 {
+		b := &strings.Builder{}
+		s.metrics.reg.writeTo(b)
+		ss = strings.Split(b.String(), "\n")
+		if hasLine(ss, want[2]) {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	for _, v := range want {
+		if !hasLine(ss, v) {
+			t.Errorf("no line %s in:\n%s", v, strings.Join(ss, "\n"))
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package gofactory
 
 import (
+	"context"
+	"errors"
 	"time"
 
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/xyzj/mqtt-server"
 )
 
@@ -15,9 +18,74 @@ func (s *Service) MqttBrokerSubscribe(topic string, subscriptionId int, handler
 }
 
 func (s *Service) MqttWrite(topic string, body []byte, qos byte) error {
-	return s.opt.climqtt.cli.WriteWithQos(topic, body, qos)
+	return s.MqttWriteCtx(context.Background(), topic, body, qos)
 }
 
+// MqttWriteCtx publishes a message with the mqtt client, the publish is recorded in a producer span of ctx.
+// Nothing is sent when ctx is done already, when the client is not connected
+// the message goes to the resend cache of the client instead.
+// The traceparent is not sent, the mqtt client does not take the user properties of a publish.
+func (s *Service) MqttWriteCtx(ctx context.Context, topic string, body []byte, qos byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, span := s.tracer.start(ctx, "mqtt publish "+topic, SpanKindProducer)
+	span.SetAttr("messaging.system", "mqtt")
+	span.SetAttr("messaging.destination.name", topic)
+	var err error
+	if cli := s.opt.climqtt.client(); cli == nil {
+		err = errors.New("[mqtt] client not started")
+	} else {
+		err = cli.WriteWithQos(topic, body, qos)
+	}
+	s.metrics.mqttPublished(err)
+	span.SetError(err)
+	span.Finish()
+	return err
+}
+
+// RMQWrite queues a message as RMQWriteCtx, the message is dropped when the producer is not connected
 func (s *Service) RMQWrite(topic string, body []byte, expire time.Duration) {
-	s.opt.clirmq.clip.Send(topic, body, expire)
+	if err := s.RMQWriteCtx(context.Background(), topic, body, expire); err != nil {
+		s.opt.logg.Debug("[rmq-p] S Err:" + topic + " | " + err.Error())
+	}
+}
+
+// RMQWriteCtx queues a message to the rmq producer,
+// the trace context of ctx is sent in the traceparent header.
+// An error is returned when the producer is not connected, or ctx is done before the message is queued,
+// the queued message which fails to be sent is sent again after the producer reconnects.
+func (s *Service) RMQWriteCtx(ctx context.Context, topic string, body []byte, expire time.Duration) error {
+	ctx, span := s.tracer.start(ctx, "rmq publish "+topic, SpanKindProducer)
+	span.SetAttr("messaging.system", "rabbitmq")
+	span.SetAttr("messaging.destination.name", topic)
+	var h amqp.Table
+	if tp := Traceparent(ctx); tp != "" {
+		h = amqp.Table{TraceparentHeader: tp}
+	}
+	err := s.opt.clirmq.clip.SendCtx(ctx, topic, body, expire, h)
+	span.SetError(err)
+	span.Finish()
+	return err
+}
+
+// rmqReceived calls the receive func of the rmq consumer in a consumer span,
+// which continues the trace of the traceparent header of d.
+func (s *Service) rmqReceived(d *amqp.Delivery) {
+	ctx := context.Background()
+	if tp, ok := d.Headers[TraceparentHeader].(string); ok {
+		if sc, ok := ParseTraceparent(tp); ok {
+			ctx = ContextWithSpanContext(ctx, sc)
+		}
+	}
+	ctx, span := s.tracer.start(ctx, "rmq receive "+d.RoutingKey, SpanKindConsumer)
+	span.SetAttr("messaging.system", "rabbitmq")
+	span.SetAttr("messaging.destination.name", d.RoutingKey)
+	defer span.Finish()
+	switch {
+	case s.opt.clirmq.recvCtxFunc != nil:
+		s.opt.clirmq.recvCtxFunc(ctx, d.RoutingKey, d.Body)
+	case s.opt.clirmq.recvFunc != nil:
+		s.opt.clirmq.recvFunc(d.RoutingKey, d.Body)
+	}
 }
@@ -4,14 +4,21 @@ import (
 	"context"
 	"errors"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 func (s *Service) RedisReadKeys(key string) ([]string, error) {
+	return s.RedisReadKeysCtx(context.Background(), key)
+}
+
+// RedisReadKeysCtx returns the keys matching the pattern key
+func (s *Service) RedisReadKeysCtx(ctx context.Context, key string) ([]string, error) {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return []string{}, err
 	}
-	ss, err := s.opt.cliredis.keys(key)
+	ss, err := s.opt.cliredis.keys(ctx, key)
 	if s.checkRedisDialErr(err) != nil {
 		return []string{}, err
 	}
@@ -20,13 +27,17 @@ func (s *Service) RedisReadKeys(key string) ([]string, error) {
 }
 
 func (s *Service) RedisReadHashField(key, field string) (string, error) {
+	return s.RedisReadHashFieldCtx(context.Background(), key, field)
+}
+
+func (s *Service) RedisReadHashFieldCtx(ctx context.Context, key, field string) (string, error) {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return "", err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.readTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.opt.cliredis.timeoutRead())
 	defer cancel()
-	val := s.opt.cliredis.cli.HGet(ctx, key, field)
+	val := s.opt.cliredis.client().HGet(ctx, key, field)
 	if s.checkRedisDialErr(val.Err()) != nil {
 		return "", val.Err()
 	}
@@ -35,13 +46,17 @@ func (s *Service) RedisReadHashField(key, field string) (string, error) {
 }
 
 func (s *Service) RedisReadHashMap(key string) (map[string]string, error) {
+	return s.RedisReadHashMapCtx(context.Background(), key)
+}
+
+func (s *Service) RedisReadHashMapCtx(ctx context.Context, key string) (map[string]string, error) {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.readTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.opt.cliredis.timeoutRead())
 	defer cancel()
-	val := s.opt.cliredis.cli.HGetAll(ctx, key)
+	val := s.opt.cliredis.client().HGetAll(ctx, key)
 	if s.checkRedisDialErr(val.Err()) != nil {
 		return nil, val.Err()
 	}
@@ -50,15 +65,15 @@ func (s *Service) RedisReadHashMap(key string) (map[string]string, error) {
 }
 
 func (s *Service) RedisRead(key string) (string, error) {
+	return s.RedisReadCtx(context.Background(), key)
+}
+
+func (s *Service) RedisReadCtx(ctx context.Context, key string) (string, error) {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return "", err
 	}
-	val, err := s.opt.cliredis.read(key)
-	// ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.readTimeout)
-	// defer cancel()
-	// ans := s.opt.cliredis.cli.Get(ctx, key)
-	// err = s.checkRedisDialErr(ans.Err())
+	val, err := s.opt.cliredis.read(ctx, key)
 	if err != nil {
 		return "", err
 	}
@@ -67,13 +82,17 @@ func (s *Service) RedisRead(key string) (string, error) {
 }
 
 func (s *Service) RedisDelKey(key string) error {
+	return s.RedisDelKeyCtx(context.Background(), key)
+}
+
+func (s *Service) RedisDelKeyCtx(ctx context.Context, key string) error {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.writeTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.opt.cliredis.timeoutWrite())
 	defer cancel()
-	err = s.checkRedisDialErr(s.opt.cliredis.cli.Del(ctx, key).Err())
+	err = s.checkRedisDialErr(s.opt.cliredis.client().Del(ctx, key).Err())
 	if err != nil {
 		return err
 	}
@@ -82,13 +101,17 @@ func (s *Service) RedisDelKey(key string) error {
 }
 
 func (s *Service) RedisDelHashField(key, field string) error {
+	return s.RedisDelHashFieldCtx(context.Background(), key, field)
+}
+
+func (s *Service) RedisDelHashFieldCtx(ctx context.Context, key, field string) error {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.writeTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.opt.cliredis.timeoutWrite())
 	defer cancel()
-	err = s.checkRedisDialErr(s.opt.cliredis.cli.HDel(ctx, key, field).Err())
+	err = s.checkRedisDialErr(s.opt.cliredis.client().HDel(ctx, key, field).Err())
 	if err != nil {
 		return err
 	}
@@ -97,13 +120,17 @@ func (s *Service) RedisDelHashField(key, field string) error {
 }
 
 func (s *Service) RedisExpireKey(key string, expire time.Duration) error {
+	return s.RedisExpireKeyCtx(context.Background(), key, expire)
+}
+
+func (s *Service) RedisExpireKeyCtx(ctx context.Context, key string, expire time.Duration) error {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.writeTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.opt.cliredis.timeoutWrite())
 	defer cancel()
-	err = s.checkRedisDialErr(s.opt.cliredis.cli.Expire(ctx, key, expire).Err())
+	err = s.checkRedisDialErr(s.opt.cliredis.client().Expire(ctx, key, expire).Err())
 	if err != nil {
 		return err
 	}
@@ -112,6 +139,10 @@ func (s *Service) RedisExpireKey(key string, expire time.Duration) error {
 }
 
 func (s *Service) RedisWriteHashMap(key string, value map[string]any) error {
+	return s.RedisWriteHashMapCtx(context.Background(), key, value)
+}
+
+func (s *Service) RedisWriteHashMapCtx(ctx context.Context, key string, value map[string]any) error {
 	if len(value) == 0 {
 		return nil
 	}
@@ -119,16 +150,16 @@ func (s *Service) RedisWriteHashMap(key string, value map[string]any) error {
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.writeTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.opt.cliredis.timeoutWrite())
 	defer cancel()
-	if s.opt.cliredis.cliver < 4 {
+	if s.opt.cliredis.cliver.Load() < 4 {
 		args := make([]any, 0, len(value)*2)
 		for f, v := range value {
 			args = append(args, f, v)
 		}
-		err = s.checkRedisDialErr(s.opt.cliredis.cli.HMSet(ctx, key, args...).Err())
+		err = s.checkRedisDialErr(s.opt.cliredis.client().HMSet(ctx, key, args...).Err())
 	} else {
-		err = s.checkRedisDialErr(s.opt.cliredis.cli.HSet(ctx, key, value).Err())
+		err = s.checkRedisDialErr(s.opt.cliredis.client().HSet(ctx, key, value).Err())
 	}
 	if err != nil {
 		return err
@@ -138,18 +169,23 @@ func (s *Service) RedisWriteHashMap(key string, value map[string]any) error {
 }
 
 func (s *Service) RedisWriteHashField(key, field string, value any) error {
-	return s.RedisWriteHashMap(key, map[string]any{field: value})
+	return s.RedisWriteHashFieldCtx(context.Background(), key, field, value)
+}
+
+func (s *Service) RedisWriteHashFieldCtx(ctx context.Context, key, field string, value any) error {
+	return s.RedisWriteHashMapCtx(ctx, key, map[string]any{field: value})
 }
 
 func (s *Service) RedisWrite(key string, value any, expire time.Duration) error {
+	return s.RedisWriteCtx(context.Background(), key, value, expire)
+}
+
+func (s *Service) RedisWriteCtx(ctx context.Context, key string, value any, expire time.Duration) error {
 	err := s.RedisClientLoaded()
 	if err != nil {
 		return err
 	}
-	err = s.opt.cliredis.write(key, value, expire)
-	// ctx, cancel := context.WithTimeout(context.Background(), s.opt.cliredis.writeTimeout)
-	// defer cancel()
-	// err = s.checkRedisDialErr(s.opt.cliredis.cli.Set(ctx, key, value, expire).Err())
+	err = s.opt.cliredis.write(ctx, key, value, expire)
 	if s.checkRedisDialErr(err) != nil {
 		return err
 	}
@@ -157,6 +193,32 @@ func (s *Service) RedisWrite(key string, value any, expire time.Duration) error
 	return nil
 }
 
+func (s *Service) RedisIncr(key string) (int64, error) {
+	return s.RedisIncrByCtx(context.Background(), key, 1)
+}
+
+func (s *Service) RedisIncrBy(key string, n int64) (int64, error) {
+	return s.RedisIncrByCtx(context.Background(), key, n)
+}
+
+// RedisIncrByCtx adds n to the counter key, which is 0 when it does not exist, returns the new value
+func (s *Service) RedisIncrByCtx(ctx context.Context, key string, n int64) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "incr:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().IncrBy(ctx, key, n).Result()
+	})
+}
+
+func (s *Service) RedisIncrByFloat(key string, n float64) (float64, error) {
+	return s.RedisIncrByFloatCtx(context.Background(), key, n)
+}
+
+// RedisIncrByFloatCtx adds n to the float counter key, returns the new value
+func (s *Service) RedisIncrByFloatCtx(ctx context.Context, key string, n float64) (float64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "incr:"+key, func(ctx context.Context) (float64, error) {
+		return s.opt.cliredis.client().IncrByFloat(ctx, key, n).Result()
+	})
+}
+
 func (s *Service) RedisClientLoaded() error {
 	ok := s.opt.cliredis.loaded.Load()
 	if ok {
@@ -173,3 +235,24 @@ func (s *Service) checkRedisDialErr(err error) error {
 	s.opt.logg.Error("[redis] error:" + s.opt.cliredis.checkRedisDialErr(err).Error())
 	return err
 }
+
+// redisDo calls f with the client loaded check and the timeout, the dial errors are checked to reconnect.
+// redis.Nil, which means no value, is returned without logging.
+func redisDo[T any](s *Service, ctx context.Context, timeout time.Duration, op string, f func(ctx context.Context) (T, error)) (T, error) {
+	var v T
+	err := s.RedisClientLoaded()
+	if err != nil {
+		return v, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	v, err = f(ctx)
+	if errors.Is(err, redis.Nil) {
+		return v, err
+	}
+	if s.checkRedisDialErr(err) != nil {
+		return v, err
+	}
+	s.opt.logg.Debug("[redis] " + op)
+	return v, nil
+}
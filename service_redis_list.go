@@ -0,0 +1,110 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+func (s *Service) RedisLPush(key string, values ...any) (int64, error) {
+	return s.RedisLPushCtx(context.Background(), key, values...)
+}
+
+// RedisLPushCtx inserts values at the head of the list key, returns the length of the list
+func (s *Service) RedisLPushCtx(ctx context.Context, key string, values ...any) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "lpush:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().LPush(ctx, key, values...).Result()
+	})
+}
+
+func (s *Service) RedisRPush(key string, values ...any) (int64, error) {
+	return s.RedisRPushCtx(context.Background(), key, values...)
+}
+
+// RedisRPushCtx appends values at the tail of the list key, returns the length of the list
+func (s *Service) RedisRPushCtx(ctx context.Context, key string, values ...any) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "rpush:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().RPush(ctx, key, values...).Result()
+	})
+}
+
+func (s *Service) RedisLPop(key string) (string, error) {
+	return s.RedisLPopCtx(context.Background(), key)
+}
+
+// RedisLPopCtx removes and returns the head of the list key, redis.Nil is returned when the list is empty
+func (s *Service) RedisLPopCtx(ctx context.Context, key string) (string, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "lpop:"+key, func(ctx context.Context) (string, error) {
+		return s.opt.cliredis.client().LPop(ctx, key).Result()
+	})
+}
+
+func (s *Service) RedisRPop(key string) (string, error) {
+	return s.RedisRPopCtx(context.Background(), key)
+}
+
+// RedisRPopCtx removes and returns the tail of the list key, redis.Nil is returned when the list is empty
+func (s *Service) RedisRPopCtx(ctx context.Context, key string) (string, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "rpop:"+key, func(ctx context.Context) (string, error) {
+		return s.opt.cliredis.client().RPop(ctx, key).Result()
+	})
+}
+
+func (s *Service) RedisBRPop(timeout time.Duration, keys ...string) (string, string, error) {
+	return s.RedisBRPopCtx(context.Background(), timeout, keys...)
+}
+
+// RedisBRPopCtx removes and returns the tail of the first non-empty list in keys, with the key of the list.
+// It waits up to timeout for a value, redis.Nil is returned when no value arrives, timeout 0 waits until a value arrives.
+func (s *Service) RedisBRPopCtx(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	if len(keys) == 0 {
+		return "", "", errors.New("[redis] no list key")
+	}
+	timeout = max(timeout, 0)
+	wait := timeout
+	if wait == 0 {
+		// 一直等待
+		wait = time.Hour * 24 * 365
+	}
+	ss, err := redisDo(s, ctx, s.opt.cliredis.timeoutRead()+wait, "brpop:"+keys[0], func(ctx context.Context) ([]string, error) {
+		return s.opt.cliredis.client().BRPop(ctx, timeout, keys...).Result()
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return ss[0], ss[1], nil
+}
+
+func (s *Service) RedisLRange(key string, start, stop int64) ([]string, error) {
+	return s.RedisLRangeCtx(context.Background(), key, start, stop)
+}
+
+// RedisLRangeCtx returns the items of the list key from start to stop, both included, -1 is the last item
+func (s *Service) RedisLRangeCtx(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "lrange:"+key, func(ctx context.Context) ([]string, error) {
+		return s.opt.cliredis.client().LRange(ctx, key, start, stop).Result()
+	})
+}
+
+func (s *Service) RedisLTrim(key string, start, stop int64) error {
+	return s.RedisLTrimCtx(context.Background(), key, start, stop)
+}
+
+// RedisLTrimCtx keeps only the items of the list key from start to stop, both included
+func (s *Service) RedisLTrimCtx(ctx context.Context, key string, start, stop int64) error {
+	_, err := redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "ltrim:"+key, func(ctx context.Context) (string, error) {
+		return s.opt.cliredis.client().LTrim(ctx, key, start, stop).Result()
+	})
+	return err
+}
+
+func (s *Service) RedisLLen(key string) (int64, error) {
+	return s.RedisLLenCtx(context.Background(), key)
+}
+
+// RedisLLenCtx returns the length of the list key
+func (s *Service) RedisLLenCtx(ctx context.Context, key string) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "llen:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().LLen(ctx, key).Result()
+	})
+}
@@ -0,0 +1,115 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTxRetry is the max times to run a transaction whose watched keys are changed by others
+const redisTxRetry = 10
+
+// RedisPipe queues the commands of a pipeline or a transaction, the results of the commands are set after they are sent,
+// such as:
+//
+//	var v *redis.StringCmd
+//	err := s.RedisPipeline(func(p gofactory.RedisPipe) error {
+//		p.Set(ctx, "a", 1, 0)
+//		p.HSet(ctx, "b", "c", 2)
+//		v = p.Get(ctx, "d")
+//		return nil
+//	})
+//	// v.Val() is set here
+type RedisPipe = redis.Pipeliner
+
+func (s *Service) RedisPipeline(f func(p RedisPipe) error) error {
+	return s.RedisPipelineCtx(context.Background(), f)
+}
+
+// RedisPipelineCtx sends the commands queued by f in one round trip, nothing is sent when f returns an error.
+// The error of the first failed command is returned, a command which gets no value is not an error,
+// check the result of each command for redis.Nil.
+func (s *Service) RedisPipelineCtx(ctx context.Context, f func(p RedisPipe) error) error {
+	var ferr error
+	_, err := redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "pipeline", func(ctx context.Context) ([]redis.Cmder, error) {
+		cmds, err := s.opt.cliredis.client().Pipelined(ctx, func(p redis.Pipeliner) error {
+			ferr = f(p)
+			return ferr
+		})
+		if ferr != nil {
+			return nil, nil
+		}
+		return cmds, redisCmdsErr(cmds, err)
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// redisCmdsErr returns the error of the first failed command, the commands which get no value are not failed.
+// err is returned when no command is failed, such as a network error before the commands are sent.
+func redisCmdsErr(cmds []redis.Cmder, err error) error {
+	for _, c := range cmds {
+		if e := c.Err(); e != nil && !errors.Is(e, redis.Nil) {
+			return e
+		}
+	}
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return err
+}
+
+func (s *Service) RedisTx(keys []string, f func(tx *redis.Tx, p RedisPipe) error) error {
+	return s.RedisTxCtx(context.Background(), keys, f)
+}
+
+// RedisTxCtx runs a transaction which watches keys, f reads the keys by tx, the reads are sent right away,
+// and queues the writes on p, which are sent in MULTI/EXEC after f returns. When a watched key is changed by others
+// before EXEC, the writes are discarded and f is called again, up to 10 times. Nothing is written when f returns an error.
+// All keys should be in the same cluster slot when the client is a cluster client, such as "{user:1}.a" and "{user:1}.b".
+func (s *Service) RedisTxCtx(ctx context.Context, keys []string, f func(tx *redis.Tx, p RedisPipe) error) error {
+	var ferr error
+	for i := range redisTxRetry {
+		if i > 0 {
+			// 退避后重试,避免与其他客户端持续冲突
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Millisecond * time.Duration(rand.IntN(10*i)+5*i)):
+			}
+		}
+		done, err := redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "tx", func(ctx context.Context) (bool, error) {
+			var cmds []redis.Cmder
+			err := s.opt.cliredis.client().Watch(ctx, func(tx *redis.Tx) error {
+				var err error
+				cmds, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+					ferr = f(tx, p)
+					return ferr
+				})
+				return err
+			}, keys...)
+			switch {
+			case ferr != nil:
+				// 回调的错误不是redis错误
+				return false, nil
+			case errors.Is(err, redis.TxFailedErr):
+				// 被其他客户端修改，重试
+				return false, nil
+			}
+			return true, redisCmdsErr(cmds, err)
+		})
+		if ferr != nil {
+			return ferr
+		}
+		if err != nil || done {
+			return err
+		}
+	}
+	return errors.New("[redis] transaction failed after " + strconv.Itoa(redisTxRetry) + " tries:" + redis.TxFailedErr.Error())
+}
@@ -0,0 +1,107 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func (s *Service) RedisPublish(channel string, msg any) (int64, error) {
+	return s.RedisPublishCtx(context.Background(), channel, msg)
+}
+
+// RedisPublishCtx sends msg to the subscribers of channel, returns the number of the subscribers which receive it
+func (s *Service) RedisPublishCtx(ctx context.Context, channel string, msg any) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "publish:"+channel, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().Publish(ctx, channel, msg).Result()
+	})
+}
+
+func (s *Service) RedisSubscribe(patterns []string, handler func(channel, payload string)) (func(), error) {
+	return s.RedisSubscribeCtx(context.Background(), patterns, handler)
+}
+
+// RedisSubscribeCtx calls handler with the messages of the channels which match patterns, such as "news.*",
+// a pattern without * ? or [] is a channel name. The handler is called one message at a time, it should return quickly.
+// The patterns are subscribed again when the client is reconnected, the messages sent in between are lost.
+//
+// The subscription is stopped when the returned func is called, ctx is done, or the service is stopped.
+func (s *Service) RedisSubscribeCtx(ctx context.Context, patterns []string, handler func(channel, payload string)) (func(), error) {
+	return s.redisSubscribe(ctx, &redisSub{
+		patterns: patterns,
+		handler:  handler,
+	})
+}
+
+func (s *Service) RedisOnExpired(handler func(key string)) (func(), error) {
+	return s.RedisOnExpiredCtx(context.Background(), handler)
+}
+
+// RedisOnExpiredCtx calls handler with the keys expired in the database of the client, such as the sessions,
+// by the `__keyevent@<db>__:expired` notifications, which need `notify-keyspace-events Ex` on the server.
+// An error is returned when the notifications are off, unless OptRedisKeyEvents is set to turn them on.
+// The keys are reported when redis removes them, which may be a while after their ttl,
+// and only the instances which are subscribed at that time get the keys.
+// On a cluster, every master is subscribed.
+//
+// The subscription is stopped when the returned func is called, ctx is done, or the service is stopped.
+func (s *Service) RedisOnExpiredCtx(ctx context.Context, handler func(key string)) (func(), error) {
+	if handler == nil {
+		return nil, errors.New("[redis] handler is nil")
+	}
+	if !s.opt.cliredis.enable {
+		return nil, errors.New("[redis] client is not enabled")
+	}
+	db := s.opt.cliredis.database
+	if s.opt.cliredis.cluster {
+		db = 0
+	}
+	setup := func(ctx context.Context, c redis.Cmdable) error {
+		if err := keyEvents(ctx, c, "x", s.opt.cliredis.keyEvents); err != nil {
+			return errors.New("[redis] " + err.Error())
+		}
+		return nil
+	}
+	// 已连接时先检查，未连接时在订阅前检查
+	if s.opt.cliredis.loaded.Load() {
+		cctx, cancel := context.WithTimeout(ctx, s.opt.cliredis.timeoutWrite())
+		defer cancel()
+		clis, err := s.opt.cliredis.nodes(cctx, true)
+		if err != nil {
+			return nil, errors.New("[redis] " + err.Error())
+		}
+		for _, c := range clis {
+			if err := setup(cctx, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s.redisSubscribe(ctx, &redisSub{
+		patterns: []string{"__keyevent@" + strconv.Itoa(db) + "__:expired"},
+		perNode:  true,
+		setup:    setup,
+		handler: func(channel, payload string) {
+			handler(payload)
+		},
+	})
+}
+
+func (s *Service) redisSubscribe(ctx context.Context, sub *redisSub) (func(), error) {
+	if !s.opt.cliredis.enable {
+		return nil, errors.New("[redis] client is not enabled")
+	}
+	if len(sub.patterns) == 0 || sub.handler == nil {
+		return nil, errors.New("[redis] no patterns or handler")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.closeCtx, cancel)
+	s.opt.cliredis.subscribe(ctx, sub, s.opt.logg)
+	s.opt.logg.Debug("[redis] subscribe:" + strings.Join(sub.patterns, ","))
+	return func() {
+		stop()
+		cancel()
+	}, nil
+}
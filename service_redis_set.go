@@ -0,0 +1,60 @@
+package gofactory
+
+import (
+	"context"
+)
+
+func (s *Service) RedisSAdd(key string, members ...any) (int64, error) {
+	return s.RedisSAddCtx(context.Background(), key, members...)
+}
+
+// RedisSAddCtx adds members to the set key, returns the number of the new members
+func (s *Service) RedisSAddCtx(ctx context.Context, key string, members ...any) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "sadd:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().SAdd(ctx, key, members...).Result()
+	})
+}
+
+func (s *Service) RedisSRem(key string, members ...any) (int64, error) {
+	return s.RedisSRemCtx(context.Background(), key, members...)
+}
+
+// RedisSRemCtx removes members from the set key, returns the number of the removed members
+func (s *Service) RedisSRemCtx(ctx context.Context, key string, members ...any) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "srem:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().SRem(ctx, key, members...).Result()
+	})
+}
+
+func (s *Service) RedisSMembers(key string) ([]string, error) {
+	return s.RedisSMembersCtx(context.Background(), key)
+}
+
+// RedisSMembersCtx returns all members of the set key
+func (s *Service) RedisSMembersCtx(ctx context.Context, key string) ([]string, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "smembers:"+key, func(ctx context.Context) ([]string, error) {
+		return s.opt.cliredis.client().SMembers(ctx, key).Result()
+	})
+}
+
+func (s *Service) RedisSIsMember(key string, member any) (bool, error) {
+	return s.RedisSIsMemberCtx(context.Background(), key, member)
+}
+
+// RedisSIsMemberCtx reports whether member is in the set key
+func (s *Service) RedisSIsMemberCtx(ctx context.Context, key string, member any) (bool, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "sismember:"+key, func(ctx context.Context) (bool, error) {
+		return s.opt.cliredis.client().SIsMember(ctx, key, member).Result()
+	})
+}
+
+func (s *Service) RedisSCard(key string) (int64, error) {
+	return s.RedisSCardCtx(context.Background(), key)
+}
+
+// RedisSCardCtx returns the number of the members of the set key
+func (s *Service) RedisSCardCtx(ctx context.Context, key string) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "scard:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().SCard(ctx, key).Result()
+	})
+}
@@ -0,0 +1,157 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStreamMessage is a message of a stream
+type RedisStreamMessage struct {
+	ID     string
+	Values map[string]string
+}
+
+func redisStreamMessages(xx []redis.XMessage) []RedisStreamMessage {
+	mm := make([]RedisStreamMessage, 0, len(xx))
+	for _, x := range xx {
+		m := RedisStreamMessage{ID: x.ID, Values: make(map[string]string, len(x.Values))}
+		for k, v := range x.Values {
+			m.Values[k] = fmt.Sprint(v)
+		}
+		mm = append(mm, m)
+	}
+	return mm
+}
+
+func (s *Service) RedisXAdd(stream string, values map[string]any, maxLen int64) (string, error) {
+	return s.RedisXAddCtx(context.Background(), stream, values, maxLen)
+}
+
+// RedisXAddCtx appends a message with values to stream, returns the id of the message.
+// When maxLen > 0, the stream is trimmed to about maxLen messages, the oldest messages are removed.
+func (s *Service) RedisXAddCtx(ctx context.Context, stream string, values map[string]any, maxLen int64) (string, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "xadd:"+stream, func(ctx context.Context) (string, error) {
+		return s.opt.cliredis.client().XAdd(ctx, &redis.XAddArgs{
+			Stream: stream,
+			MaxLen: max(maxLen, 0),
+			Approx: maxLen > 0,
+			Values: values,
+		}).Result()
+	})
+}
+
+func (s *Service) RedisXGroupCreate(stream, group, start string) error {
+	return s.RedisXGroupCreateCtx(context.Background(), stream, group, start)
+}
+
+// RedisXGroupCreateCtx creates the consumer group of stream, the stream is created when it does not exist.
+// The group reads the messages after the id start, "0" reads all messages, "" or "$" reads the new messages only.
+// It is not an error when the group exists already.
+func (s *Service) RedisXGroupCreateCtx(ctx context.Context, stream, group, start string) error {
+	if start == "" {
+		start = "$"
+	}
+	_, err := redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "xgroup create:"+stream+" "+group, func(ctx context.Context) (string, error) {
+		v, err := s.opt.cliredis.client().XGroupCreateMkStream(ctx, stream, group, start).Result()
+		if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return v, nil
+		}
+		return v, err
+	})
+	return err
+}
+
+func (s *Service) RedisXReadGroup(stream, group, consumer string, count int64, block time.Duration) ([]RedisStreamMessage, error) {
+	return s.RedisXReadGroupCtx(context.Background(), stream, group, consumer, count, block)
+}
+
+// RedisXReadGroupCtx reads up to count new messages of stream for consumer in group,
+// the messages are pending until they are acked by RedisXAckCtx.
+// It waits up to block for the new messages, an empty list is returned when no message arrives, block <= 0 does not wait.
+func (s *Service) RedisXReadGroupCtx(ctx context.Context, stream, group, consumer string, count int64, block time.Duration) ([]RedisStreamMessage, error) {
+	if block <= 0 {
+		// 不等待
+		block = -1
+	}
+	xx, err := redisDo(s, ctx, s.opt.cliredis.timeoutRead()+max(block, 0), "xreadgroup:"+stream+" "+group, func(ctx context.Context) ([]redis.XStream, error) {
+		return s.opt.cliredis.client().XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, ">"},
+			Count:    count,
+			Block:    block,
+		}).Result()
+	})
+	if errors.Is(err, redis.Nil) {
+		return []RedisStreamMessage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mm := make([]RedisStreamMessage, 0)
+	for _, x := range xx {
+		mm = append(mm, redisStreamMessages(x.Messages)...)
+	}
+	return mm, nil
+}
+
+func (s *Service) RedisXAck(stream, group string, ids ...string) (int64, error) {
+	return s.RedisXAckCtx(context.Background(), stream, group, ids...)
+}
+
+// RedisXAckCtx marks the messages of ids done in group, returns the number of the acked messages
+func (s *Service) RedisXAckCtx(ctx context.Context, stream, group string, ids ...string) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "xack:"+stream+" "+group, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().XAck(ctx, stream, group, ids...).Result()
+	})
+}
+
+func (s *Service) RedisXAutoClaim(stream, group, consumer string, minIdle time.Duration, start string, count int64) ([]RedisStreamMessage, string, error) {
+	return s.RedisXAutoClaimCtx(context.Background(), stream, group, consumer, minIdle, start, count)
+}
+
+// RedisXAutoClaimCtx takes over up to count pending messages of group, which are not acked for minIdle,
+// such as the messages of a crashed consumer, and returns them to consumer. It needs redis 6.2 or later.
+// The messages after the id start are claimed, "" or "0-0" from the first, the id to start the next call is returned,
+// which is "0-0" when all pending messages are checked.
+func (s *Service) RedisXAutoClaimCtx(ctx context.Context, stream, group, consumer string, minIdle time.Duration, start string, count int64) ([]RedisStreamMessage, string, error) {
+	if start == "" {
+		start = "0-0"
+	}
+	var next string
+	xx, err := redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "xautoclaim:"+stream+" "+group, func(ctx context.Context) ([]redis.XMessage, error) {
+		var (
+			xx  []redis.XMessage
+			err error
+		)
+		xx, next, err = s.opt.cliredis.client().XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  minIdle,
+			Start:    start,
+			Count:    count,
+		}).Result()
+		return xx, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return redisStreamMessages(xx), next, nil
+}
+
+func (s *Service) RedisXLen(stream string) (int64, error) {
+	return s.RedisXLenCtx(context.Background(), stream)
+}
+
+// RedisXLenCtx returns the number of the messages of stream
+func (s *Service) RedisXLenCtx(ctx context.Context, stream string) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "xlen:"+stream, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().XLen(ctx, stream).Result()
+	})
+}
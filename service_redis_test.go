@@ -0,0 +1,271 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/redis/go-redis/v9"
+	"github.com/xyzj/toolbox/logger"
+)
+
+// newTestRedis returns a service whose redis client is connected to an in-process redis
+func newTestRedis(t *testing.T, opts ...redisOpts) (*Service, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s, err := New(WithLogger(logger.NewNilLogger()), WithRedisClient(append([]redisOpts{OptRedisAddr(mr.Addr())}, opts...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.opt.cliredis.build(s.closeCtx, s.opt.logg); err != nil {
+		t.Fatal(err)
+	}
+	// miniredis 不支持 INFO Server，客户端已创建，直接标记为可用
+	s.opt.cliredis.loaded.Store(true)
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	return s, mr
+}
+
+func TestRedisTxRetry(t *testing.T) {
+	s, mr := newTestRedis(t)
+	other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer other.Close()
+	ctx := context.Background()
+	if err := s.RedisWrite("n", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	err := s.RedisTx([]string{"n"}, func(tx *redis.Tx, p RedisPipe) error {
+		calls++
+		n, err := tx.Get(ctx, "n").Int()
+		if err != nil {
+			return err
+		}
+		// 第一次执行时被其他客户端修改
+		if calls == 1 {
+			other.Incr(ctx, "n")
+		}
+		p.Set(ctx, "n", n+10, 0)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.RedisRead("n"); calls != 2 || v != "12" {
+		t.Fatalf("%d calls, n is %s", calls, v)
+	}
+	// 每次都被修改时重试次数有限
+	calls = 0
+	err = s.RedisTx([]string{"n"}, func(tx *redis.Tx, p RedisPipe) error {
+		calls++
+		other.Incr(ctx, "n")
+		p.Set(ctx, "n", 0, 0)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), redis.TxFailedErr.Error()) || calls != redisTxRetry {
+		t.Fatalf("%d calls, error %v", calls, err)
+	}
+	// 回调的错误原样返回，不写入
+	ferr := errors.New("stop")
+	err = s.RedisTx([]string{"n"}, func(tx *redis.Tx, p RedisPipe) error {
+		p.Set(ctx, "n", 0, 0)
+		return ferr
+	})
+	if err != ferr {
+		t.Fatalf("error %v", err)
+	}
+	if v, _ := s.RedisRead("n"); v == "0" {
+		t.Fatal("the writes of a failed callback are sent")
+	}
+}
+
+func TestRedisCmdsErr(t *testing.T) {
+	ctx := context.Background()
+	nilCmd := redis.NewStringCmd(ctx)
+	nilCmd.SetErr(redis.Nil)
+	okCmd := redis.NewStatusCmd(ctx)
+	failCmd := redis.NewStringCmd(ctx)
+	failCmd.SetErr(errors.New("WRONGTYPE"))
+	netErr := errors.New("dial tcp: refused")
+	for _, v := range []struct {
+		name string
+		cmds []redis.Cmder
+		err  error
+		want error
+	}{
+		{name: "no value", cmds: []redis.Cmder{okCmd, nilCmd}, err: redis.Nil, want: nil},
+		{name: "failed command", cmds: []redis.Cmder{nilCmd, failCmd}, err: redis.Nil, want: failCmd.Err()},
+		{name: "not sent", cmds: []redis.Cmder{okCmd}, err: netErr, want: netErr},
+	} {
+		if err := redisCmdsErr(v.cmds, v.err); err != v.want {
+			t.Fatalf("%s: error %v", v.name, err)
+		}
+	}
+	s, _ := newTestRedis(t)
+	var get *redis.StringCmd
+	err := s.RedisPipeline(func(p RedisPipe) error {
+		p.Set(ctx, "a", "1", 0)
+		get = p.Get(ctx, "missing")
+		return nil
+	})
+	if err != nil || !errors.Is(get.Err(), redis.Nil) {
+		t.Fatalf("pipeline error %v, get error %v", err, get.Err())
+	}
+	err = s.RedisPipeline(func(p RedisPipe) error {
+		p.HGet(ctx, "a", "x")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "WRONGTYPE") {
+		t.Fatalf("pipeline error %v", err)
+	}
+}
+
+// testConfig serves CONFIG GET/SET of notify-keyspace-events, which miniredis does not support
+type testConfig struct {
+	events string
+	mu     sync.Mutex
+}
+
+func (c *testConfig) register(t *testing.T, mr *miniredis.Miniredis) {
+	t.Helper()
+	err := mr.Server().Register("CONFIG", func(p *server.Peer, cmd string, args []string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			p.WriteMapLen(1)
+			p.WriteBulk("notify-keyspace-events")
+			p.WriteBulk(c.events)
+		case "SET":
+			c.events = args[2]
+			p.WriteOK()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testConfig) get() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.events
+}
+
+func TestRedisKeyEvents(t *testing.T) {
+	s, mr := newTestRedis(t)
+	conf := &testConfig{}
+	conf.register(t, mr)
+	ctx := context.Background()
+	cli := s.opt.cliredis.client()
+	for _, v := range []struct {
+		events string
+		set    bool
+		want   string
+		err    bool
+	}{
+		{events: "", set: false, want: "", err: true},
+		{events: "", set: true, want: "Ex"},
+		{events: "Kx", set: true, want: "KxE"},
+		// A 包含全部事件
+		{events: "KEA", set: false, want: "KEA"},
+		{events: "Ex", set: false, want: "Ex"},
+	} {
+		conf.mu.Lock()
+		conf.events = v.events
+		conf.mu.Unlock()
+		err := keyEvents(ctx, cli, "x", v.set)
+		if (err != nil) != v.err || conf.get() != v.want {
+			t.Fatalf("%q set %v: events %q, error %v", v.events, v.set, conf.get(), err)
+		}
+	}
+	// 通知关闭时不订阅
+	conf.mu.Lock()
+	conf.events = ""
+	conf.mu.Unlock()
+	if _, err := s.RedisOnExpired(func(key string) {}); err == nil || !strings.Contains(err.Error(), "OptRedisKeyEvents") {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestRedisResubscribe(t *testing.T) {
+	s, _ := newTestRedis(t)
+	recv := make(chan string, 100)
+	stop, err := s.RedisSubscribe([]string{"news.*", "plain"}, func(channel, payload string) {
+		recv <- channel + ":" + payload
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// 订阅生效前的消息会丢失，重复发送直到收到
+	fRecv := func(channel string) {
+		t.Helper()
+		timeout := time.After(time.Second * 5)
+		for {
+			if _, err := s.RedisPublish(channel, "x"); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-recv:
+				if m != channel+":x" {
+					t.Fatalf("received %s, want %s", m, channel)
+				}
+				for len(recv) > 0 {
+					<-recv
+				}
+				return
+			case <-time.After(time.Millisecond * 100):
+			case <-timeout:
+				t.Fatalf("%s not received", channel)
+			}
+		}
+	}
+	fRecv("news.a")
+	fRecv("plain")
+	// 与重连循环一样替换客户端，旧的订阅随旧客户端关闭
+	cli := s.opt.cliredis.newClient()
+	cli.AddHook(s.opt.cliredis.hook)
+	if old := s.opt.cliredis.cli.Swap(&cli); old != nil {
+		(*old).Close()
+	}
+	fRecv("news.b")
+	fRecv("plain")
+}
+
+func TestRedisRegistry(t *testing.T) {
+	s, mr := newTestRedis(t)
+	b := newRedisBackend(&s.opt.cliredis)
+	ctx := context.Background()
+	prefix := "/test-root/discover"
+	if err := b.Register(ctx, prefix, "a", `{"name":"a"}`, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register(ctx, prefix, "b", `{"name":"b"}`, time.Millisecond*50); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	// 过期的实例在读取时移除
+	ss, err := b.List(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 1 || ss["a"] != `{"name":"a"}` {
+		t.Fatalf("instances %v", ss)
+	}
+	registry, expire, _ := registryKeys(prefix)
+	if keys, _ := mr.HKeys(registry); len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("registry %v", keys)
+	}
+	if err := b.Deregister(ctx, prefix, "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(registry) || mr.Exists(expire) || mr.Exists("a") {
+		t.Fatal("the instance is not removed")
+	}
+}
@@ -0,0 +1,149 @@
+package gofactory
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisZMember is a member of a sorted set with its score
+type RedisZMember struct {
+	Member string
+	Score  float64
+}
+
+func redisZMembers(zz []redis.Z) []RedisZMember {
+	xx := make([]RedisZMember, 0, len(zz))
+	for _, z := range zz {
+		m, _ := z.Member.(string)
+		xx = append(xx, RedisZMember{Member: m, Score: z.Score})
+	}
+	return xx
+}
+
+func (s *Service) RedisZAdd(key string, members ...RedisZMember) (int64, error) {
+	return s.RedisZAddCtx(context.Background(), key, members...)
+}
+
+// RedisZAddCtx adds members to the sorted set key or updates their scores, returns the number of the new members
+func (s *Service) RedisZAddCtx(ctx context.Context, key string, members ...RedisZMember) (int64, error) {
+	zz := make([]redis.Z, 0, len(members))
+	for _, m := range members {
+		zz = append(zz, redis.Z{Member: m.Member, Score: m.Score})
+	}
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "zadd:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().ZAdd(ctx, key, zz...).Result()
+	})
+}
+
+func (s *Service) RedisZIncrBy(key, member string, n float64) (float64, error) {
+	return s.RedisZIncrByCtx(context.Background(), key, member, n)
+}
+
+// RedisZIncrByCtx adds n to the score of member in the sorted set key, returns the new score
+func (s *Service) RedisZIncrByCtx(ctx context.Context, key, member string, n float64) (float64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "zincrby:"+key, func(ctx context.Context) (float64, error) {
+		return s.opt.cliredis.client().ZIncrBy(ctx, key, n, member).Result()
+	})
+}
+
+func (s *Service) RedisZRem(key string, members ...string) (int64, error) {
+	return s.RedisZRemCtx(context.Background(), key, members...)
+}
+
+// RedisZRemCtx removes members from the sorted set key, returns the number of the removed members
+func (s *Service) RedisZRemCtx(ctx context.Context, key string, members ...string) (int64, error) {
+	mm := make([]any, 0, len(members))
+	for _, m := range members {
+		mm = append(mm, m)
+	}
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "zrem:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().ZRem(ctx, key, mm...).Result()
+	})
+}
+
+func (s *Service) RedisZRemRangeByScore(key, min, max string) (int64, error) {
+	return s.RedisZRemRangeByScoreCtx(context.Background(), key, min, max)
+}
+
+// RedisZRemRangeByScoreCtx removes the members whose score is between min and max, returns the number of the removed members.
+// min and max are the same as RedisZRangeByScoreCtx.
+func (s *Service) RedisZRemRangeByScoreCtx(ctx context.Context, key, min, max string) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutWrite(), "zremrangebyscore:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().ZRemRangeByScore(ctx, key, min, max).Result()
+	})
+}
+
+func (s *Service) RedisZScore(key, member string) (float64, error) {
+	return s.RedisZScoreCtx(context.Background(), key, member)
+}
+
+// RedisZScoreCtx returns the score of member in the sorted set key, redis.Nil is returned when member is not found
+func (s *Service) RedisZScoreCtx(ctx context.Context, key, member string) (float64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "zscore:"+key, func(ctx context.Context) (float64, error) {
+		return s.opt.cliredis.client().ZScore(ctx, key, member).Result()
+	})
+}
+
+func (s *Service) RedisZRevRank(key, member string) (int64, error) {
+	return s.RedisZRevRankCtx(context.Background(), key, member)
+}
+
+// RedisZRevRankCtx returns the rank of member by score from high to low, starts from 0,
+// redis.Nil is returned when member is not found
+func (s *Service) RedisZRevRankCtx(ctx context.Context, key, member string) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "zrevrank:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().ZRevRank(ctx, key, member).Result()
+	})
+}
+
+func (s *Service) RedisZRange(key string, start, stop int64, reverse bool) ([]RedisZMember, error) {
+	return s.RedisZRangeCtx(context.Background(), key, start, stop, reverse)
+}
+
+// RedisZRangeCtx returns the members of the sorted set key ranked from start to stop, both included, -1 is the last member.
+// The members are ranked by score from low to high, or from high to low when reverse, such as the top 10 of a leaderboard.
+func (s *Service) RedisZRangeCtx(ctx context.Context, key string, start, stop int64, reverse bool) ([]RedisZMember, error) {
+	zz, err := redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "zrange:"+key, func(ctx context.Context) ([]redis.Z, error) {
+		if reverse {
+			return s.opt.cliredis.client().ZRevRangeWithScores(ctx, key, start, stop).Result()
+		}
+		return s.opt.cliredis.client().ZRangeWithScores(ctx, key, start, stop).Result()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redisZMembers(zz), nil
+}
+
+func (s *Service) RedisZRangeByScore(key, min, max string, offset, count int64) ([]RedisZMember, error) {
+	return s.RedisZRangeByScoreCtx(context.Background(), key, min, max, offset, count)
+}
+
+// RedisZRangeByScoreCtx returns the members whose score is between min and max by score from low to high,
+// such as the records of a time index. min and max are numbers, "-inf" or "+inf", a number starts with "(" is excluded.
+// count members are returned from offset, count <= 0 returns all.
+func (s *Service) RedisZRangeByScoreCtx(ctx context.Context, key, min, max string, offset, count int64) ([]RedisZMember, error) {
+	zz, err := redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "zrangebyscore:"+key, func(ctx context.Context) ([]redis.Z, error) {
+		opt := &redis.ZRangeBy{Min: min, Max: max}
+		if count > 0 {
+			opt.Offset, opt.Count = offset, count
+		}
+		return s.opt.cliredis.client().ZRangeByScoreWithScores(ctx, key, opt).Result()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redisZMembers(zz), nil
+}
+
+func (s *Service) RedisZCard(key string) (int64, error) {
+	return s.RedisZCardCtx(context.Background(), key)
+}
+
+// RedisZCardCtx returns the number of the members of the sorted set key
+func (s *Service) RedisZCardCtx(ctx context.Context, key string) (int64, error) {
+	return redisDo(s, ctx, s.opt.cliredis.timeoutRead(), "zcard:"+key, func(ctx context.Context) (int64, error) {
+		return s.opt.cliredis.client().ZCard(ctx, key).Result()
+	})
+}
@@ -0,0 +1,225 @@
+package gofactory
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/loopfunc"
+)
+
+// ReloadResult describes the changes found by a config reload.
+type ReloadResult struct {
+	// Applied changes which have taken effect on the running service
+	Applied []string
+	// RestartRequired changes which need a restart to take effect, such as new ports
+	RestartRequired []string
+}
+
+// OnReload registers a hook which is called after every successful reload,
+// the hook must not call Reload.
+func (s *Service) OnReload(f func(r ReloadResult)) {
+	if f == nil {
+		return
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.reloadFunc = append(s.reloadFunc, f)
+}
+
+// Reload loads the options and config file again, and applies the changes that are safe at runtime:
+// log level and run mode, web read and write timeouts, redis timeouts, mqtt client subscriptions,
+// discover publish interval and pick strategy.
+// Other changes are reported in RestartRequired.
+func (s *Service) Reload() (ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	r := ReloadResult{
+		Applied:         make([]string, 0),
+		RestartRequired: make([]string, 0),
+	}
+	n := &Opt{}
+	if err := loadOpt(n, s.opts); err != nil {
+		s.opt.logg.Error("[reload] load config error:" + err.Error())
+		return r, err
+	}
+	o := s.opt
+	live := *s.live.Load()
+	fRestart := func(changed bool, name string) {
+		if changed {
+			r.RestartRequired = append(r.RestartRequired, name)
+		}
+	}
+	// base config
+	if n.mode != live.mode || n.logLevel != live.logLevel {
+		live.mode = n.mode
+		live.logLevel = n.logLevel
+		switch {
+		case live.logLevel > 0:
+			o.logg.SetLevel(live.logLevel)
+		case live.mode == Debug:
+			o.logg.SetLevel(logger.LogDebug)
+		default:
+			o.logg.SetLevel(logger.LogInfo)
+		}
+		if live.mode == Release {
+			gin.SetMode(gin.ReleaseMode)
+		} else {
+			gin.SetMode(gin.DebugMode)
+		}
+		r.Applied = append(r.Applied, "mode and log level")
+	}
+	live.strict = n.strict
+	live.optional = n.optional
+	live.shutdownTimeout = n.shutdownTimeout
+	// services
+	fRestart(n.tcpServer.enable != o.tcpServer.enable || n.tcpServer.bind != o.tcpServer.bind, "tcp server")
+	fRestart(n.mqttBroker.enable != o.mqttBroker.enable ||
+		n.mqttBroker.mqtt != o.mqttBroker.mqtt ||
+		n.mqttBroker.mqtttls != o.mqttBroker.mqtttls ||
+		n.mqttBroker.mqttws != o.mqttBroker.mqttws ||
+		n.mqttBroker.mqttweb != o.mqttBroker.mqttweb, "mqtt broker")
+	fRestart(n.webServer.enable != o.webServer.enable || n.webServer.bind != o.webServer.bind || n.webServer.protocol != o.webServer.protocol, "web server")
+	if o.webServer.enable && (n.webServer.readTimeout != live.webRead || n.webServer.writeTimeout != live.webWrite) {
+		live.webRead = n.webServer.readTimeout
+		live.webWrite = n.webServer.writeTimeout
+		r.Applied = append(r.Applied, "web timeouts")
+	}
+	// 运行中的http.Server不能修改空闲超时
+	fRestart(n.webServer.enable && o.webServer.enable && n.webServer.idleTimeout != o.webServer.idleTimeout, "web idle timeout")
+	// the names generated by the options differ in every load, keep the running ones
+	if n.clirmq.queueAuto && o.clirmq.queueAuto {
+		n.clirmq.queueName = o.clirmq.queueName
+	}
+	if n.discover.nameAuto && o.discover.nameAuto {
+		n.discover.svrInfo.SvrName = o.discover.svrInfo.SvrName
+	}
+	// clients
+	if n.cliredis.enable != o.cliredis.enable || !o.cliredis.sameConn(&n.cliredis) {
+		fRestart(true, "redis client")
+	} else if o.cliredis.enable && (n.cliredis.readTimeout != o.cliredis.timeoutRead() || n.cliredis.writeTimeout != o.cliredis.timeoutWrite()) {
+		o.cliredis.setTimeouts(n.cliredis.readTimeout, n.cliredis.writeTimeout)
+		r.Applied = append(r.Applied, "redis timeouts")
+	}
+	if n.discover.enable != o.discover.enable ||
+		n.discover.discoverType != o.discover.discoverType ||
+		(n.discover.discoverType == byRedis && !o.discover.rediscli.sameConn(&n.discover.rediscli)) ||
+		!reflect.DeepEqual(n.discover.udp, o.discover.udp) ||
+		!reflect.DeepEqual(n.discover.keys, o.discover.keys) ||
+		(n.discover.discoverType == byBackend && !sameBackend(n.discover.backend, o.discover.backend)) ||
+		(n.discover.discoverType == byBolt && n.discover.boltFile != o.discover.boltFile) ||
+		n.discover.infoTimeout != o.discover.infoTimeout ||
+		n.discover.advertiseIP != o.discover.advertiseIP ||
+		!o.discover.sameInfo(n.discover.svrInfo) {
+		fRestart(true, "discover")
+	} else if o.discover.enable && n.discover.publishInterval != o.discover.publishInterval {
+		if err := o.discover.setPublishInterval(n.discover.publishInterval); err != nil {
+			o.logg.Error("[reload] " + err.Error())
+			fRestart(true, "discover publish interval")
+		} else {
+			r.Applied = append(r.Applied, "discover publish interval")
+		}
+	}
+	if o.discover.enable && n.discover.strategy != live.strategy {
+		live.strategy = n.discover.strategy
+		r.Applied = append(r.Applied, "discover pick strategy")
+	}
+	if n.climqtt.enable != o.climqtt.enable ||
+		n.climqtt.addr != o.climqtt.addr ||
+		n.climqtt.user != o.climqtt.user ||
+		n.climqtt.pwd != o.climqtt.pwd ||
+		n.climqtt.clientID != o.climqtt.clientID {
+		fRestart(true, "mqtt client")
+	} else if o.climqtt.enable && !mapEqual(n.climqtt.subscribe, o.climqtt.subscribe) {
+		if err := o.climqtt.resubscribe(n.climqtt.subscribe); err != nil {
+			o.logg.Error("[reload] " + err.Error())
+			fRestart(true, "mqtt subscriptions")
+		} else {
+			r.Applied = append(r.Applied, "mqtt subscriptions")
+		}
+	}
+	fRestart(n.clirmq.enable != o.clirmq.enable ||
+		n.clirmq.addr != o.clirmq.addr ||
+		n.clirmq.user != o.clirmq.user ||
+		n.clirmq.pwd != o.clirmq.pwd ||
+		n.clirmq.vhost != o.clirmq.vhost ||
+		n.clirmq.exchange != o.clirmq.exchange ||
+		n.clirmq.queueName != o.clirmq.queueName, "rmq client")
+	fRestart(n.clidb.enable != o.clidb.enable ||
+		n.clidb.addr != o.clidb.addr ||
+		n.clidb.user != o.clidb.user ||
+		n.clidb.pwd != o.clidb.pwd ||
+		!slices.Equal(n.clidb.database, o.clidb.database), "db client")
+	fRestart(n.boltname != o.boltname, "boltdb")
+	fRestart(n.metricsBind != o.metricsBind, "metrics server")
+	fRestart(!sameExporter(n.traceExporter, o.traceExporter) || !reflect.DeepEqual(n.traceOTLP, o.traceOTLP) || n.traceRatio != o.traceRatio, "tracing")
+	s.live.Store(&live)
+	if len(r.Applied) > 0 {
+		o.logg.System("[reload] applied: " + strings.Join(r.Applied, ", "))
+	}
+	if len(r.RestartRequired) > 0 {
+		o.logg.Warning("[reload] restart required: " + strings.Join(r.RestartRequired, ", "))
+	}
+	for _, f := range s.reloadFunc {
+		f(r)
+	}
+	return r, nil
+}
+
+func mapEqual[K comparable, V comparable](a, b map[K]V) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if x, ok := b[k]; !ok || x != v {
+			return false
+		}
+	}
+	return true
+}
+
+// watchConfig reloads the config on SIGHUP, or when the config file is modified.
+func (s *Service) watchConfig(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go loopfunc.LoopFunc(func(params ...any) {
+		defer signal.Stop(sig)
+		var modTime time.Time
+		fModTime := func() time.Time {
+			if fi, err := os.Stat(s.opt.filePath); err == nil {
+				return fi.ModTime()
+			}
+			return modTime
+		}
+		var tc <-chan time.Time
+		if s.opt.filePath != "" && s.opt.reloadInterval > 0 {
+			modTime = fModTime()
+			t1 := time.NewTicker(s.opt.reloadInterval)
+			defer t1.Stop()
+			tc = t1.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sig:
+				s.opt.logg.System("[reload] SIGHUP received")
+			case <-tc:
+				t := fModTime()
+				if t.Equal(modTime) {
+					continue
+				}
+				modTime = t
+				s.opt.logg.System("[reload] config file modified")
+			}
+			s.Reload()
+		}
+	}, "reload", s.opt.logg.DefaultWriter())
+}
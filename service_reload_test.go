@@ -0,0 +1,222 @@
+package gofactory
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/toolbox/logger"
+)
+
+func TestReloadMqttSubscribe(t *testing.T) {
+	addr := freeAddr(t)
+	b, err := (&mqttBroker{mqtt: addr, insidejob: true, enable: true}).build(logger.NewNilLogger(), Debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	fWrite := func(topic string) {
+		if err := os.WriteFile(name, []byte("mqtt:\n  addr: "+addr+"\n  subscribe:\n    "+topic+": 0\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fWrite("test/a")
+	recv := make(chan string, 100)
+	s, err := New(WithLogger(logger.NewNilLogger()), FromConfigFile(name),
+		WithMqttClient(OptMqttRecvFunc(func(topic string, body []byte) {
+			recv <- topic
+		})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.opt.climqtt.build(s.opt.logg); err != nil {
+		t.Fatal(err)
+	}
+	defer s.opt.climqtt.close()
+	fRecv := func(topic string) {
+		t.Helper()
+		timeout := time.After(time.Second * 5)
+		for {
+			if err := b.Publish(topic, []byte("x"), 0); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case x := <-recv:
+				if x != topic {
+					t.Fatalf("received %s, want %s", x, topic)
+				}
+				return
+			case <-time.After(time.Millisecond * 100):
+			case <-timeout:
+				t.Fatalf("%s not received", topic)
+			}
+		}
+	}
+	fRecv("test/a")
+	// 发送与订阅变更同时进行
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.MqttWrite("test/c", []byte("x"), 0)
+				s.HealthReport()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	fWrite("test/b")
+	r, err := s.Reload()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(r.Applied, "mqtt subscriptions") || len(r.RestartRequired) > 0 {
+		t.Fatalf("reload result %+v", r)
+	}
+	fRecv("test/b")
+	for len(recv) > 0 {
+		if x := <-recv; x == "test/a" {
+			t.Fatal("test/a is still subscribed")
+		}
+	}
+}
+
+func TestReloadGeneratedNames(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte("trace:\n  endpoint: http://127.0.0.1:4318\n  headers:\n    x-token: abc\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithLogger(logger.NewNilLogger()), FromConfigFile(name),
+		WithRMQConsumer(), WithDiscover(OptDiscoverInfo("", "", "", "/test-root", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 生成的名称在每次加载时都不同
+	s.opt.clirmq.queueName = "old-queue"
+	s.opt.discover.svrInfo.SvrName = "x_old"
+	r, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.RestartRequired) > 0 {
+		t.Fatalf("restart required: %v", r.RestartRequired)
+	}
+	if err := os.WriteFile(name, []byte("trace:\n  endpoint: http://127.0.0.1:4318\n  headers:\n    x-token: def\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(r.RestartRequired, []string{"tracing"}) {
+		t.Fatalf("restart required: %v", r.RestartRequired)
+	}
+}
+
+func TestReloadPureOptions(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	fWrite := func(bolt string) {
+		if err := os.WriteFile(name, []byte("mode: release\ntrace:\n  endpoint: http://127.0.0.1:4318\ndiscover:\n  name: test\n  by: bolt\n  bolt_file: "+bolt+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fWrite("a.db")
+	mode := gin.Mode()
+	defer gin.SetMode(mode)
+	gin.SetMode(gin.TestMode)
+	// 加载选项不应有副作用
+	o := &Opt{}
+	if err := loadOpt(o, []Opts{WithLogger(logger.NewNilLogger()), FromConfigFile(name), SetMode(Release)}); err != nil {
+		t.Fatal(err)
+	}
+	if gin.Mode() != gin.TestMode {
+		t.Fatalf("gin mode %s", gin.Mode())
+	}
+	if o.traceExporter != nil || o.traceOTLP == nil || o.discover.backend != nil || o.discover.boltFile != "a.db" {
+		t.Fatalf("trace exporter %v, otlp %v, discover backend %v", o.traceExporter, o.traceOTLP, o.discover.backend)
+	}
+	s, err := New(WithLogger(logger.NewNilLogger()), FromConfigFile(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stopTracer(context.Background())
+	if gin.Mode() != gin.ReleaseMode || s.tracer == nil {
+		t.Fatalf("gin mode %s, tracer %v", gin.Mode(), s.tracer)
+	}
+	r, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.RestartRequired) > 0 {
+		t.Fatalf("restart required: %v", r.RestartRequired)
+	}
+	fWrite("b.db")
+	if r, err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(r.RestartRequired, []string{"discover"}) {
+		t.Fatalf("restart required: %v", r.RestartRequired)
+	}
+}
+
+func TestReloadWebTimeouts(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	addr := freeAddr(t)
+	fWrite := func(write string) {
+		if err := os.WriteFile(name, []byte("web:\n  bind: "+addr+"\n  write_timeout: "+write+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fWrite("10s")
+	s, err := New(WithLogger(logger.NewNilLogger()), FromConfigFile(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestWeb(t, s, func(e *gin.Engine) {
+		e.GET("/slow", func(c *gin.Context) {
+			time.Sleep(time.Millisecond * 300)
+			c.String(http.StatusOK, "ok")
+		})
+	})
+	fGet := func() error {
+		resp, err := http.Get(srv.URL + "/slow")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+	if err := fGet(); err != nil {
+		t.Fatal(err)
+	}
+	fWrite("100ms")
+	r, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(r.Applied, []string{"web timeouts"}) || len(r.RestartRequired) > 0 {
+		t.Fatalf("reload result %+v", r)
+	}
+	// 新的写超时对之后的请求生效
+	if err := fGet(); err == nil {
+		t.Fatal("the write timeout is not applied")
+	}
+}
@@ -3,5 +3,6 @@ package gofactory
 import "github.com/xyzj/toolbox/tcpfactory"
 
 func (s *Service) TcpWrite(target string, msgs ...*tcpfactory.SendMessage) {
+	s.metrics.tcpWritten.add(float64(sendSize(msgs)))
 	s.tcpserver.WriteTo(target, msgs...)
 }
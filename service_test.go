@@ -0,0 +1,224 @@
+package gofactory
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/tcpfactory"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestRunTCPUsedPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	defer ln.Close()
+	// 端口被占用时启动失败
+	s, err := New(WithLogger(logger.NewNilLogger()), WithStrict(true), WithTCPServer(OptTCPBindAddr(addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("run with a used port")
+	}
+	if s.tcpUp.Load() {
+		t.Fatal("tcp is up with a used port")
+	}
+}
+
+// testTCPConns counts the connections of connTCPClient, the client is copied for each connection
+var testTCPConns atomic.Int32
+
+type connTCPClient struct {
+	tcpfactory.EmptyClient
+}
+
+func (c *connTCPClient) OnConnect(*net.TCPConn) {
+	testTCPConns.Add(1)
+}
+
+func TestRunTCP(t *testing.T) {
+	testTCPConns.Store(0)
+	s, err := New(WithLogger(logger.NewNilLogger()), WithStrict(true), WithTCPServer(OptTCPBindAddr(freeAddr(t)), OptTCPClient(&connTCPClient{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+	for i := 0; !s.tcpUp.Load(); i++ {
+		if i > 50 {
+			t.Fatal("tcp is not up")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	// 就绪检查不连接服务
+	if n := testTCPConns.Load(); n != 0 {
+		t.Fatalf("%d connections before any client", n)
+	}
+	conn, err := net.Dial("tcp", s.opt.tcpServer.bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; testTCPConns.Load() != 1; i++ {
+		if i > 50 {
+			t.Fatal("client is not connected")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunBrokerUsedPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free.Close()
+	for name, o := range map[string]mqttBrokerOpts{
+		"mqtt": func(o *mqttBroker) {
+			o.mqtt = addr
+			o.mqttweb = ""
+		},
+		// http监听在后台绑定
+		"web": func(o *mqttBroker) {
+			o.mqtt = free.Addr().String()
+			o.mqttweb = addr
+		},
+	} {
+		s, err := New(WithLogger(logger.NewNilLogger()), WithStrict(true), WithMQTTBroker(o))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Run(context.Background()); err == nil {
+			t.Fatalf("%s: run with a used port", name)
+		}
+		if s.brokerUp.Load() {
+			t.Fatalf("%s: broker is up with a used port", name)
+		}
+	}
+}
+
+func TestRunBroker(t *testing.T) {
+	web := freeAddr(t)
+	s, err := New(WithLogger(logger.NewNilLogger()), WithStrict(true), WithMQTTBroker(func(o *mqttBroker) {
+		o.mqtt = freeAddr(t)
+		o.mqttweb = web
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+	// http监听在后台绑定，全部可连接后才就绪
+	for i := 0; !s.brokerUp.Load(); i++ {
+		if i > 50 {
+			t.Fatal("broker is not up")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	s, err := New(WithLogger(logger.NewNilLogger()), WithDiscover(OptDiscoverInfo("demo", "", "", "/test-root", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunWebUsedPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// 启动失败时discover尚未启动
+	s, err := New(WithLogger(logger.NewNilLogger()), WithStrict(true),
+		WithWebServer(OptWebBind(ln.Addr().String(), "", "")),
+		WithDiscover(OptDiscoverInfo("demo", "", "", "/test-root", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("run with a used port")
+	}
+}
+
+func TestRunWeb(t *testing.T) {
+	addr := freeAddr(t)
+	s, err := New(WithLogger(logger.NewNilLogger()), WithStrict(true), WithWebServer(OptWebBind(addr, "", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+	var body string
+	for i := 0; ; i++ {
+		if resp, err := http.Get("http://" + addr + "/healthz"); err == nil {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			body = string(b)
+			break
+		}
+		if i > 50 {
+			t.Fatal("web is not up")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if !strings.Contains(body, `"component":"web","name":"`+addr+`","ready":true`) {
+		t.Fatalf("healthz %s", body)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.webUp.Load() {
+		t.Fatal("web is still up")
+	}
+}
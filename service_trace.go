@@ -0,0 +1,113 @@
+package gofactory
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// StartSpan starts a span as a child of the span of ctx, or as the root of a new trace.
+// The returned ctx carries the new span, call Finish on the span when the operation is done.
+// The span is nil when tracing is not enabled, and all its methods do nothing.
+func (s *Service) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return s.tracer.start(ctx, name, kind)
+}
+
+// startChildSpan starts a span only when ctx already carries one,
+// used by the redis and db helpers so that background calls do not create traces.
+func (s *Service) startChildSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if !SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+	return s.tracer.start(ctx, name, kind)
+}
+
+// FlushTraces exports all finished spans right away.
+func (s *Service) FlushTraces(ctx context.Context) error {
+	if s.tracer == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case s.tracer.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startTracer exports the spans in background until stopTracer is called
+func (s *Service) startTracer() {
+	exp := s.opt.traceExporter
+	if c := s.opt.traceOTLP; c != nil {
+		exp = NewOTLPExporter(c.endpoint, c.serviceName, c.headers)
+	}
+	if exp == nil {
+		return
+	}
+	s.tracer = newTracer(exp, s.opt.traceRatio)
+	var ctx context.Context
+	ctx, s.traceCancel = context.WithCancel(context.Background())
+	s.traceDone = make(chan struct{})
+	go func() {
+		defer close(s.traceDone)
+		s.tracer.run(ctx, func(err error) {
+			s.opt.logg.Error("[trace] export error:" + err.Error())
+		})
+	}()
+}
+
+// stopTracer exports the remaining spans and shuts down the exporter
+func (s *Service) stopTracer(ctx context.Context) error {
+	if s.tracer == nil {
+		return nil
+	}
+	s.traceCancel()
+	select {
+	case <-s.traceDone:
+	case <-ctx.Done():
+		return errors.New("[trace] flush not finished:" + ctx.Err().Error())
+	}
+	if err := s.tracer.exporter.Shutdown(ctx); err != nil {
+		return errors.New("[trace] shutdown exporter error:" + err.Error())
+	}
+	return nil
+}
+
+// traceRequest continues the trace of the traceparent header of r, and starts a server span for it.
+// The span is carried by the returned request, pass its context to the ...Ctx helpers to trace the outgoing calls.
+func (s *Service) traceRequest(r *http.Request, route string) (*http.Request, *Span) {
+	if s.tracer == nil {
+		return r, nil
+	}
+	ctx := r.Context()
+	if sc, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+		ctx = ContextWithSpanContext(ctx, sc)
+	}
+	name := r.Method
+	if route != "" {
+		name += " " + route
+	}
+	ctx, span := s.tracer.start(ctx, name, SpanKindServer)
+	if route != "" {
+		span.SetAttr("http.route", route)
+	}
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("url.path", r.URL.Path)
+	return r.WithContext(ctx), span
+}
+
+// finishRequest records the response status of the server span
+func finishRequest(span *Span, status int) {
+	span.SetAttr("http.response.status_code", strconv.Itoa(status))
+	if status >= http.StatusInternalServerError {
+		span.SetError(errors.New(http.StatusText(status)))
+	}
+	span.Finish()
+}
@@ -0,0 +1,127 @@
+package gofactory
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func spanByKind(t *testing.T, spans []*Span, kind SpanKind) *Span {
+	t.Helper()
+	for _, v := range spans {
+		if v.Kind == kind {
+			return v
+		}
+	}
+	t.Fatalf("no span of kind %d in %d spans", kind, len(spans))
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	tp := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	sc, ok := ParseTraceparent(tp)
+	if !ok || !sc.Sampled {
+		t.Fatalf("parse %s: %+v %v", tp, sc, ok)
+	}
+	if x := Traceparent(ContextWithSpanContext(context.Background(), sc)); x != tp {
+		t.Fatalf("got %s, want %s", x, tp)
+	}
+	for _, v := range []string{"", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331", "00-00000000000000000000000000000000-b7ad6b7169203331-01", "zz-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"} {
+		if _, ok := ParseTraceparent(v); ok {
+			t.Fatalf("%q is parsed", v)
+		}
+	}
+}
+
+func TestTraceWebRequest(t *testing.T) {
+	exp := NewMemoryExporter()
+	s := newTestService(t, exp)
+	var got string
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(TraceparentHeader)
+	}))
+	defer down.Close()
+	// 用户在engine中注册的路由
+	srv := newTestWeb(t, s, func(e *gin.Engine) {
+		e.GET("/user/:id", func(c *gin.Context) {
+			req, _ := http.NewRequest(http.MethodGet, down.URL, nil)
+			code, _, _, err := s.DoRequestCtx(c.Request.Context(), req)
+			if err != nil {
+				c.String(http.StatusBadGateway, err.Error())
+				return
+			}
+			c.Status(code)
+		})
+		e.GET("/fail", func(c *gin.Context) {
+			c.Status(http.StatusInternalServerError)
+		})
+	})
+
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/user/1", nil)
+	req.Header.Set(TraceparentHeader, parent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if err := s.FlushTraces(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := exp.Spans()
+	server := spanByKind(t, spans, SpanKindServer)
+	client := spanByKind(t, spans, SpanKindClient)
+	if server.Name != "GET /user/:id" || server.Attributes["http.route"] != "/user/:id" || server.Attributes["http.response.status_code"] != "200" {
+		t.Fatalf("server span %s %v", server.Name, server.Attributes)
+	}
+	if server.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" || server.Parent.String() != "b7ad6b7169203331" {
+		t.Fatalf("server span is not a child of the traceparent: %s %s", server.TraceID, server.Parent)
+	}
+	if client.TraceID != server.TraceID || client.Parent != server.SpanID {
+		t.Fatal("client span is not a child of the server span")
+	}
+	if want := Traceparent(ContextWithSpanContext(context.Background(), client.SpanContext)); got != want {
+		t.Fatalf("downstream got %q, want %q", got, want)
+	}
+
+	exp.Reset()
+	resp, err = http.Get(srv.URL + "/fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	s.FlushTraces(context.Background())
+	server = spanByKind(t, exp.Spans(), SpanKindServer)
+	if server.Err == "" || server.Parent.IsValid() {
+		t.Fatalf("failed request span: err %q parent %s", server.Err, server.Parent)
+	}
+}
+
+func TestTraceRMQReceive(t *testing.T) {
+	exp := NewMemoryExporter()
+	s := newTestService(t, exp)
+	var got SpanContext
+	OptRmqConsumerCtx("ex", "q", false, true, func(ctx context.Context, topic string, body []byte) {
+		got = SpanContextFromContext(ctx)
+	})(&s.opt.clirmq)
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	s.rmqReceived(&amqp.Delivery{RoutingKey: "a.b", Headers: amqp.Table{TraceparentHeader: parent}, Body: []byte("x")})
+	if err := s.FlushTraces(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	span := spanByKind(t, exp.Spans(), SpanKindConsumer)
+	if span.Name != "rmq receive a.b" || span.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" || span.Parent.String() != "b7ad6b7169203331" {
+		t.Fatalf("consumer span %s %s %s", span.Name, span.TraceID, span.Parent)
+	}
+	// 接收函数的ctx携带消费span
+	if got != span.SpanContext {
+		t.Fatalf("receive ctx %+v, want %+v", got, span.SpanContext)
+	}
+}
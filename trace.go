@@ -0,0 +1,457 @@
+package gofactory
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyzj/toolbox/json"
+)
+
+// TraceparentHeader is the W3C trace context header, also used as the mqtt user property and amqp header name.
+const TraceparentHeader = "traceparent"
+
+// SpanKind is the OpenTelemetry span kind.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+	SpanKindProducer
+	SpanKindConsumer
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool   { return s != SpanID{} }
+
+// SpanContext identifies a span across services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a W3C traceparent value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent value.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	sc := SpanContext{}
+	ss := strings.Split(strings.TrimSpace(s), "-")
+	if len(ss) < 4 || len(ss[0]) != 2 || ss[0] == "ff" || len(ss[1]) != 32 || len(ss[2]) != 16 || len(ss[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.DecodeString(ss[0]); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(ss[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(ss[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(ss[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Span is a timed operation of a trace, all methods are safe on a nil span.
+type Span struct {
+	tracer     *tracer
+	Attributes map[string]string
+	Start      time.Time
+	End        time.Time
+	Name       string
+	Err        string
+	Kind       SpanKind
+	Parent     SpanID
+	SpanContext
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetAttr sets an attribute of the span
+func (s *Span) SetAttr(k, v string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attributes[k] = v
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Err = err.Error()
+	s.mu.Unlock()
+}
+
+// Finish ends the span and sends it to the exporter, only the first call takes effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Sampled && s.tracer != nil {
+		s.tracer.put(s)
+	}
+}
+
+// Context returns the span context, an empty one for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.SpanContext
+}
+
+type spanCtxKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc,
+// used to continue a remote trace, e.g. from a traceparent received by a mqtt or rmq consumer.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanCtxKey{}, sc)
+}
+
+// SpanContextFromContext returns the current span context of ctx
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	if sc, ok := ctx.Value(spanCtxKey{}).(SpanContext); ok {
+		return sc
+	}
+	return SpanContext{}
+}
+
+// Traceparent returns the traceparent of the current span of ctx, or "" if there is none
+func Traceparent(ctx context.Context) string {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.Traceparent()
+}
+
+// SpanExporter receives the finished spans in batches.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+// tracer creates spans and sends them to the exporter in background.
+type tracer struct {
+	exporter SpanExporter
+	queue    chan *Span
+	flush    chan chan struct{}
+	ratio    float64
+}
+
+func newTracer(exp SpanExporter, ratio float64) *tracer {
+	return &tracer{
+		exporter: exp,
+		queue:    make(chan *Span, 2048),
+		flush:    make(chan chan struct{}),
+		ratio:    ratio,
+	}
+}
+
+// start creates a span, it is a child of the span of ctx if there is one
+func (t *tracer) start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	p := SpanContextFromContext(ctx)
+	s := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+	if p.IsValid() {
+		s.TraceID = p.TraceID
+		s.Parent = p.SpanID
+		s.Sampled = p.Sampled
+	} else {
+		for !s.TraceID.IsValid() {
+			putUint64(s.TraceID[:8], rand.Uint64())
+			putUint64(s.TraceID[8:], rand.Uint64())
+		}
+		s.Sampled = t.ratio >= 1 || rand.Float64() < t.ratio
+	}
+	for !s.SpanID.IsValid() {
+		putUint64(s.SpanID[:], rand.Uint64())
+	}
+	return context.WithValue(ctx, spanCtxKey{}, s.SpanContext), s
+}
+
+func putUint64(b []byte, v uint64) {
+	for i := range 8 {
+		b[i] = byte(v >> (56 - 8*i))
+	}
+}
+
+func (t *tracer) put(s *Span) {
+	select {
+	case t.queue <- s:
+	default: // 队列已满时丢弃
+	}
+}
+
+// run exports the spans in batches until ctx is done
+func (t *tracer) run(ctx context.Context, onErr func(error)) {
+	batch := make([]*Span, 0, 256)
+	fExport := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ectx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := t.exporter.ExportSpans(ectx, batch); err != nil {
+			onErr(err)
+		}
+		batch = make([]*Span, 0, 256)
+	}
+	fDrain := func() {
+		for {
+			select {
+			case s := <-t.queue:
+				batch = append(batch, s)
+			default:
+				fExport()
+				return
+			}
+		}
+	}
+	t1 := time.NewTicker(time.Second * 5)
+	defer t1.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fDrain()
+			return
+		case done := <-t.flush:
+			fDrain()
+			close(done)
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= 256 {
+				fExport()
+			}
+		case <-t1.C:
+			fExport()
+		}
+	}
+}
+
+// MemoryExporter keeps the exported spans in memory, for tests.
+type MemoryExporter struct {
+	spans  []*Span
+	locker sync.Mutex
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{spans: make([]*Span, 0)}
+}
+
+func (e *MemoryExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.locker.Lock()
+	e.spans = append(e.spans, spans...)
+	e.locker.Unlock()
+	return nil
+}
+
+func (e *MemoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Spans returns the exported spans
+func (e *MemoryExporter) Spans() []*Span {
+	e.locker.Lock()
+	defer e.locker.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+// Reset removes all exported spans
+func (e *MemoryExporter) Reset() {
+	e.locker.Lock()
+	e.spans = make([]*Span, 0)
+	e.locker.Unlock()
+}
+
+// sameExporter reports whether a and b export to the same place,
+// the exporters created from the config file are compared by their config.
+func sameExporter(a, b SpanExporter) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if x, ok := a.(*OTLPExporter); ok {
+		y, ok := b.(*OTLPExporter)
+		return ok && x.url == y.url && x.serviceName == y.serviceName && maps.Equal(x.headers, y.headers)
+	}
+	return sameValue(a, b)
+}
+
+// otlpConfig is the OTLP exporter set by the config file, which is created when the service starts tracing
+type otlpConfig struct {
+	headers     map[string]string
+	endpoint    string
+	serviceName string
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP in json encoding.
+type OTLPExporter struct {
+	cli         *http.Client
+	headers     map[string]string
+	url         string
+	serviceName string
+}
+
+// NewOTLPExporter creates an exporter which posts to endpoint, like http://127.0.0.1:4318,
+// the path /v1/traces is appended when endpoint has no path.
+func NewOTLPExporter(endpoint, serviceName string, headers map[string]string) *OTLPExporter {
+	u := strings.TrimSuffix(endpoint, "/")
+	if i := strings.Index(u, "://"); i < 0 || !strings.Contains(u[i+3:], "/") {
+		u += "/v1/traces"
+	}
+	return &OTLPExporter{
+		cli:         &http.Client{Timeout: time.Second * 10},
+		headers:     headers,
+		url:         u,
+		serviceName: serviceName,
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+	Kind              SpanKind       `json:"kind"`
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	ss := make([]otlpSpan, 0, len(spans))
+	for _, v := range spans {
+		x := otlpSpan{
+			TraceID:           v.TraceID.String(),
+			SpanID:            v.SpanID.String(),
+			Name:              v.Name,
+			Kind:              v.Kind,
+			StartTimeUnixNano: strconv.FormatInt(v.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(v.End.UnixNano(), 10),
+			Attributes:        make([]otlpKeyValue, 0, len(v.Attributes)),
+		}
+		if v.Parent.IsValid() {
+			x.ParentSpanID = v.Parent.String()
+		}
+		v.mu.Lock()
+		for k, a := range v.Attributes {
+			x.Attributes = append(x.Attributes, otlpKeyValue{Key: k, Value: otlpValue{StringValue: a}})
+		}
+		if v.Err != "" {
+			x.Status = otlpStatus{Code: 2, Message: v.Err}
+		}
+		v.mu.Unlock()
+		ss = append(ss, x)
+	}
+	body := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue{StringValue: e.serviceName}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "github.com/xyzj/gofactory"},
+				"spans": ss,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("otlp export failed: " + resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.cli.CloseIdleConnections()
+	return nil
+}
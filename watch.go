@@ -0,0 +1,235 @@
+package gofactory
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xyzj/toolbox/logger"
+	"github.com/xyzj/toolbox/loopfunc"
+)
+
+// ServiceEventType is the kind of change of a service instance
+type ServiceEventType byte
+
+const (
+	// ServiceAdded a new instance is found
+	ServiceAdded ServiceEventType = iota + 1
+	// ServiceUpdated the info of an instance is changed, such as the addresses
+	ServiceUpdated
+	// ServiceRemoved an instance is deregistered or its info is expired
+	ServiceRemoved
+)
+
+func (t ServiceEventType) String() string {
+	switch t {
+	case ServiceAdded:
+		return "added"
+	case ServiceUpdated:
+		return "updated"
+	case ServiceRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// ServiceEvent is a change of a service instance found by discover
+type ServiceEvent struct {
+	Address    map[ProtocolType]string // 注册地址, Removed时为最后的地址
+	Type       ServiceEventType
+	Key        string            // 实例注册键
+	Name       string            // 服务名称
+	Alias      string            // 服务别名
+	RootPath   string            // 业务标识
+	Weight     int               // 负载权重
+	Status     ServiceStatus     // 实例状态
+	Metadata   map[string]string // 自定义信息
+	Tags       []string          // 标签
+	Version    string            // 版本号
+	Zone       string            // 所在区域
+	InstanceID string            // 实例标识,重启后改变
+	StartTime  int64             // 启动时间戳
+}
+
+func newServiceEvent(t ServiceEventType, key string, v svrinfo) ServiceEvent {
+	return ServiceEvent{
+		Type:       t,
+		Key:        key,
+		Name:       v.SvrName,
+		Alias:      v.SvrAlias,
+		RootPath:   v.RootPath,
+		Weight:     v.Weight,
+		Status:     v.Status,
+		Metadata:   maps.Clone(v.Metadata),
+		Tags:       slices.Clone(v.Tags),
+		Version:    v.Version,
+		Zone:       v.Zone,
+		InstanceID: v.InstanceID,
+		StartTime:  v.StartTime,
+		Address:    maps.Clone(v.RegisterAddress),
+	}
+}
+
+// serviceWatcher receives the events of name, or of all services when name is empty
+type serviceWatcher struct {
+	ch      chan ServiceEvent
+	name    string
+	dropped int        // 缓冲区已满时丢弃的事件数
+	closed  bool       // ch已关闭
+	mu      sync.Mutex // 发送与关闭互斥
+}
+
+// send queues e without blocking, e is dropped when the buffer of a slow reader is full
+func (w *serviceWatcher) send(e ServiceEvent) {
+	if w.name != "" && w.name != e.Name {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.ch <- e:
+	default:
+		w.dropped++
+	}
+}
+
+// takeDropped returns the number of the dropped events since the last call
+func (w *serviceWatcher) takeDropped() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.dropped
+	w.dropped = 0
+	return n
+}
+
+func (w *serviceWatcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	close(w.ch)
+}
+
+// snapshotInfos returns the live infos, the update time is cleared so that only real changes are compared
+func (opt *discover) snapshotInfos() map[string]svrinfo {
+	ss := make(map[string]svrinfo)
+	if opt.infos == nil {
+		return ss
+	}
+	opt.infosMu.RLock()
+	defer opt.infosMu.RUnlock()
+	opt.infos.ForEach(func(key string, value svrinfo) bool {
+		value.UpdateTime = ""
+		value.UpdateStamp = 0
+		ss[key] = value
+		return true
+	})
+	return ss
+}
+
+// watch returns a channel which receives the events of name until ctx is done,
+// the current instances are sent as ServiceAdded first.
+func (opt *discover) watch(ctx context.Context, name string) <-chan ServiceEvent {
+	opt.watchMu.Lock()
+	defer opt.watchMu.Unlock()
+	if opt.snapshot == nil {
+		opt.snapshot = opt.snapshotInfos()
+	}
+	w := &serviceWatcher{
+		ch:   make(chan ServiceEvent, len(opt.snapshot)+64),
+		name: name,
+	}
+	for _, k := range slices.Sorted(maps.Keys(opt.snapshot)) {
+		w.send(newServiceEvent(ServiceAdded, k, opt.snapshot[k]))
+	}
+	opt.watchers = append(opt.watchers, w)
+	go func() {
+		<-ctx.Done()
+		opt.watchMu.Lock()
+		defer opt.watchMu.Unlock()
+		opt.watchers = slices.DeleteFunc(opt.watchers, func(x *serviceWatcher) bool { return x == w })
+		w.close()
+	}()
+	return w.ch
+}
+
+// notify compares the live infos with the last snapshot, and sends the changes to the watchers.
+// The events are sent out of the lock, so that a watcher which is not read does not block the others or new watchers.
+func (opt *discover) notify() {
+	ee, ww := opt.changes()
+	for _, w := range ww {
+		for _, e := range ee {
+			w.send(e)
+		}
+		if n := w.takeDropped(); n > 0 && opt.logg != nil {
+			opt.logg.Warning("[discover] watcher of " + cmp.Or(w.name, "all services") + " is not read, " + strconv.Itoa(n) + " events dropped")
+		}
+	}
+}
+
+// changes returns the changes since the last snapshot and the current watchers, the snapshot is updated
+func (opt *discover) changes() ([]ServiceEvent, []*serviceWatcher) {
+	opt.watchMu.Lock()
+	defer opt.watchMu.Unlock()
+	cur := opt.snapshotInfos()
+	if opt.snapshot == nil || len(opt.watchers) == 0 {
+		opt.snapshot = cur
+		return nil, nil
+	}
+	ee := make([]ServiceEvent, 0)
+	for _, k := range slices.Sorted(maps.Keys(cur)) {
+		v := cur[k]
+		old, ok := opt.snapshot[k]
+		switch {
+		case !ok:
+			ee = append(ee, newServiceEvent(ServiceAdded, k, v))
+		case !infoEqual(old, v):
+			ee = append(ee, newServiceEvent(ServiceUpdated, k, v))
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(opt.snapshot)) {
+		if _, ok := cur[k]; !ok {
+			ee = append(ee, newServiceEvent(ServiceRemoved, k, opt.snapshot[k]))
+		}
+	}
+	opt.snapshot = cur
+	return ee, slices.Clone(opt.watchers)
+}
+
+// watchLoop checks the changes of the instances every second until ctx is done
+func (opt *discover) watchLoop(ctx context.Context, l logger.Logger) {
+	go loopfunc.LoopFunc(func(params ...any) {
+		t1 := time.NewTicker(time.Second)
+		defer t1.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t1.C:
+				opt.notify()
+			}
+		}
+	}, "discover watch", l.DefaultWriter())
+}
+
+func infoEqual(a, b svrinfo) bool {
+	return a.SvrName == b.SvrName &&
+		a.SvrAlias == b.SvrAlias &&
+		a.SvrSource == b.SvrSource &&
+		a.RootPath == b.RootPath &&
+		a.Weight == b.Weight &&
+		a.Status == b.Status &&
+		a.Version == b.Version &&
+		a.Zone == b.Zone &&
+		a.InstanceID == b.InstanceID &&
+		a.StartTime == b.StartTime &&
+		slices.Equal(a.Tags, b.Tags) &&
+		maps.Equal(a.Metadata, b.Metadata) &&
+		maps.Equal(a.RegisterAddress, b.RegisterAddress)
+}
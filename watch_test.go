@@ -0,0 +1,161 @@
+package gofactory
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xyzj/toolbox/cache"
+)
+
+func watchInfo(name, addr string) svrinfo {
+	return svrinfo{
+		SvrName:         name,
+		RegisterAddress: map[ProtocolType]string{ProtocolHTTP: addr},
+		UpdateStamp:     time.Now().Unix(),
+	}
+}
+
+// recvEvents returns the events which are already in ch
+func recvEvents(t *testing.T, ch <-chan ServiceEvent) []string {
+	t.Helper()
+	x := make([]string, 0)
+	for {
+		select {
+		case e := <-ch:
+			x = append(x, e.Type.String()+" "+e.Key)
+		default:
+			return x
+		}
+	}
+}
+
+func TestWatchNotify(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *cache.AnyCache[svrinfo])
+		want   []string
+	}{
+		{"none", func(c *cache.AnyCache[svrinfo]) {}, []string{}},
+		{"stamp only", func(c *cache.AnyCache[svrinfo]) {
+			v := watchInfo("svc1", "10.0.0.1:80")
+			v.UpdateStamp++
+			v.UpdateTime = "now"
+			c.Store("a", v)
+		}, []string{}},
+		{"added", func(c *cache.AnyCache[svrinfo]) {
+			c.Store("c", watchInfo("svc2", "10.0.0.3:80"))
+		}, []string{"added c"}},
+		{"removed", func(c *cache.AnyCache[svrinfo]) {
+			c.Delete("a")
+		}, []string{"removed a"}},
+		{"updated", func(c *cache.AnyCache[svrinfo]) {
+			c.Store("b", watchInfo("svc2", "10.0.0.9:80"))
+			v := watchInfo("svc1", "10.0.0.1:80")
+			v.Tags = []string{"canary"}
+			c.Store("a", v)
+		}, []string{"updated a", "updated b"}},
+		{"mixed", func(c *cache.AnyCache[svrinfo]) {
+			c.Delete("a")
+			c.Store("b", watchInfo("svc2", "10.0.0.9:80"))
+			c.Store("c", watchInfo("svc2", "10.0.0.3:80"))
+		}, []string{"updated b", "added c", "removed a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := &discover{infos: cache.NewAnyCache[svrinfo](time.Minute)}
+			defer opt.infos.Close()
+			opt.infos.Store("a", watchInfo("svc1", "10.0.0.1:80"))
+			opt.infos.Store("b", watchInfo("svc2", "10.0.0.2:80"))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := opt.watch(ctx, "")
+			if x := recvEvents(t, ch); !slices.Equal(x, []string{"added a", "added b"}) {
+				t.Fatalf("initial events %v", x)
+			}
+			tt.change(opt.infos)
+			opt.notify()
+			if x := recvEvents(t, ch); !slices.Equal(x, tt.want) {
+				t.Fatalf("events %v, want %v", x, tt.want)
+			}
+			// 没有变化时不再通知
+			opt.notify()
+			if x := recvEvents(t, ch); len(x) > 0 {
+				t.Fatalf("repeated events %v", x)
+			}
+		})
+	}
+}
+
+func TestWatchName(t *testing.T) {
+	opt := &discover{infos: cache.NewAnyCache[svrinfo](time.Minute)}
+	defer opt.infos.Close()
+	opt.infos.Store("a", watchInfo("svc1", "10.0.0.1:80"))
+	opt.infos.Store("b", watchInfo("svc2", "10.0.0.2:80"))
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := opt.watch(ctx, "svc2")
+	opt.infos.Store("c", watchInfo("svc1", "10.0.0.3:80"))
+	opt.infos.Delete("b")
+	opt.notify()
+	if x := recvEvents(t, ch); !slices.Equal(x, []string{"added b", "removed b"}) {
+		t.Fatalf("events %v", x)
+	}
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel is not closed")
+	}
+	opt.watchMu.Lock()
+	defer opt.watchMu.Unlock()
+	if len(opt.watchers) > 0 {
+		t.Fatal("watcher is not removed")
+	}
+}
+
+func TestWatchSlowReader(t *testing.T) {
+	opt := &discover{infos: cache.NewAnyCache[svrinfo](time.Minute)}
+	defer opt.infos.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 第一个watcher从不读取
+	opt.watch(ctx, "")
+	ch := opt.watch(ctx, "")
+	n := 200
+	recv := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range n {
+			opt.infos.Store("k"+strconv.Itoa(i), watchInfo("svc", "10.0.0.1:"+strconv.Itoa(i)))
+			opt.notify()
+			<-recv
+		}
+	}()
+	for i := range n {
+		select {
+		case e := <-ch:
+			if e.Type != ServiceAdded || e.Key != "k"+strconv.Itoa(i) {
+				t.Fatalf("event %s %s", e.Type, e.Key)
+			}
+			recv <- struct{}{}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("event %d is not received", i)
+		}
+	}
+	<-done
+	// 新的watcher不被阻塞
+	select {
+	case e := <-opt.watch(ctx, "svc"):
+		if e.Type != ServiceAdded {
+			t.Fatalf("event %s", e.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("new watcher is blocked")
+	}
+}